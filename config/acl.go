@@ -0,0 +1,118 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// 访问控制规则，支持 IPv4 及 IPv6 的 CIDR
+// 命中拒绝规则的 IP 一律拒绝；配置了允许规则时，只允许命中允许规则的 IP
+type ACL struct {
+	Allow []*net.IPNet // 允许规则
+	Deny  []*net.IPNet // 拒绝规则
+}
+
+// 是否没有任何规则
+func (a *ACL) Empty() bool {
+	return len(a.Allow) == 0 && len(a.Deny) == 0
+}
+
+// 检查 IP 是否允许访问，IP 为空时视为未知，配置了规则时拒绝
+func (a *ACL) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return a.Empty()
+	}
+	if containsIP(a.Deny, ip) {
+		return false
+	}
+	return len(a.Allow) == 0 || containsIP(a.Allow, ip)
+}
+
+// 允许规则字符串，逗号分隔
+func (a *ACL) AllowString() string {
+	return joinCIDRs(a.Allow)
+}
+
+// 拒绝规则字符串，逗号分隔
+func (a *ACL) DenyString() string {
+	return joinCIDRs(a.Deny)
+}
+
+// 解析访问控制规则
+func ParseACL(allow, deny string) (ACL, error) {
+	var acl ACL
+	var err error
+	if acl.Allow, err = ParseCIDRs(allow); err != nil {
+		return ACL{}, err
+	}
+	if acl.Deny, err = ParseCIDRs(deny); err != nil {
+		return ACL{}, err
+	}
+	return acl, nil
+}
+
+// 解析 CIDR 列表，以逗号、竖线或空白分隔，单个 IP 视为 /32 或 /128
+func ParseCIDRs(str string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	items := strings.FieldsFunc(str, func(r rune) bool {
+		return r == ',' || r == '|' || r == ' ' || r == '\t'
+	})
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("illegal ip " + item)
+			}
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.New("illegal cidr " + item)
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// 取地址中的 IP，无法解析时返回 nil
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return HostIP(addr.String())
+}
+
+// 取 host:port 中的 IP，无法解析时返回 nil
+func HostIP(address string) net.IP {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(address)
+}
+
+func containsIP(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinCIDRs(ipNets []*net.IPNet) string {
+	items := make([]string, len(ipNets))
+	for i, ipNet := range ipNets {
+		items[i] = ipNet.String()
+	}
+	return strings.Join(items, ",")
+}
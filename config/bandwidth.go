@@ -0,0 +1,88 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 带宽限制，单位为字节/秒，双向传输合计
+type Bandwidth struct {
+	Rate  uint64 // 速率，0 表示不限制
+	Burst uint64 // 突发量，令牌桶容量，为 0 时等于速率
+}
+
+// 是否不限制
+func (b Bandwidth) Unlimited() bool {
+	return b.Rate == 0
+}
+
+// 填充默认值
+func (b Bandwidth) WithDefaults() Bandwidth {
+	if b.Rate > 0 && b.Burst == 0 {
+		b.Burst = b.Rate
+	}
+	return b
+}
+
+// 转字符串
+func (b Bandwidth) String() string {
+	if b.Unlimited() {
+		return "unlimited"
+	}
+	b = b.WithDefaults()
+	return fmt.Sprintf("%s/s burst %s", FormatSize(b.Rate), FormatSize(b.Burst))
+}
+
+// 解析带宽限制，如 rate = 1M，burst = 2M
+func ParseBandwidth(rate, burst string) (Bandwidth, error) {
+	var bandwidth Bandwidth
+	var err error
+	if bandwidth.Rate, err = ParseSize(rate); err != nil {
+		return Bandwidth{}, err
+	}
+	if bandwidth.Burst, err = ParseSize(burst); err != nil {
+		return Bandwidth{}, err
+	}
+	return bandwidth, nil
+}
+
+// 解析字节数，支持 K、M、G 后缀（1024 进制），可带 B，为空时为 0
+func ParseSize(str string) (uint64, error) {
+	str = strings.ToUpper(strings.TrimSpace(str))
+	if str == "" {
+		return 0, nil
+	}
+	unit := uint64(1)
+	str = strings.TrimSuffix(str, "B")
+	switch {
+	case strings.HasSuffix(str, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(str, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(str, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		str = str[:len(str)-1]
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(str), 10, 64)
+	if err != nil {
+		return 0, errors.New("illegal size " + str)
+	}
+	return value * unit, nil
+}
+
+// 字节数转字符串
+func FormatSize(size uint64) string {
+	switch {
+	case size >= 1<<30 && size%(1<<30) == 0:
+		return fmt.Sprintf("%dG", size>>30)
+	case size >= 1<<20 && size%(1<<20) == 0:
+		return fmt.Sprintf("%dM", size>>20)
+	case size >= 1<<10 && size%(1<<10) == 0:
+		return fmt.Sprintf("%dK", size>>10)
+	}
+	return fmt.Sprintf("%d", size)
+}
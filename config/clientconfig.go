@@ -1,6 +1,7 @@
 package config
 
 import (
+	"chuantou/logging"
 	"encoding/json"
 	"fmt"
 	"github.com/go-ini/ini"
@@ -10,6 +11,7 @@ import (
 	"strings"
 )
 
+// 隧道数已由多路复用取代，仅为兼容旧参数保留
 const (
 	// 默认最大隧道数
 	MinTunnelCount = 1
@@ -18,10 +20,20 @@ const (
 
 // 客户端配置
 type ClientConfig struct {
-	Key         string       // 参考服务端配置 custom-port-key random-port-key
+	Key         string       // 参考服务端配置 custom-port-key random-port-key，以用户身份登录时为用户密钥
+	User        string       // 用户名，服务端配置了用户文件时必须填写
 	ServerAddr  NetAddress   // 服务端地址
 	LocalAddr   []NetAddress // 内网服务地址及映射端口
-	TunnelCount int          // 隧道条数(1-5)
+	TunnelCount int          // 隧道条数(1-5)，已废弃，每个映射只使用一条多路复用连接
+
+	TLS            bool   // 是否使用 TLS 连接服务端
+	TLSCA          string // CA 证书文件，用于校验服务端证书
+	TLSFingerprint string // 服务端证书 SHA-256 指纹，配置后只信任该证书
+	TLSServerName  string // 校验证书时使用的服务端名称，默认为服务端 IP
+
+	MetricsAddr string // 指标接口监听地址，只有端口时监听 127.0.0.1，为空时不启用
+
+	Log logging.Config // 日志配置，读取 [log] 配置
 }
 
 func (p *ClientConfig) Local(port uint32) NetAddress {
@@ -33,6 +45,11 @@ func (p *ClientConfig) Local(port uint32) NetAddress {
 	return NetAddress{}
 }
 
+// 指标接口监听地址，默认只监听本机
+func (p *ClientConfig) MetricsListenAddr() string {
+	return LocalListenAddr(p.MetricsAddr)
+}
+
 // 从参数中解析配置
 func _parseClientConfig(args []string) ClientConfig {
 	if len(args) < 3 {
@@ -92,7 +109,24 @@ func _loadClientConfig() ClientConfig {
 	}
 	args[2] = str_mapping
 	args[3] = client("tunnel-count").String()
-	return _parseClientConfig(args)
+	config := _parseClientConfig(args)
+
+	// 用户名，可选
+	config.User = client("user").String()
+
+	// TLS 配置，配置了 CA 或指纹时自动启用
+	config.TLSCA = client("tls-ca").String()
+	config.TLSFingerprint = client("tls-fingerprint").String()
+	config.TLSServerName = client("tls-server-name").String()
+	config.TLS = client("tls").MustBool(false) || config.TLSCA != "" || config.TLSFingerprint != ""
+
+	// 指标接口，可选
+	config.MetricsAddr = client("metrics-addr").String()
+	// 日志，可选
+	if config.Log, err = ParseLogConfig(cfg.Section("log")); err != nil {
+		log.Fatalln("Fail to parse log config.", err.Error())
+	}
+	return config
 }
 
 // 初始化客户端配置，支持从参数中读取或者从配置文件中读取
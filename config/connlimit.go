@@ -0,0 +1,30 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// 访问者连接限制，各项为 0 时不限制
+type ConnLimit struct {
+	MaxConns     uint32        // 最大同时连接数
+	Rate         uint32        // 每秒新建连接数，允许突发同样数量的连接
+	QueueTimeout time.Duration // 超出限制时排队等待的最长时间，为 0 时立即拒绝
+}
+
+// 是否不限制
+func (c ConnLimit) Unlimited() bool {
+	return c.MaxConns == 0 && c.Rate == 0
+}
+
+// 转字符串
+func (c ConnLimit) String() string {
+	if c.Unlimited() {
+		return "unlimited"
+	}
+	behaviour := "reject"
+	if c.QueueTimeout > 0 {
+		behaviour = "queue " + c.QueueTimeout.String()
+	}
+	return fmt.Sprintf("max %d rate %d/s %s", c.MaxConns, c.Rate, behaviour)
+}
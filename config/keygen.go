@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"log"
 	"strings"
 	"time"
@@ -19,13 +22,19 @@ func padding(cipherText []byte, blockSize int) []byte {
 	return append(cipherText, padText...)
 }
 
-func unPadding(origData []byte) []byte {
+func unPadding(origData []byte) ([]byte, error) {
 	length := len(origData)
+	if length == 0 {
+		return nil, errors.New("empty data")
+	}
 	unPadding := int(origData[length-1])
-	return origData[:(length - unPadding)]
+	if unPadding == 0 || unPadding > length {
+		return nil, errors.New("illegal padding")
+	}
+	return origData[:(length - unPadding)], nil
 }
 
-//AES加密
+// AES加密
 func encrypt(original, key string) (string, error) {
 	originalBytes := []byte(original)
 	keyBytes := []byte(key)
@@ -43,7 +52,7 @@ func encrypt(original, key string) (string, error) {
 	return base64.StdEncoding.EncodeToString(encrypted), nil
 }
 
-//AES解密
+// AES解密
 func decrypt(encrypted, key string) (string, error) {
 	encryptedBytes, err := base64.StdEncoding.DecodeString(encrypted)
 	if err != nil {
@@ -56,10 +65,15 @@ func decrypt(encrypted, key string) (string, error) {
 		return "", err
 	}
 	blockSize := block.BlockSize()
+	if len(encryptedBytes) == 0 || len(encryptedBytes)%blockSize != 0 {
+		return "", errors.New("illegal key length")
+	}
 	blockMode := cipher.NewCBCDecrypter(block, keyBytes[:blockSize])
 	origData := make([]byte, len(encryptedBytes))
 	blockMode.CryptBlocks(origData, encryptedBytes)
-	origData = unPadding(origData)
+	if origData, err = unPadding(origData); err != nil {
+		return "", err
+	}
 
 	return string(origData), nil
 }
@@ -84,12 +98,69 @@ func NewKey(seed string, expired string) (string, error) {
 	return encrypt(expired, seed)
 }
 
-// 检查 key 是否有效
+// 生成客户端使用的短期 key，格式为 到期日期.key，如 2019-12-31.xxxx
+// 到期日期随请求明文发送，服务端据此重新生成 key 校验应答，key 本身不发送
+func NewTrialKey(seed string, expired string) (string, error) {
+	ex, err := time.Parse(timeLayout, expired)
+	if err != nil {
+		ex = time.Now().Add(30 * 24 * time.Hour)
+	}
+	expired = ex.Format(timeLayout)
+	key, err := NewKey(seed, expired)
+	if err != nil {
+		return "", err
+	}
+	return expired + "." + key, nil
+}
+
+// 拆分 NewTrialKey 生成的短期 key，返回到期日期及 key
+func SplitTrialKey(trialKey string) (expired string, key string, ok bool) {
+	index := strings.Index(trialKey, ".")
+	if index < 0 || IsToken(trialKey) {
+		return "", "", false
+	}
+	expired, key = trialKey[:index], trialKey[index+1:]
+	if _, err := time.Parse(timeLayout, expired); err != nil {
+		return "", "", false
+	}
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return "", "", false
+	}
+	return expired, key, true
+}
+
+// 是否为 NewTrialKey 生成的短期 key
+func IsTrialKey(key string) bool {
+	_, _, ok := SplitTrialKey(key)
+	return ok
+}
+
+// 短期 key 的吊销ID，为 key 的 SHA-256 摘要前 8 字节，可写入吊销列表
+func TrialKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "trial-" + hex.EncodeToString(sum[:8])
+}
+
+// 由种子及到期日期重新生成短期 key，返回 key 及到期时间，日期不合法时返回错误
+func TrialKeySecret(seed, expired string) (string, time.Time, error) {
+	ex, err := time.Parse(timeLayout, expired)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	key, err := NewKey(seed, expired)
+	return key, ex, err
+}
+
+// 检查 key 是否有效，key 可以带到期日期前缀
 func CheckKey(seed, key string) (time.Time, bool) {
 	// 超级 key
 	if key == seed {
 		return time.Time{}, true
 	}
+	if _, trialKey, ok := SplitTrialKey(key); ok {
+		key = trialKey
+	}
 
 	seed = fixLength(seed)
 	expired, err := decrypt(key, seed)
@@ -101,6 +172,7 @@ func CheckKey(seed, key string) (time.Time, bool) {
 	ex, err := time.Parse(timeLayout, expired)
 	if err != nil {
 		log.Println("Fail to parse key", err)
+		return time.Time{}, false
 	}
 	return ex, time.Now().Before(ex)
 }
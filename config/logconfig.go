@@ -0,0 +1,57 @@
+package config
+
+import (
+	"chuantou/logging"
+	"fmt"
+	"github.com/go-ini/ini"
+	"strings"
+)
+
+// 解析 [log] 配置，如
+// level = info
+// format = json
+// file = chuantou.log
+// max-size = 10M
+// max-backups = 5
+// debug = heartbeat,dial
+// access = true
+// access-format = json
+// access-file = access.log
+func ParseLogConfig(section *ini.Section) (logging.Config, error) {
+	var cfg logging.Config
+	var err error
+	if cfg.Level, err = logging.ParseLevel(section.Key("level").String()); err != nil {
+		return logging.Config{}, err
+	}
+	if cfg.Format, err = parseLogFormat(section.Key("format").String()); err != nil {
+		return logging.Config{}, err
+	}
+	cfg.File = strings.TrimSpace(section.Key("file").String())
+	if cfg.MaxSize, err = ParseSize(section.Key("max-size").String()); err != nil {
+		return logging.Config{}, err
+	}
+	if cfg.MaxBackups = section.Key("max-backups").MustInt(0); cfg.MaxBackups < 0 {
+		return logging.Config{}, fmt.Errorf("illegal max-backups %d", cfg.MaxBackups)
+	}
+	for _, name := range strings.Split(section.Key("debug").String(), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			cfg.Debug = append(cfg.Debug, strings.ToLower(name))
+		}
+	}
+	// 访问日志，可选
+	cfg.Access = section.Key("access").MustBool(false)
+	if cfg.AccessFormat, err = parseLogFormat(section.Key("access-format").String()); err != nil {
+		return logging.Config{}, err
+	}
+	cfg.AccessFile = strings.TrimSpace(section.Key("access-file").String())
+	return cfg, nil
+}
+
+// 解析日志格式，为空时使用默认格式
+func parseLogFormat(str string) (string, error) {
+	format := strings.ToLower(strings.TrimSpace(str))
+	if format != "" && format != logging.FormatText && format != logging.FormatJSON {
+		return "", fmt.Errorf("illegal log format %s", str)
+	}
+	return format, nil
+}
@@ -1,18 +1,40 @@
 package config
 
 import (
+	"chuantou/geo"
 	"fmt"
 	"log"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	// 网络类型
+	NetworkTCP = "tcp"
+	NetworkUDP = "udp"
+
+	// PROXY 协议版本
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
 )
 
 // 网络地址
 type NetAddress struct {
-	IP    string
-	Port  uint32
-	Port2 uint32 // 备用数据
+	IP      string
+	Port    uint32
+	Port2   uint32 // 备用数据
+	Network string // 网络类型，为空时表示 tcp
+	Domain  string // 访问域名，配置后通过服务端 HTTP 端口按 Host 访问，不再占用访问端口
+	SNI     string // TLS 服务名称，配置后通过服务端 HTTPS 端口按 SNI 访问，不解密 TLS
+
+	ProxyProtocol string     // 连接内网服务时发送的 PROXY 协议版本，v1 或 v2，为空时不发送
+	ACL           ACL        // 访问控制规则，服务端及客户端都会检查访问者 IP
+	Geo           geo.Policy // 国家策略，由服务端按国家 IP 库检查访问者 IP
+	Bandwidth     Bandwidth  // 映射限速，由服务端限速
+	ConnLimit     ConnLimit  // 访问者连接限制，由服务端限制
 }
 
 // 转字符串
@@ -20,9 +42,82 @@ func (t *NetAddress) String() string {
 	return fmt.Sprintf("%s:%d", t.IP, t.Port)
 }
 
+// 映射名称，与服务端一致，域名映射为访问域名，SNI 映射为 SNI，否则为访问端口
+func (t *NetAddress) Mapping() string {
+	if t.Domain != "" {
+		return t.Domain
+	}
+	if t.SNI != "" {
+		return t.SNI
+	}
+	return strconv.Itoa(int(t.Port2))
+}
+
 // 完整字符串
 func (t *NetAddress) FullString() string {
-	return fmt.Sprintf("%s:%d:%d", t.IP, t.Port, t.Port2)
+	address := fmt.Sprintf("%s:%d:%d", t.IP, t.Port, t.Port2)
+	if t.IsUDP() {
+		address = NetworkUDP + "://" + address
+	}
+	if options := t.options(); len(options) > 0 {
+		address += "?" + options.Encode()
+	}
+	return address
+}
+
+// 附加选项
+func (t *NetAddress) options() url.Values {
+	options := url.Values{}
+	if t.Domain != "" {
+		options.Set("domain", t.Domain)
+	}
+	if t.SNI != "" {
+		options.Set("sni", t.SNI)
+	}
+	if t.ProxyProtocol != "" {
+		options.Set("proxy", t.ProxyProtocol)
+	}
+	for _, ipNet := range t.ACL.Allow {
+		options.Add("allow", ipNet.String())
+	}
+	for _, ipNet := range t.ACL.Deny {
+		options.Add("deny", ipNet.String())
+	}
+	if len(t.Geo.Allow) > 0 {
+		options.Set("geo-allow", strings.Join(t.Geo.Allow, "|"))
+	}
+	if len(t.Geo.Deny) > 0 {
+		options.Set("geo-deny", strings.Join(t.Geo.Deny, "|"))
+	}
+	if t.Bandwidth.Rate > 0 {
+		options.Set("bandwidth", FormatSize(t.Bandwidth.Rate))
+	}
+	if t.Bandwidth.Burst > 0 {
+		options.Set("burst", FormatSize(t.Bandwidth.Burst))
+	}
+	if t.ConnLimit.MaxConns > 0 {
+		options.Set("max-conns", strconv.Itoa(int(t.ConnLimit.MaxConns)))
+	}
+	if t.ConnLimit.Rate > 0 {
+		options.Set("conn-rate", strconv.Itoa(int(t.ConnLimit.Rate)))
+	}
+	if t.ConnLimit.QueueTimeout > 0 {
+		options.Set("queue", t.ConnLimit.QueueTimeout.String())
+	}
+	return options
+}
+
+// 网络类型，用于拨号及监听
+func (t *NetAddress) NetworkType() string {
+	if t.IsUDP() {
+		return NetworkUDP
+	}
+	return NetworkTCP
+}
+
+// 是否为 UDP 地址
+func (t *NetAddress) IsUDP() bool {
+	return t.Network == NetworkUDP
 }
 
 // 解析多个地址
@@ -41,12 +136,35 @@ func ParseNetAddresses(addresses string) ([]NetAddress, bool) {
 
 /**
  * @Description: // 解析单个网络地址 支持两个端口的解析，格式如192.168.1.100:3389:13389
+ * 支持网络类型前缀，如 udp://127.0.0.1:53:10053，默认为 tcp
+ * 支持附加选项，如 127.0.0.1:8080?domain=app.example.com 或 127.0.0.1:443?sni=app.example.com
+ * 访问控制如 127.0.0.1:3306:13306?allow=10.0.0.0/8|192.168.0.0/16&deny=10.1.0.0/16
+ * 国家策略如 127.0.0.1:3389:13389?geo-allow=CN 或 127.0.0.1:3389:13389?geo-deny=CN
+ * 限速如 127.0.0.1:873:10873?bandwidth=1M&burst=2M，单位字节/秒
+ * 连接限制如 127.0.0.1:3389:13389?max-conns=10&conn-rate=5&queue=5s，未配置 queue 时超出限制立即拒绝
  * @param address
  * @return NetAddress
  * @return bool
  */
 func ParseNetAddress(address string) (NetAddress, bool) {
-	arr := strings.Split(strings.TrimSpace(address), ":")
+	address = strings.TrimSpace(address)
+	network := ""
+	if index := strings.Index(address, "://"); index >= 0 {
+		network = strings.ToLower(address[:index])
+		address = address[index+3:]
+		if network != NetworkTCP && network != NetworkUDP {
+			log.Println("Fail to parse address network")
+			return NetAddress{}, false
+		}
+		if network == NetworkTCP {
+			network = ""
+		}
+	}
+	query := ""
+	if index := strings.Index(address, "?"); index >= 0 {
+		address, query = address[:index], address[index+1:]
+	}
+	arr := strings.Split(address, ":")
 	if len(arr) < 2 {
 		log.Println("Fail to parse address")
 		return NetAddress{}, false
@@ -73,7 +191,106 @@ func ParseNetAddress(address string) (NetAddress, bool) {
 			return NetAddress{}, false
 		}
 	}
-	return NetAddress{ip, uint32(port), uint32(port2)}, true
+	result := NetAddress{IP: ip, Port: port, Port2: port2, Network: network}
+	if !parseAddressOptions(&result, query) {
+		return NetAddress{}, false
+	}
+	return result, true
+}
+
+// 解析附加选项，不认识的选项视为错误，避免配置写错却不生效
+func parseAddressOptions(address *NetAddress, query string) bool {
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		log.Println("Fail to parse address options")
+		return false
+	}
+	for key := range options {
+		value := strings.TrimSpace(options.Get(key))
+		switch key {
+		case "domain":
+			if address.IsUDP() || value == "" {
+				log.Println("Fail to parse address domain")
+				return false
+			}
+			address.Domain = strings.ToLower(value)
+		case "sni":
+			if address.IsUDP() || value == "" {
+				log.Println("Fail to parse address sni")
+				return false
+			}
+			address.SNI = strings.ToLower(value)
+		case "proxy":
+			value = strings.ToLower(value)
+			// UDP 只支持 v2
+			if value != ProxyProtocolV2 && (value != ProxyProtocolV1 || address.IsUDP()) {
+				log.Println("Fail to parse address proxy protocol")
+				return false
+			}
+			address.ProxyProtocol = value
+		case "allow", "deny":
+			// 多个规则以竖线分隔或重复配置，如 allow=10.0.0.0/8|192.168.0.0/16
+			ipNets, err := ParseCIDRs(strings.Join(options[key], "|"))
+			if err != nil || len(ipNets) == 0 {
+				log.Println("Fail to parse address acl", key)
+				return false
+			}
+			if key == "allow" {
+				address.ACL.Allow = ipNets
+			} else {
+				address.ACL.Deny = ipNets
+			}
+		case "geo-allow", "geo-deny":
+			policy, err := geo.ParsePolicy(strings.Join(options[key], "|"), "")
+			if err != nil || len(policy.Allow) == 0 {
+				log.Println("Fail to parse address geo policy", key)
+				return false
+			}
+			if key == "geo-allow" {
+				address.Geo.Allow = policy.Allow
+			} else {
+				address.Geo.Deny = policy.Allow
+			}
+		case "bandwidth", "burst":
+			size, err := ParseSize(value)
+			if err != nil || size == 0 {
+				log.Println("Fail to parse address", key)
+				return false
+			}
+			if key == "bandwidth" {
+				address.Bandwidth.Rate = size
+			} else {
+				address.Bandwidth.Burst = size
+			}
+		case "max-conns", "conn-rate":
+			count, err := strconv.Atoi(value)
+			if err != nil || count <= 0 {
+				log.Println("Fail to parse address", key)
+				return false
+			}
+			if key == "max-conns" {
+				address.ConnLimit.MaxConns = uint32(count)
+			} else {
+				address.ConnLimit.Rate = uint32(count)
+			}
+		case "queue":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				log.Println("Fail to parse address queue timeout")
+				return false
+			}
+			address.ConnLimit.QueueTimeout = timeout
+		default:
+			log.Println("Unknown address option", key)
+			return false
+		}
+	}
+	// 一个映射只能选择一种共用端口的方式
+	if address.Domain != "" && address.SNI != "" {
+		log.Println("Domain and sni can not be used together")
+		return false
+	}
+	return true
 }
 
 // 解析单个端口
@@ -0,0 +1,198 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 吊销列表，记录已吊销的令牌ID及短期 key 的吊销ID，从文件加载，文件修改或删除后自动重新加载
+// 使用用户 secret 登录的客户端应在用户文件中设置 enabled = false 停用用户
+//
+// 文件格式：每行一个ID，其后可附吊销原因，# 开头为注释
+// a20313d86dbd45d6 leaked
+// trial-5d41402abc4b2a76 leaked
+type RevocationList struct {
+	file    string
+	mutex   sync.RWMutex
+	ids     map[string]string // 令牌ID -> 吊销原因
+	modTime time.Time         // 最后加载时文件的修改时间
+}
+
+// 使用给定令牌ID创建吊销列表
+func NewRevocationList(ids ...string) *RevocationList {
+	list := &RevocationList{ids: make(map[string]string)}
+	for _, id := range ids {
+		list.ids[id] = ""
+	}
+	return list
+}
+
+// 从文件加载吊销列表，文件不存在时为空列表
+func LoadRevocationList(file string) (*RevocationList, error) {
+	list := &RevocationList{file: file, ids: make(map[string]string)}
+	if err := list.Reload(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// 重新加载吊销列表，文件不存在时清空，读取失败时保留原有内容
+func (l *RevocationList) Reload() error {
+	if l == nil || l.file == "" {
+		return nil
+	}
+	info, err := os.Stat(l.file)
+	if os.IsNotExist(err) {
+		l.mutex.Lock()
+		cleared := len(l.ids)
+		l.ids, l.modTime = make(map[string]string), time.Time{}
+		l.mutex.Unlock()
+		if cleared > 0 {
+			log.Printf("Revocation file %s not found, clear %d revoked tokens\n", l.file, cleared)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ids, err := parseRevocations(l.file)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.ids = ids
+	l.modTime = info.ModTime()
+	l.mutex.Unlock()
+	log.Printf("Load %d revoked tokens from %s\n", len(ids), l.file)
+	return nil
+}
+
+// 文件修改或删除后重新加载
+func (l *RevocationList) ReloadIfModified() error {
+	if l == nil || l.file == "" {
+		return nil
+	}
+	info, err := os.Stat(l.file)
+	if os.IsNotExist(err) {
+		return l.Reload()
+	}
+	if err != nil {
+		return err
+	}
+	l.mutex.RLock()
+	modified := !info.ModTime().Equal(l.modTime)
+	l.mutex.RUnlock()
+	if !modified {
+		return nil
+	}
+	return l.Reload()
+}
+
+// 令牌是否已吊销
+func (l *RevocationList) Revoked(id string) bool {
+	if l == nil || id == "" {
+		return false
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	_, exists := l.ids[id]
+	return exists
+}
+
+// 吊销令牌，配置了文件时追加写入
+func (l *RevocationList) Revoke(id, reason string) error {
+	id = strings.TrimSpace(id)
+	if id == "" || strings.ContainsAny(id, " \t\r\n#") {
+		return fmt.Errorf("illegal token id %q", id)
+	}
+	reason = strings.Join(strings.Fields(reason), " ")
+	if l.file != "" {
+		if err := appendRevocation(l.file, id, reason); err != nil {
+			return err
+		}
+	}
+	l.mutex.Lock()
+	l.ids[id] = reason
+	l.mutex.Unlock()
+	return nil
+}
+
+// 已吊销的令牌数
+func (l *RevocationList) Len() int {
+	if l == nil {
+		return 0
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.ids)
+}
+
+// 吊销令牌，追加写入吊销列表文件，token 可以是令牌、令牌ID或短期 key
+func RevokeToken(file, token, reason string) (string, error) {
+	id := token
+	if _, key, ok := SplitTrialKey(token); ok {
+		id = TrialKeyID(key)
+	} else if IsToken(token) {
+		signed, _, err := SplitToken(token)
+		if err != nil {
+			return "", err
+		}
+		claims, err := parseClaims(signed)
+		if err != nil {
+			return "", err
+		}
+		id = claims.ID
+	}
+	list, err := LoadRevocationList(file)
+	if err != nil {
+		return "", err
+	}
+	return id, list.Revoke(id, reason)
+}
+
+// 解析吊销列表文件
+func parseRevocations(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		reason := ""
+		if len(fields) == 2 {
+			reason = strings.TrimSpace(fields[1])
+		}
+		ids[fields[0]] = reason
+	}
+	return ids, scanner.Err()
+}
+
+// 追加一条吊销记录
+func appendRevocation(file, id, reason string) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	line := id
+	if reason != "" {
+		line += " " + reason
+	}
+	if _, err = fmt.Fprintln(f, line); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
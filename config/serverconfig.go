@@ -1,17 +1,156 @@
 package config
 
 import (
+	"chuantou/geo"
+	"chuantou/logging"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
 	"github.com/go-ini/ini"
 	"log"
 	"strings"
+	"time"
 )
 
 // 服务端配置
 type ServerConfig struct {
-	Port          uint32 // 服务端口
-	Key           string // 6-16 个字符，用于身份校验
-	MinAccessPort uint32 // 最小访问端口，最小值 1024
-	MaxAccessPort uint32 // 最大访问端口，最大值 65535
+	Port          uint32     // 服务端口
+	Key           string     // 6-16 个字符，用于身份校验
+	MinAccessPort uint32     // 最小访问端口，最小值 1024
+	MaxAccessPort uint32     // 最大访问端口，最大值 65535
+	TLSCert       string     // TLS 证书文件，与 TLSKey 同时配置时启用 TLS
+	TLSKey        string     // TLS 私钥文件
+	HTTPPort      uint32     // HTTP 端口，配置后按 Host 将访问转发到对应域名的映射，0 表示不启用
+	HTTPSPort     uint32     // HTTPS 端口，配置后按 SNI 将 TLS 连接原样转发到对应的映射，0 表示不启用
+	UsersFile     string     // 用户文件，配置后客户端须以用户身份登录，不再接受共享 Key
+	Users         *UserStore // 用户列表，为空时只使用共享 Key 校验
+
+	TokenKeyFile string             // 令牌签名私钥文件
+	TokenKey     ed25519.PrivateKey // 令牌签名私钥，配置后接受签名令牌
+	LegacyKeys   bool               // 配置了令牌私钥时，是否仍接受共享 Key
+
+	RevocationFile string          // 吊销列表文件
+	Revocations    *RevocationList // 吊销列表，心跳时检查文件是否修改
+	HeartBeat      time.Duration   // 心跳间隔，为 0 时使用默认值
+
+	Ban BanConfig // 鉴权失败封禁策略
+	ACL ACL       // 全局访问控制规则，对所有映射生效
+
+	GeoIPFiles string        // 国家 IP 段文件，如 CN=cn_ips.txt
+	GeoIP      *geo.Database // 国家 IP 库，心跳时检查文件是否修改，映射可按国家限制访问者
+
+	Bandwidth       Bandwidth // 全局限速，所有映射合计
+	ClientBandwidth Bandwidth // 每个客户端的默认限速，按机器码统计
+
+	TrafficFile string // 流量统计文件，按月统计用户及映射的流量，心跳时保存，为空时不保存
+
+	AdminAddr  string // 管理接口监听地址，只有端口时监听 127.0.0.1，为空时不启用
+	AdminToken string // 管理接口令牌，请求须携带 Authorization: Bearer <token>
+
+	DashboardPassword string // 控制台密码，在管理接口地址上提供网页控制台，为空时不启用
+
+	MetricsAddr string // 指标接口监听地址，只有端口时监听 127.0.0.1，为空时不启用
+
+	ControlSocket string // 本地控制台 Unix Socket 路径，供 -ctl 命令使用，为空时不启用
+
+	Log logging.Config // 日志配置，读取 [log] 配置
+}
+
+// 鉴权失败封禁策略，各项为 0 时使用默认值
+type BanConfig struct {
+	Threshold   int           // 统计时间内失败多少次后封禁，小于 0 表示不封禁
+	Window      time.Duration // 失败次数统计时间
+	Duration    time.Duration // 首次封禁时长，之后每次封禁时长加倍
+	MaxDuration time.Duration // 最长封禁时长
+	File        string        // 封禁列表文件，重启后仍然有效，为空时不保存
+}
+
+// 封禁策略默认值
+const (
+	DefaultBanThreshold   = 5
+	DefaultBanWindow      = 10 * time.Minute
+	DefaultBanDuration    = time.Minute
+	DefaultBanMaxDuration = 24 * time.Hour
+)
+
+// 填充默认值
+func (c BanConfig) WithDefaults() BanConfig {
+	if c.Threshold == 0 {
+		c.Threshold = DefaultBanThreshold
+	}
+	if c.Window <= 0 {
+		c.Window = DefaultBanWindow
+	}
+	if c.Duration <= 0 {
+		c.Duration = DefaultBanDuration
+	}
+	if c.MaxDuration <= 0 {
+		c.MaxDuration = DefaultBanMaxDuration
+	}
+	if c.MaxDuration < c.Duration {
+		c.MaxDuration = c.Duration
+	}
+	return c
+}
+
+// 默认心跳间隔
+const DefaultHeartBeat = 60 * time.Second
+
+// 心跳间隔
+func (c *ServerConfig) HeartBeatInterval() time.Duration {
+	if c.HeartBeat <= 0 {
+		return DefaultHeartBeat
+	}
+	return c.HeartBeat
+}
+
+// 是否接受共享 Key
+// 未配置令牌私钥时保持原有行为
+func (c *ServerConfig) LegacyKeysAllowed() bool {
+	return c.TokenKey == nil || c.LegacyKeys
+}
+
+// 管理接口监听地址，默认只监听本机
+func (c *ServerConfig) AdminListenAddr() string {
+	return LocalListenAddr(c.AdminAddr)
+}
+
+// 指标接口监听地址，默认只监听本机
+func (c *ServerConfig) MetricsListenAddr() string {
+	return LocalListenAddr(c.MetricsAddr)
+}
+
+// 控制台 Socket 路径，取 config.ini 中服务端的配置，未配置时服务端不会监听，返回错误
+func LoadControlSocket() (string, error) {
+	cfg, err := ini.Load("config.ini")
+	if err != nil {
+		return "", fmt.Errorf("fail to load config.ini, specify the socket with -socket. %s", err.Error())
+	}
+	socket := strings.TrimSpace(cfg.Section("server").Key("ctl-socket").String())
+	if socket == "" {
+		return "", errors.New("ctl-socket is not configured in config.ini, the server does not listen on a control socket")
+	}
+	return socket, nil
+}
+
+// 规范化监听地址，只有端口时监听 127.0.0.1，为空时返回空
+func LocalListenAddr(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return ""
+	}
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return addr
+}
+
+// 是否启用 TLS
+func (c *ServerConfig) TLSEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
 }
 
 // 检查端口是否在允许范围内，不含边界
@@ -52,12 +191,22 @@ func _parseServerConfig(args []string) ServerConfig {
 		log.Fatalln("Fail to parse args.", args)
 	}
 
-	return ServerConfig{
+	config := ServerConfig{
 		Port:          port,
 		Key:           key,
 		MinAccessPort: minAccessPort,
 		MaxAccessPort: maxAccessPort,
 	}
+
+	// 3 4 tls cert/key，可选
+	if len(args) >= 5 {
+		config.TLSCert = strings.TrimSpace(args[3])
+		config.TLSKey = strings.TrimSpace(args[4])
+		if (config.TLSCert == "") != (config.TLSKey == "") {
+			log.Fatalln("TLS cert and key must be configured together.", args)
+		}
+	}
+	return config
 }
 
 // 从配置文件中加载配置
@@ -70,12 +219,112 @@ func _loadServerConfig() ServerConfig {
 		return cfg.Section("server").Key(key)
 	}
 
-	args := make([]string, 3)
+	args := make([]string, 5)
 	args[0] = server("key").String()
 	args[1] = server("port").String()
 	args[2] = server("access-port-range").String()
+	args[3] = server("tls-cert").String()
+	args[4] = server("tls-key").String()
+	config := _parseServerConfig(args)
 
-	return _parseServerConfig(args)
+	// HTTP 端口，可选
+	if httpPort := server("http-port").String(); httpPort != "" {
+		port, err := parsePort(httpPort)
+		if err != nil || !checkPort(port) {
+			log.Fatalln("Fail to parse http-port.", httpPort)
+		}
+		config.HTTPPort = port
+	}
+	// HTTPS 端口，可选
+	if httpsPort := server("https-port").String(); httpsPort != "" {
+		port, err := parsePort(httpsPort)
+		if err != nil || !checkPort(port) {
+			log.Fatalln("Fail to parse https-port.", httpsPort)
+		}
+		config.HTTPSPort = port
+	}
+	// 用户文件，可选
+	if usersFile := server("users-file").String(); usersFile != "" {
+		users, err := LoadUserStore(usersFile)
+		if err != nil {
+			log.Fatalln("Fail to load users-file.", err.Error())
+		}
+		config.UsersFile = usersFile
+		config.Users = users
+	}
+	// 令牌私钥，可选
+	if tokenKeyFile := server("token-key").String(); tokenKeyFile != "" {
+		tokenKey, err := LoadTokenPrivateKey(tokenKeyFile)
+		if err != nil {
+			log.Fatalln("Fail to load token-key.", err.Error())
+		}
+		config.TokenKeyFile = tokenKeyFile
+		config.TokenKey = tokenKey
+		config.LegacyKeys = server("legacy-keys").MustBool(false)
+	}
+	// 吊销列表，可选
+	if revocationFile := server("revocation-file").String(); revocationFile != "" {
+		revocations, err := LoadRevocationList(revocationFile)
+		if err != nil {
+			log.Fatalln("Fail to load revocation-file.", err.Error())
+		}
+		config.RevocationFile = revocationFile
+		config.Revocations = revocations
+	}
+	// 心跳间隔，单位秒，可选
+	if heartBeat := server("heartbeat-interval").MustInt(0); heartBeat > 0 {
+		config.HeartBeat = time.Duration(heartBeat) * time.Second
+	}
+	// 封禁策略，可选，ban-threshold 为 0 时不封禁
+	if threshold := server("ban-threshold").String(); threshold != "" {
+		if config.Ban.Threshold = server("ban-threshold").MustInt(DefaultBanThreshold); config.Ban.Threshold <= 0 {
+			config.Ban.Threshold = -1
+		}
+	}
+	config.Ban.Window = time.Duration(server("ban-window").MustInt(0)) * time.Second
+	config.Ban.Duration = time.Duration(server("ban-duration").MustInt(0)) * time.Second
+	config.Ban.MaxDuration = time.Duration(server("ban-max-duration").MustInt(0)) * time.Second
+	config.Ban.File = server("ban-file").String()
+	// 全局访问控制，可选
+	if config.ACL, err = ParseACL(server("allow").String(), server("deny").String()); err != nil {
+		log.Fatalln("Fail to parse allow/deny.", err.Error())
+	}
+	// 限速，可选
+	if config.Bandwidth, err = ParseBandwidth(server("bandwidth").String(), server("bandwidth-burst").String()); err != nil {
+		log.Fatalln("Fail to parse bandwidth.", err.Error())
+	}
+	if config.ClientBandwidth, err = ParseBandwidth(server("client-bandwidth").String(), server("client-bandwidth-burst").String()); err != nil {
+		log.Fatalln("Fail to parse client-bandwidth.", err.Error())
+	}
+	// 流量统计文件，可选
+	config.TrafficFile = server("traffic-file").String()
+	// 管理接口，可选，启用时必须配置令牌
+	config.AdminAddr = server("admin-addr").String()
+	config.AdminToken = server("admin-token").String()
+	config.DashboardPassword = server("dashboard-password").String()
+	if config.AdminAddr != "" && config.AdminToken == "" && config.DashboardPassword == "" {
+		log.Fatalln("admin-token or dashboard-password is required when admin-addr is set")
+	}
+	// 指标接口，可选
+	config.MetricsAddr = server("metrics-addr").String()
+	// 本地控制台，可选
+	config.ControlSocket = server("ctl-socket").String()
+	// 日志，可选
+	if config.Log, err = ParseLogConfig(cfg.Section("log")); err != nil {
+		log.Fatalln("Fail to parse log config.", err.Error())
+	}
+	// 国家 IP 库，可选
+	if geoIPFiles := server("geoip-files").String(); geoIPFiles != "" {
+		files, err := geo.ParseFiles(geoIPFiles)
+		if err != nil {
+			log.Fatalln("Fail to parse geoip-files.", err.Error())
+		}
+		if config.GeoIP, err = geo.Load(files); err != nil {
+			log.Fatalln("Fail to load geoip-files.", err.Error())
+		}
+		config.GeoIPFiles = geoIPFiles
+	}
+	return config
 }
 
 // 初始化服务端配置，支持从参数中读取或者从配置文件中读取
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// 令牌前缀，用于与旧版 key 区分
+const tokenPrefix = "ct1."
+
+// 令牌有效期默认值
+const tokenDefaultValidity = 30 * 24 * time.Hour
+
+// 令牌声明
+type TokenClaims struct {
+	ID         string `json:"jti"`             // 令牌ID，用于吊销
+	Subject    string `json:"sub"`             // 持有者
+	IssuedAt   int64  `json:"iat"`             // 签发时间，Unix 秒
+	ExpiresAt  int64  `json:"exp"`             // 到期时间，Unix 秒
+	Ports      string `json:"ports,omitempty"` // 允许使用的访问端口范围，格式如 10000-10100,12000，为空时不限制
+	MaxTunnels int    `json:"max,omitempty"`   // 最大隧道数，0 表示不限制
+}
+
+// 到期时间
+func (c *TokenClaims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// 是否已到期
+func (c *TokenClaims) Expired(now time.Time) bool {
+	return !now.Before(c.Expiry())
+}
+
+// 转为用户，用户名为令牌持有者
+func (c *TokenClaims) User() (User, error) {
+	portRanges, err := ParsePortRanges(c.Ports)
+	if err != nil {
+		return User{}, err
+	}
+	return User{
+		Name:        c.Subject,
+		PortRanges:  portRanges,
+		MaxMappings: c.MaxTunnels,
+		Enabled:     true,
+	}, nil
+}
+
+// 是否为令牌格式
+func IsToken(key string) bool {
+	return strings.HasPrefix(key, tokenPrefix)
+}
+
+// 生成签名密钥对，PEM 格式
+func NewTokenKey() (privatePEM, publicPEM []byte, err error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	privateDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicDer, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	privatePEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDer})
+	publicPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer})
+	return privatePEM, publicPEM, nil
+}
+
+// 读取签名私钥
+func LoadTokenPrivateKey(file string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an ed25519 private key")
+	}
+	return privateKey, nil
+}
+
+// 读取验签公钥
+func LoadTokenPublicKey(file string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an ed25519 public key")
+	}
+	return publicKey, nil
+}
+
+// 解析到期时间，支持日期或日期加时间，为空时默认一个月后到期
+func ParseExpiry(expired string) (time.Time, error) {
+	expired = strings.TrimSpace(expired)
+	if expired == "" {
+		return time.Now().Add(tokenDefaultValidity), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", timeLayout} {
+		if ex, err := time.ParseInLocation(layout, expired, time.Local); err == nil {
+			return ex, nil
+		}
+	}
+	return time.Time{}, errors.New("illegal expired time " + expired)
+}
+
+// 签发令牌，未指定令牌ID时随机生成
+// 格式：前缀.声明.签名，声明及签名为 base64url 编码，签名覆盖前缀及声明
+func NewToken(privateKey ed25519.PrivateKey, claims TokenClaims) (string, error) {
+	if claims.Subject == "" {
+		return "", errors.New("token subject is required")
+	}
+	if _, err := ParsePortRanges(claims.Ports); err != nil {
+		return "", err
+	}
+	if claims.ID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		claims.ID = hex.EncodeToString(id)
+	}
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = time.Now().Unix()
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := tokenPrefix + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(privateKey, []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// 拆分令牌，返回签名部分及签名
+// 签名部分只包含声明，可以公开传输，签名是令牌持有者的密钥
+func SplitToken(token string) (string, []byte, error) {
+	if !IsToken(token) {
+		return "", nil, errors.New("not a token")
+	}
+	index := strings.LastIndex(token, ".")
+	if index <= len(tokenPrefix) {
+		return "", nil, errors.New("malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[index+1:])
+	if err != nil {
+		return "", nil, errors.New("malformed token signature")
+	}
+	return token[:index], signature, nil
+}
+
+// 解析令牌声明
+func parseClaims(signed string) (TokenClaims, error) {
+	if !IsToken(signed) {
+		return TokenClaims{}, errors.New("not a token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(signed[len(tokenPrefix):])
+	if err != nil {
+		return TokenClaims{}, errors.New("malformed token claims")
+	}
+	var claims TokenClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return TokenClaims{}, fmt.Errorf("malformed token claims. %s", err.Error())
+	}
+	return claims, nil
+}
+
+// 解析令牌并校验签名，不检查是否到期
+func ParseToken(publicKey ed25519.PublicKey, token string) (TokenClaims, error) {
+	signed, signature, err := SplitToken(token)
+	if err != nil {
+		return TokenClaims{}, err
+	}
+	if len(publicKey) != ed25519.PublicKeySize || !ed25519.Verify(publicKey, []byte(signed), signature) {
+		return TokenClaims{}, errors.New("invalid token signature")
+	}
+	return parseClaims(signed)
+}
+
+// 由签名部分还原令牌签名，返回声明及签名，不检查是否到期
+// Ed25519 签名是确定的，服务端无需保存令牌即可得到持有者的密钥
+func SignClaims(privateKey ed25519.PrivateKey, signed string) (TokenClaims, []byte, error) {
+	claims, err := parseClaims(signed)
+	if err != nil {
+		return claims, nil, err
+	}
+	return claims, ed25519.Sign(privateKey, []byte(signed)), nil
+}
+
+// 校验令牌，签名有效且未到期时返回声明
+func CheckToken(publicKey ed25519.PublicKey, token string) (TokenClaims, error) {
+	claims, err := ParseToken(publicKey, token)
+	if err != nil {
+		return claims, err
+	}
+	if claims.Expired(time.Now()) {
+		return claims, errors.New("token expired at " + claims.Expiry().Format(time.RFC3339))
+	}
+	return claims, nil
+}
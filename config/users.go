@@ -0,0 +1,172 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-ini/ini"
+	"log"
+	"strings"
+	"sync"
+)
+
+// 端口范围，包含边界
+type PortRange struct {
+	Min uint32
+	Max uint32
+}
+
+// 是否包含端口
+func (r PortRange) Contains(port uint32) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+// 转字符串
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return fmt.Sprintf("%d", r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// 用户
+type User struct {
+	Name        string      // 用户名
+	Secret      string      // 用户密钥，用于身份校验
+	PortRanges  []PortRange // 允许使用的访问端口范围，为空时使用服务端的访问端口范围
+	MaxMappings int         // 最大映射数，0 表示不限制
+	Enabled     bool        // 是否启用
+
+	MonthlyQuota uint64 // 每月流量配额，单位字节，0 表示不限制
+}
+
+// 检查访问端口是否允许使用
+func (u *User) PortAllowed(port uint32) bool {
+	if len(u.PortRanges) == 0 {
+		return true
+	}
+	for _, portRange := range u.PortRanges {
+		if portRange.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// 用户列表，从文件加载，支持重新加载
+type UserStore struct {
+	file  string
+	mutex sync.RWMutex
+	users map[string]User
+}
+
+// 使用给定用户创建用户列表
+func NewUserStore(users ...User) *UserStore {
+	store := &UserStore{users: make(map[string]User)}
+	for _, user := range users {
+		store.users[user.Name] = user
+	}
+	return store
+}
+
+// 从文件加载用户列表
+func LoadUserStore(file string) (*UserStore, error) {
+	store := &UserStore{file: file}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// 重新加载用户文件，失败时保留原有用户
+func (s *UserStore) Reload() error {
+	if s.file == "" {
+		return nil
+	}
+	users, err := parseUsers(s.file)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.users = users
+	s.mutex.Unlock()
+	log.Printf("Load %d users from %s\n", len(users), s.file)
+	return nil
+}
+
+// 查找用户
+func (s *UserStore) Get(name string) (User, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	user, exists := s.users[name]
+	return user, exists
+}
+
+// 用户数
+func (s *UserStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.users)
+}
+
+// 解析用户文件，每个分区为一个用户
+//
+// [alice]
+// secret = 123456
+// port-range = 10000-10100,12000
+// max-mappings = 5
+// monthly-quota = 100G
+// enabled = true
+func parseUsers(file string) (map[string]User, error) {
+	cfg, err := ini.Load(file)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]User)
+	for _, section := range cfg.Sections() {
+		name := strings.TrimSpace(section.Name())
+		if name == ini.DefaultSection {
+			continue
+		}
+		user := User{
+			Name:        name,
+			Secret:      section.Key("secret").String(),
+			MaxMappings: section.Key("max-mappings").MustInt(0),
+			Enabled:     section.Key("enabled").MustBool(true),
+		}
+		if user.Secret == "" {
+			return nil, fmt.Errorf("user [%s] has no secret", name)
+		}
+		if user.PortRanges, err = ParsePortRanges(section.Key("port-range").String()); err != nil {
+			return nil, fmt.Errorf("user [%s] %s", name, err.Error())
+		}
+		if user.MonthlyQuota, err = ParseSize(section.Key("monthly-quota").String()); err != nil {
+			return nil, fmt.Errorf("user [%s] %s", name, err.Error())
+		}
+		users[name] = user
+	}
+	return users, nil
+}
+
+// 解析端口范围列表，格式如 10000-10100,12000
+func ParsePortRanges(str string) ([]PortRange, error) {
+	var portRanges []PortRange
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		min, err := parsePort(bounds[0])
+		if err != nil || !checkPort(min) {
+			return nil, errors.New("illegal port range " + item)
+		}
+		max := min
+		if len(bounds) == 2 {
+			if max, err = parsePort(bounds[1]); err != nil || !checkPort(max) || max < min {
+				return nil, errors.New("illegal port range " + item)
+			}
+		}
+		portRanges = append(portRanges, PortRange{Min: min, Max: max})
+	}
+	return portRanges, nil
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"bufio"
+	"chuantou/logging"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// 访问日志，每个访问者会话在两个方向都结束后记录一条，HTTP 端口每个请求记录一条
+type accessEntry struct {
+	remote   string    // 访问者地址
+	mapping  string    // 访问端口，或访问域名、SNI
+	clientID string    // 客户端机器码
+	user     string    // 登录用户，使用共享 Key 时为空
+	target   string    // 内网服务地址，旧版客户端不发送时为空
+	start    time.Time // 会话开始时间
+}
+
+// 记录会话，in 为访问者发出的字节数，out 为回复访问者的字节数
+func (e accessEntry) log(in, out int64, reason string) {
+	if !logging.AccessEnabled() {
+		return
+	}
+	logging.Access("Visitor session",
+		"remote", e.remote,
+		"port", e.mapping,
+		"client_id", e.clientID,
+		"user", e.user,
+		"target", e.target,
+		"start", e.start.Format(time.RFC3339Nano),
+		"duration_ms", time.Since(e.start).Milliseconds(),
+		"bytes_in", in,
+		"bytes_out", out,
+		"reason", reason)
+}
+
+// HTTP 端口的请求记录，统计请求体及响应的字节数
+type accessRecorder struct {
+	http.ResponseWriter
+	body    *countingReader
+	written int64
+	status  int
+	err     error // 转发失败的原因
+}
+
+func newAccessRecorder(w http.ResponseWriter, request *http.Request) *accessRecorder {
+	recorder := &accessRecorder{ResponseWriter: w, status: http.StatusOK}
+	if request.Body != nil {
+		recorder.body = &countingReader{ReadCloser: request.Body}
+		request.Body = recorder.body
+	}
+	return recorder
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+// 反向代理流式响应时需要刷新
+func (r *accessRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// WebSocket 等协议升级时接管连接，之后的数据不再统计
+func (r *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func (r *accessRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// 请求的访问日志，转发失败时记录原因，否则记录响应状态码
+func (r *accessRecorder) log(entry accessEntry) {
+	var in int64
+	if r.body != nil {
+		in = atomic.LoadInt64(&r.body.read)
+	}
+	reason := fmt.Sprintf("status %d", r.status)
+	if r.err != nil {
+		reason = "proxy error: " + r.err.Error()
+	}
+	entry.log(in, r.written, reason)
+}
+
+// 统计读取的字节数
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
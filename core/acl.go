@@ -0,0 +1,41 @@
+package core
+
+import (
+	"chuantou/config"
+	"chuantou/geo"
+	"net"
+)
+
+// 访问控制，依次检查服务端全局规则、映射规则及映射的国家策略，任一规则拒绝即拒绝
+type accessControl struct {
+	acls  []config.ACL  // 服务端全局规则及映射规则
+	geo   geo.Policy    // 映射的国家策略
+	geoIP *geo.Database // 国家 IP 库，重新加载后立即生效
+}
+
+// 根据请求创建访问控制，映射规则不合法或国家 IP 库中没有策略中的国家时返回错误
+func newAccessControl(req Protocol, cfg config.ServerConfig) (accessControl, error) {
+	mappingACL, err := req.acl()
+	if err != nil {
+		return accessControl{}, err
+	}
+	policy, err := req.geoPolicy()
+	if err != nil {
+		return accessControl{}, err
+	}
+	if err = policy.Check(cfg.GeoIP); err != nil {
+		return accessControl{}, err
+	}
+	return accessControl{acls: []config.ACL{cfg.ACL, mappingACL}, geo: policy, geoIP: cfg.GeoIP}, nil
+}
+
+// 检查访问者地址是否允许访问
+func (a *accessControl) allowed(addr net.Addr) bool {
+	ip := config.AddrIP(addr)
+	for i := range a.acls {
+		if !a.acls[i].Allowed(ip) {
+			return false
+		}
+	}
+	return a.geo.Allowed(a.geoIP, ip)
+}
@@ -0,0 +1,353 @@
+package core
+
+import (
+	"chuantou/config"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 隧道信息，管理接口及命令行使用
+type TunnelInfo struct {
+	Key         string           `json:"key"`          // 访问端口、访问域名或 SNI
+	Port        uint32           `json:"port"`         // 访问端口
+	Network     string           `json:"network"`      // 网络类型
+	Domain      string           `json:"domain"`       // 访问域名
+	SNI         string           `json:"sni"`          // TLS 服务名称
+	ClientID    string           `json:"client_id"`    // 客户端机器码
+	User        string           `json:"user"`         // 登录用户
+	RemoteAddr  string           `json:"remote_addr"`  // 客户端地址
+	CreateTime  time.Time        `json:"create_time"`  // 注册时间
+	LastTime    time.Time        `json:"last_time"`    // 最后心跳时间
+	Tunnels     int              `json:"tunnels"`      // 隧道连接数，多路复用后每个映射一条
+	Streams     int              `json:"streams"`      // 隧道中打开的流数
+	Connections ConnStats        `json:"connections"`  // 访问者连接统计
+	Bandwidth   config.Bandwidth `json:"bandwidth"`    // 映射限速
+	Transferred uint64           `json:"transferred"`  // 注册以来转发的字节数，实时统计
+	Traffic     uint64           `json:"traffic"`      // 映射当月流量，字节
+	UserTraffic uint64           `json:"user_traffic"` // 用户当月流量，字节
+}
+
+// 隧道信息
+func (p *TunnelContext) info() TunnelInfo {
+	p.mutex.Lock()
+	lastTime := p.lastTime
+	p.mutex.Unlock()
+
+	info := TunnelInfo{
+		Key:         p.mapping,
+		Port:        p.request.Port,
+		Network:     p.request.Network,
+		Domain:      p.request.Domain,
+		SNI:         p.request.SNI,
+		ClientID:    p.request.ID,
+		User:        p.credential.user.Name,
+		CreateTime:  p.createTime,
+		LastTime:    lastTime,
+		Streams:     p.session.numStreams(),
+		Connections: p.conns.stats(),
+		Bandwidth:   p.limiter.get(),
+		Transferred: p.limiter.transferred(),
+	}
+	if info.Network == "" {
+		info.Network = config.NetworkTCP
+	}
+	if p.remoteAddr != nil {
+		info.RemoteAddr = p.remoteAddr.String()
+	}
+	if !p.session.isClosed() {
+		info.Tunnels = 1
+	}
+	stats := p.traffic.snapshot()
+	info.Traffic = stats.Mappings[p.mapping]
+	info.UserTraffic = stats.Users[info.User]
+	return info
+}
+
+// 已注册的隧道，按访问端口及名称排序
+func listTunnels() []TunnelInfo {
+	tunnels := make([]TunnelInfo, 0)
+	tunnelContextMap.Range(func(_, value interface{}) bool {
+		tunnels = append(tunnels, value.(*TunnelContext).info())
+		return true
+	})
+	sort.Slice(tunnels, func(i, j int) bool {
+		if tunnels[i].Port != tunnels[j].Port {
+			return tunnels[i].Port < tunnels[j].Port
+		}
+		return tunnels[i].Key < tunnels[j].Key
+	})
+	return tunnels
+}
+
+// 客户端信息，按机器码汇总隧道
+type ClientInfo struct {
+	ID          string           `json:"id"`          // 机器码
+	User        string           `json:"user"`        // 登录用户
+	RemoteAddr  string           `json:"remote_addr"` // 客户端地址，取第一个隧道的地址
+	Mappings    []string         `json:"mappings"`    // 已注册的映射
+	Streams     int              `json:"streams"`     // 打开的流数
+	Since       time.Time        `json:"since"`       // 最早的注册时间
+	Bandwidth   config.Bandwidth `json:"bandwidth"`   // 客户端限速
+	Transferred uint64           `json:"transferred"` // 转发的字节数，实时统计
+}
+
+// 已连接的客户端，按机器码排序
+func listClients(tunnels []TunnelInfo) []ClientInfo {
+	clients := make([]ClientInfo, 0)
+	index := make(map[string]int)
+	for _, tunnel := range tunnels {
+		i, exists := index[tunnel.ClientID]
+		if !exists {
+			i = len(clients)
+			index[tunnel.ClientID] = i
+			limiter := getClientLimiter(tunnel.ClientID)
+			clients = append(clients, ClientInfo{
+				ID:          tunnel.ClientID,
+				User:        tunnel.User,
+				RemoteAddr:  tunnel.RemoteAddr,
+				Since:       tunnel.CreateTime,
+				Bandwidth:   limiter.get(),
+				Transferred: limiter.transferred(),
+			})
+		}
+		client := &clients[i]
+		client.Mappings = append(client.Mappings, tunnel.Key)
+		client.Streams += tunnel.Streams
+		if tunnel.CreateTime.Before(client.Since) {
+			client.Since = tunnel.CreateTime
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+	return clients
+}
+
+// 概览，控制台定时刷新
+type overview struct {
+	Time         time.Time    `json:"time"`
+	Tunnels      []TunnelInfo `json:"tunnels"`
+	Clients      []ClientInfo `json:"clients"`
+	Visitors     []Event      `json:"visitors"`      // 最近的访问者连接
+	AuthFailures []Event      `json:"auth_failures"` // 最近的鉴权失败
+}
+
+func newOverview() overview {
+	tunnels := listTunnels()
+	return overview{
+		Time:         time.Now(),
+		Tunnels:      tunnels,
+		Clients:      listClients(tunnels),
+		Visitors:     recentVisitors.recent(),
+		AuthFailures: recentAuthFailures.recent(),
+	}
+}
+
+// 关闭客户端的所有隧道，返回关闭的隧道数
+// 客户端会自动重连，需要阻止其重连时应吊销令牌或停用用户
+func kickClient(id string) int {
+	var contexts []*TunnelContext
+	tunnelContextMap.Range(func(_, value interface{}) bool {
+		if context := value.(*TunnelContext); context.request.ID == id {
+			contexts = append(contexts, context)
+		}
+		return true
+	})
+	for _, context := range contexts {
+		adminLog.Info("Kick client", "port", context.request.tunnelKey(), "client_id", id)
+		unregisterTunnelContext(context)
+	}
+	return len(contexts)
+}
+
+// 关闭映射，key 为访问端口、访问域名或 SNI
+func closeTunnel(key string) bool {
+	context := lookupTunnelContext(key)
+	if context == nil {
+		return false
+	}
+	adminLog.Info("Close tunnel", "port", key, "client_id", context.request.ID)
+	unregisterTunnelContext(context)
+	return true
+}
+
+// 服务端配置，不含密钥
+type configView struct {
+	Port            uint32           `json:"port"`
+	AccessPortRange string           `json:"access_port_range"`
+	TLS             bool             `json:"tls"`
+	HTTPPort        uint32           `json:"http_port"`
+	HTTPSPort       uint32           `json:"https_port"`
+	UsersFile       string           `json:"users_file"`
+	Users           int              `json:"users"`
+	TokenKeyFile    string           `json:"token_key_file"`
+	LegacyKeys      bool             `json:"legacy_keys"`
+	RevocationFile  string           `json:"revocation_file"`
+	Revocations     int              `json:"revocations"`
+	HeartBeat       string           `json:"heartbeat"`
+	Ban             config.BanConfig `json:"ban"`
+	Allow           string           `json:"allow"`
+	Deny            string           `json:"deny"`
+	GeoIPFiles      string           `json:"geoip_files"`
+	GeoIPCountries  []string         `json:"geoip_countries"`
+	Bandwidth       config.Bandwidth `json:"bandwidth"`
+	ClientBandwidth config.Bandwidth `json:"client_bandwidth"`
+	TrafficFile     string           `json:"traffic_file"`
+	AdminAddr       string           `json:"admin_addr"`
+}
+
+// 服务端配置，限速为运行中调整后的值
+func newConfigView(cfg config.ServerConfig) configView {
+	view := configView{
+		Port:            cfg.Port,
+		AccessPortRange: fmt.Sprintf("%d-%d", cfg.MinAccessPort, cfg.MaxAccessPort),
+		TLS:             cfg.TLSEnabled(),
+		HTTPPort:        cfg.HTTPPort,
+		HTTPSPort:       cfg.HTTPSPort,
+		UsersFile:       cfg.UsersFile,
+		TokenKeyFile:    cfg.TokenKeyFile,
+		LegacyKeys:      cfg.LegacyKeysAllowed(),
+		RevocationFile:  cfg.RevocationFile,
+		Revocations:     cfg.Revocations.Len(),
+		HeartBeat:       cfg.HeartBeatInterval().String(),
+		Ban:             cfg.Ban.WithDefaults(),
+		Allow:           cfg.ACL.AllowString(),
+		Deny:            cfg.ACL.DenyString(),
+		GeoIPFiles:      cfg.GeoIPFiles,
+		GeoIPCountries:  cfg.GeoIP.Countries(),
+		Bandwidth:       globalLimiter.get(),
+		TrafficFile:     cfg.TrafficFile,
+		AdminAddr:       cfg.AdminListenAddr(),
+	}
+	if cfg.Users != nil {
+		view.Users = cfg.Users.Len()
+	}
+	clientMutex.Lock()
+	view.ClientBandwidth = clientBandwidth
+	clientMutex.Unlock()
+	return view
+}
+
+// 管理接口，所有请求须携带令牌，返回 JSON
+//
+// GET  /api/tunnels           已注册的隧道
+// GET  /api/overview          隧道、客户端及最近的访问者连接和鉴权失败
+// POST /api/kick?id=<机器码>   关闭客户端的所有隧道
+// POST /api/close?key=<端口>   关闭映射，key 为访问端口、访问域名或 SNI
+// GET  /api/config            服务端配置，不含密钥
+func AdminHandler(cfg config.ServerConfig) http.Handler {
+	return requireToken(cfg.AdminToken, apiHandler(cfg))
+}
+
+// 管理接口路由，不校验身份
+func apiHandler(cfg config.ServerConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, listTunnels())
+	})
+	mux.HandleFunc("/api/overview", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, newOverview())
+	})
+	mux.HandleFunc("/api/kick", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			writeError(w, http.StatusBadRequest)
+			return
+		}
+		closed := kickClient(id)
+		if closed == 0 {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"closed": closed})
+	})
+	mux.HandleFunc("/api/close", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed)
+			return
+		}
+		key := strings.ToLower(r.URL.Query().Get("key"))
+		if key == "" {
+			writeError(w, http.StatusBadRequest)
+			return
+		}
+		if !closeTunnel(key) {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"closed": 1})
+	})
+	mux.HandleFunc("/api/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, newConfigView(cfg))
+	})
+	return mux
+}
+
+// 校验令牌，未配置令牌时拒绝所有请求
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 返回 JSON
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		adminLog.Warn("Fail to encode response", "error", err)
+	}
+}
+
+// 返回错误
+func writeError(w http.ResponseWriter, status int) {
+	writeJSON(w, status, map[string]string{"error": http.StatusText(status)})
+}
+
+// 监听管理接口
+func serveAdmin(cfg config.ServerConfig) {
+	listener, err := net.Listen("tcp", cfg.AdminListenAddr())
+	if err != nil {
+		adminLog.Fatal("Fail to listen the admin address", "addr", cfg.AdminListenAddr(), "error", err)
+	}
+	adminLog.Info("Admin api listening", "addr", listener.Addr().String())
+	mux := http.NewServeMux()
+	mux.Handle("/api/", AdminHandler(cfg))
+	if cfg.DashboardPassword != "" {
+		mux.Handle("/", DashboardHandler(cfg))
+	}
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: vhostReadTimeout,
+	}
+	if err = server.Serve(listener); err != nil {
+		adminLog.Info("Admin api closed", "error", err)
+	}
+}
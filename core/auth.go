@@ -0,0 +1,163 @@
+package core
+
+import (
+	"chuantou/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// 挑战应答
+// HMAC-SHA256(密钥, 随机数|机器码|访问端口)
+// 随机数由服务端为每个连接生成且只使用一次，应答无法在其他连接上重放
+func challengeProof(secret, nonce []byte, id string, port uint32) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write([]byte(id))
+	_ = binary.Write(mac, binary.BigEndian, port)
+	return mac.Sum(nil)
+}
+
+// 客户端计算挑战应答，密钥本身不会发送
+// 签名令牌只发送声明，以令牌签名作为密钥
+// 短期 key 只发送到期日期，服务端由共享 Key 及到期日期重新生成后校验应答
+func signRequest(req *Protocol, key string, nonce []byte) bool {
+	secret := []byte(key)
+	if config.IsToken(key) {
+		signed, signature, err := config.SplitToken(key)
+		if err != nil {
+			authLog.Error("Fail to parse token", "error", err)
+			return false
+		}
+		req.Token = signed
+		secret = signature
+	} else if expired, trialKey, ok := config.SplitTrialKey(key); ok {
+		req.Expiry = expired
+		secret = []byte(trialKey)
+	}
+	req.Proof = challengeProof(secret, nonce, req.ID, req.Port)
+	return true
+}
+
+// 校验挑战应答
+func checkProof(req Protocol, secret, nonce []byte) bool {
+	if len(secret) == 0 || len(nonce) == 0 {
+		return false
+	}
+	return hmac.Equal(req.Proof, challengeProof(secret, nonce, req.ID, req.Port))
+}
+
+// 登录凭据，注册后保存在隧道中，心跳时重新校验
+type credential struct {
+	user      config.User // 登录的用户，使用共享 Key 时为空
+	tokenID   string      // 令牌ID，使用签名令牌时不为空
+	trialID   string      // 短期 key 的吊销ID，使用短期 key 时不为空
+	expiresAt time.Time   // 到期时间，零值表示不过期
+}
+
+// 重新校验凭据，令牌已吊销、已到期或用户已停用时返回错误
+func (c *credential) validate(cfg config.ServerConfig) error {
+	if !c.expiresAt.IsZero() && !time.Now().Before(c.expiresAt) {
+		return errors.New("credential expired")
+	}
+	if cfg.Revocations.Revoked(c.tokenID) {
+		return errors.New("token revoked")
+	}
+	if cfg.Revocations.Revoked(c.trialID) {
+		return errors.New("trial key revoked")
+	}
+	// 用户文件中的用户，删除或停用后失效
+	if c.tokenID == "" && c.user.Name != "" && cfg.Users != nil {
+		if user, exists := cfg.Users.Get(c.user.Name); !exists || !user.Enabled {
+			return errors.New("user disabled")
+		}
+	}
+	return nil
+}
+
+// 身份校验，返回登录凭据
+// 配置了令牌私钥时，签名令牌按声明限制端口及隧道数，用户名为令牌持有者，已吊销的令牌无效
+// 服务端配置了用户列表时，客户端须以用户身份登录，用户密钥只对本用户有效
+// 否则使用共享 Key 或由其生成的旧版短期 key 校验，返回的用户不限制端口及映射数，短期 key 到期后隧道关闭
+func authenticate(req Protocol, nonce []byte, cfg config.ServerConfig) (credential, bool) {
+	if req.Token != "" {
+		return authenticateToken(req, nonce, cfg)
+	}
+
+	if cfg.Users == nil {
+		if req.User != "" {
+			authLog.Warn("User is not supported", "user", req.User, "client_id", req.ID)
+			return credential{}, false
+		}
+		if !cfg.LegacyKeysAllowed() {
+			authLog.Warn("Legacy key is not allowed", "client_id", req.ID)
+			return credential{}, false
+		}
+		if req.Expiry != "" {
+			return authenticateTrialKey(req, nonce, cfg)
+		}
+		return credential{}, checkProof(req, []byte(cfg.Key), nonce)
+	}
+
+	user, exists := cfg.Users.Get(req.User)
+	if !exists || !user.Enabled {
+		authLog.Warn("Unknown or disabled user", "user", req.User, "client_id", req.ID)
+		return credential{}, false
+	}
+	if !checkProof(req, []byte(user.Secret), nonce) {
+		return credential{}, false
+	}
+	return credential{user: user}, true
+}
+
+// 校验旧版短期 key，由共享 Key 及到期日期重新生成 key，有效期内以其校验应答
+func authenticateTrialKey(req Protocol, nonce []byte, cfg config.ServerConfig) (credential, bool) {
+	trialKey, expiresAt, err := config.TrialKeySecret(cfg.Key, req.Expiry)
+	if err != nil {
+		authLog.Warn("Illegal trial key expiry", "client_id", req.ID, "expiry", req.Expiry, "error", err)
+		return credential{}, false
+	}
+	if !checkProof(req, []byte(trialKey), nonce) {
+		return credential{}, false
+	}
+	cred := credential{trialID: config.TrialKeyID(trialKey), expiresAt: expiresAt}
+	if err = cred.validate(cfg); err != nil {
+		authLog.Warn("Invalid trial key", "client_id", req.ID, "expiry", req.Expiry, "error", err)
+		return credential{}, false
+	}
+	return cred, true
+}
+
+// 校验签名令牌，服务端由声明还原签名后校验应答
+func authenticateToken(req Protocol, nonce []byte, cfg config.ServerConfig) (credential, bool) {
+	if cfg.TokenKey == nil {
+		authLog.Warn("Token is not supported", "client_id", req.ID)
+		return credential{}, false
+	}
+	claims, signature, err := config.SignClaims(cfg.TokenKey, req.Token)
+	if err != nil {
+		authLog.Warn("Fail to parse token", "client_id", req.ID, "error", err)
+		return credential{}, false
+	}
+	if !checkProof(req, signature, nonce) {
+		return credential{}, false
+	}
+	// 同时指定了用户名时，须与令牌持有者一致
+	if req.User != "" && req.User != claims.Subject {
+		authLog.Warn("Token subject mismatch", "user", req.User, "subject", claims.Subject)
+		return credential{}, false
+	}
+	user, err := claims.User()
+	if err != nil {
+		authLog.Warn("Fail to parse token claims", "subject", claims.Subject, "error", err)
+		return credential{}, false
+	}
+	cred := credential{user: user, tokenID: claims.ID, expiresAt: claims.Expiry()}
+	if err = cred.validate(cfg); err != nil {
+		authLog.Warn("Invalid token", "token_id", claims.ID, "subject", claims.Subject, "error", err)
+		return credential{}, false
+	}
+	return cred, true
+}
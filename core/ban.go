@@ -0,0 +1,210 @@
+package core
+
+import (
+	"chuantou/config"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 单个 IP 的鉴权失败记录
+type banEntry struct {
+	failures     int       // 统计时间内的失败次数
+	firstFailure time.Time // 统计开始时间
+	bans         int       // 累计封禁次数，用于计算封禁时长
+	until        time.Time // 封禁到期时间
+}
+
+// 封禁列表持久化格式
+type bannedIP struct {
+	IP    string    `json:"ip"`
+	Bans  int       `json:"bans"`
+	Until time.Time `json:"until"`
+}
+
+// 鉴权失败封禁列表
+// 同一 IP 在统计时间内鉴权失败达到阈值后封禁，封禁时长按累计封禁次数指数增长
+type banList struct {
+	policy  config.BanConfig
+	mutex   sync.Mutex
+	entries map[string]*banEntry
+	total   uint64 // 累计封禁次数
+}
+
+// 创建封禁列表，配置了文件时加载未到期的封禁
+func newBanList(policy config.BanConfig) *banList {
+	list := &banList{policy: policy.WithDefaults(), entries: make(map[string]*banEntry)}
+	if list.policy.File == "" {
+		return list
+	}
+	data, err := ioutil.ReadFile(list.policy.File)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			authLog.Warn("Fail to load ban list", "file", list.policy.File, "error", err)
+		}
+		return list
+	}
+	var banned []bannedIP
+	if err = json.Unmarshal(data, &banned); err != nil {
+		authLog.Warn("Fail to parse ban list", "file", list.policy.File, "error", err)
+		return list
+	}
+	for _, item := range banned {
+		list.entries[item.IP] = &banEntry{bans: item.Bans, until: item.Until}
+	}
+	authLog.Info("Load ban list", "banned", len(banned), "file", list.policy.File)
+	return list
+}
+
+// 取连接的来源 IP
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// 是否被封禁，未启用自动封禁时仍检查手动封禁
+func (p *banList) banned(ip string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entry, exists := p.entries[ip]
+	return exists && time.Now().Before(entry.until)
+}
+
+// 记录一次鉴权失败，达到阈值时封禁并返回封禁时长
+func (p *banList) fail(ip string) time.Duration {
+	if p.policy.Threshold < 0 {
+		return 0
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	entry, exists := p.entries[ip]
+	if !exists {
+		entry = &banEntry{}
+		p.entries[ip] = entry
+	}
+	if entry.failures == 0 || now.Sub(entry.firstFailure) > p.policy.Window {
+		entry.failures = 0
+		entry.firstFailure = now
+	}
+	entry.failures++
+	if entry.failures < p.policy.Threshold {
+		return 0
+	}
+
+	duration := p.banLocked(entry, now, 0)
+	authLog.Warn("Ban ip after auth failures", "remote", ip, "duration", duration, "failures", p.policy.Threshold, "bans", entry.bans)
+	return duration
+}
+
+// 手动封禁，duration 为 0 时按累计封禁次数计算封禁时长，返回封禁时长
+func (p *banList) ban(ip string, duration time.Duration) time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entry, exists := p.entries[ip]
+	if !exists {
+		entry = &banEntry{}
+		p.entries[ip] = entry
+	}
+	duration = p.banLocked(entry, time.Now(), duration)
+	authLog.Warn("Ban ip manually", "remote", ip, "duration", duration, "bans", entry.bans)
+	return duration
+}
+
+// 封禁并保存，调用方持有锁
+// 封禁时长 = 首次封禁时长 * 2^累计封禁次数，不超过最长封禁时长
+func (p *banList) banLocked(entry *banEntry, now time.Time, duration time.Duration) time.Duration {
+	if duration <= 0 {
+		duration = p.policy.Duration
+		for i := 0; i < entry.bans && duration < p.policy.MaxDuration; i++ {
+			duration *= 2
+		}
+		if duration > p.policy.MaxDuration {
+			duration = p.policy.MaxDuration
+		}
+	}
+	entry.bans++
+	entry.failures = 0
+	entry.until = now.Add(duration)
+	atomic.AddUint64(&p.total, 1)
+	p.save()
+	return duration
+}
+
+// 封禁中的 IP 数
+func (p *banList) active() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	count := 0
+	for _, entry := range p.entries {
+		if now.Before(entry.until) {
+			count++
+		}
+	}
+	return count
+}
+
+// 鉴权成功，清除失败次数，累计封禁次数保留
+func (p *banList) success(ip string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if entry, exists := p.entries[ip]; exists {
+		entry.failures = 0
+		if entry.bans == 0 {
+			delete(p.entries, ip)
+		}
+	}
+}
+
+// 清理过期记录，封禁到期超过最长封禁时长后不再累计
+func (p *banList) prune() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	pruned := false
+	for ip, entry := range p.entries {
+		recentFailure := entry.failures > 0 && now.Sub(entry.firstFailure) <= p.policy.Window
+		if !recentFailure && now.After(entry.until.Add(p.policy.MaxDuration)) {
+			delete(p.entries, ip)
+			pruned = pruned || entry.bans > 0
+		}
+	}
+	if pruned {
+		p.save()
+	}
+}
+
+// 累计封禁次数
+func (p *banList) count() uint64 {
+	return atomic.LoadUint64(&p.total)
+}
+
+// 保存封禁列表，只保存有封禁记录的 IP，调用方持有锁
+func (p *banList) save() {
+	if p.policy.File == "" {
+		return
+	}
+	banned := make([]bannedIP, 0, len(p.entries))
+	for ip, entry := range p.entries {
+		if entry.bans > 0 {
+			banned = append(banned, bannedIP{IP: ip, Bans: entry.bans, Until: entry.until})
+		}
+	}
+	data, err := json.MarshalIndent(banned, "", "  ")
+	if err != nil {
+		authLog.Warn("Fail to encode ban list", "error", err)
+		return
+	}
+	if err = ioutil.WriteFile(p.policy.File, data, 0644); err != nil {
+		authLog.Warn("Fail to save ban list", "file", p.policy.File, "error", err)
+	}
+}
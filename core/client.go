@@ -2,12 +2,13 @@ package core
 
 import (
 	"chuantou/config"
+	"crypto/tls"
+	"fmt"
 	"github.com/denisbrodbeck/machineid"
-	"log"
 	"net"
 	"os"
-	"runtime"
 	"strings"
+	"time"
 )
 
 // 客户端ID，启动时就确定了
@@ -16,137 +17,200 @@ var clientID string
 func init() {
 	if id, err := machineid.ID(); err == nil {
 		clientID = strings.ReplaceAll(id, "-", "")
-		log.Println("Get client machine ID :", clientID)
+		clientLog.Info("Get client machine ID", "client_id", clientID)
 	} else {
-		log.Println("Fail to get machine ID")
+		clientLog.Error("Fail to get machine ID", "error", err)
 		os.Exit(0)
 	}
 }
 
 // 处理客户端连接
-func handleClientConnection(cfg config.ClientConfig, index int) {
-	connChan := make(chan net.Conn)
-	flagChan := make(chan bool)
-
-	// 远程拨号，建桥
-	go buildTunnelConnection(cfg, index, connChan, flagChan)
-	// 本地连接拨号，并建立双向通道
-	go buildLocalConnection(cfg.LocalAddr[index], connChan, flagChan)
-	// 初始化连接
-	for i := 0; i < cfg.TunnelCount; i++ {
-		flagChan <- true
+// 每个映射只维持一条到桥端的连接，访问者连接通过多路复用流承载
+func handleClientConnection(cfg config.ClientConfig, index int, tlsConfig *tls.Config) {
+	local := cfg.LocalAddr[index]
+	for {
+		session, negotiated := buildTunnelSession(cfg, index, tlsConfig)
+		if session == nil {
+			return
+		}
+		clientLog.Info("Initialization tunnel", "port", local.Port2, "target", local.String())
+		clientSessions.Store(local.Mapping(), session)
+
+		for {
+			// 此处会阻塞，以等待访问者连接
+			stream, err := session.acceptStream()
+			if err != nil {
+				break
+			}
+			visitorLog.Info("New connection", "port", local.Port2, "target", local.String())
+			go buildLocalConnection(local, stream, negotiated)
+		}
+
+		// 连接中断，重新连接
+		clientLog.Warn("Tunnel connection interrupted, try to redial", "port", local.Port2, "target", local.String())
+		clientSessions.Delete(local.Mapping())
+		session.close()
+		time.Sleep(retryIntervalTime * time.Second)
 	}
-	log.Printf("Initilization tunnel [%d] [%d]", cfg.LocalAddr[index].Port2, cfg.TunnelCount)
 }
 
-func buildTunnelConnection(cfg config.ClientConfig, index int, connCh chan net.Conn, flagCh chan bool) {
-	server := cfg.ServerAddr
+// 向桥端建立连接，注册成功后返回多路复用会话
+func buildTunnelSession(cfg config.ClientConfig, index int, tlsConfig *tls.Config) (*muxSession, hello) {
 	local := cfg.LocalAddr[index]
 
 	for {
-		select {
-		case <-flagCh:
-			// 新建协程，向桥端建立连接
-			go func(ch chan net.Conn) {
-				conn := dial(server, maxRetryTimes)
-				if conn == nil {
-					runtime.Goexit()
-				}
-
-				request := Protocol{
-					Result:  protocolResultSuccess,
-					Version: Version,
-					Port:    local.Port2,
-					ID:      clientID,
-					Key:     cfg.Key,
-				}
-
-				if !sendProtocol(conn, request) {
-					log.Fatalln("Fail to start. exit")
-				}
-				var response Protocol
-			loop:
-				for {
-					// 此处会阻塞，以等待访问者连接
-					response = receiveProtocol(conn)
-
-					// 处理连接结果
-					switch response.Result {
-					case protocolResultHeartBeat:
-						// 不做任何处理，继续监听
-						//log.Println("heartbeat...", response.Port)
-					case protocolResultSuccess:
-						log.Printf("New connection [%d] [%s]\n", local.Port2, local.String())
-						ch <- conn
-
-						// 跳出循环
-						break loop
-					case protocolResultVersionMismatch:
-						// 版本不匹配，退出客户端
-						// 鉴权失败，退出客户端
-						log.Fatalln("Version mismatch. exit")
-					case protocolResultFailToAuth:
-						// 鉴权失败，退出客户端
-						log.Fatalln("Fail to auth. exit")
-					case protocolResultIllegalAccessPort:
-						// 访问端口不合法
-						log.Fatalln("Illegal Access Port. exit")
-					case protocolResultPortIsOccupied:
-						// 访问端口被占用
-						log.Fatalf("Port[%d] is occupied\n", response.Port)
-					case protocolResultFail:
-						log.Fatalln("Fail to start. exit")
-					case protocolResultFailToReceive:
-						// 一般是超时导致，不打印日志
-						closeConn(conn)
-						flagCh <- true
-
-						// 跳出循环
-						break loop
-					default:
-						// 连接中断，重新连接
-						log.Printf("Tunnel connection interrupted, try to redial. [result=%d] [%s]\n", response.Result, local.String())
-						closeConn(conn)
-						flagCh <- true
-
-						// 跳出循环
-						break loop
-					}
-				}
-			}(connCh)
+		conn := dial(cfg.ServerAddr, maxRetryTimes)
+		if conn == nil {
+			return nil, hello{}
 		}
+		if tlsConfig != nil {
+			if conn = tlsClient(conn, tlsConfig); conn == nil {
+				time.Sleep(retryIntervalTime * time.Second)
+				continue
+			}
+		}
+
+		// 握手，协商协议版本及特性
+		start := time.Now()
+		negotiated := clientHandshake(conn)
+		response := Protocol{Result: negotiated.Result, Port: local.Port2}
+		if negotiated.Success() {
+			request := Protocol{
+				Result:   protocolResultSuccess,
+				Version:  Version,
+				Port:     local.Port2,
+				ID:       clientID,
+				User:     cfg.User,
+				Network:  local.Network,
+				Domain:   local.Domain,
+				SNI:      local.SNI,
+				Allow:    local.ACL.AllowString(),
+				Deny:     local.ACL.DenyString(),
+				GeoAllow: local.Geo.AllowString(),
+				GeoDeny:  local.Geo.DenyString(),
+				Rate:     local.Bandwidth.Rate,
+				Burst:    local.Bandwidth.Burst,
+				MaxConns: local.ConnLimit.MaxConns,
+				ConnRate: local.ConnLimit.Rate,
+				Queue:    uint32(local.ConnLimit.QueueTimeout / time.Millisecond),
+				Target:   local.String(),
+			}
+			if !signRequest(&request, cfg.Key, negotiated.Nonce) {
+				clientLog.Fatal("Fail to sign request. exit", "port", local.Port2)
+			}
+			if !sendProtocol(conn, request) {
+				closeConn(conn)
+				time.Sleep(retryIntervalTime * time.Second)
+				continue
+			}
+			response = receiveProtocol(conn)
+		}
+		countRegistration(response.Result, start)
+
+		// 处理注册结果
+		switch response.Result {
+		case protocolResultSuccess:
+			return newMuxSession(conn, true), negotiated
+		case protocolResultVersionMismatch:
+			// 版本不匹配，退出客户端
+			clientLog.Fatal("Version mismatch. exit", "port", local.Port2, "result_code", response.Result)
+		case protocolResultFailToAuth:
+			// 鉴权失败，退出客户端
+			clientLog.Fatal("Fail to auth. exit", "port", local.Port2, "result_code", response.Result)
+		case protocolResultIllegalAccessPort:
+			// 访问端口不合法
+			clientLog.Fatal("Illegal Access Port. exit", "port", local.Port2, "result_code", response.Result)
+		case protocolResultPortIsOccupied:
+			// 访问端口被占用
+			clientLog.Fatal("Port is occupied. exit", "port", response.Port, "result_code", response.Result)
+		case protocolResultTooManyMappings:
+			// 映射数超过用户上限
+			clientLog.Fatal("Too many mappings. exit", "port", local.Port2, "result_code", response.Result)
+		case protocolResultQuotaExceeded:
+			// 当月流量配额已用完
+			clientLog.Fatal("Traffic quota exceeded. exit", "port", local.Port2, "result_code", response.Result)
+		case protocolResultUnsupported:
+			// 服务端不支持该映射类型
+			clientLog.Fatal("Unsupported mapping. exit", "mapping", local.FullString(), "result_code", response.Result)
+		case protocolResultFail:
+			clientLog.Fatal("Fail to start. exit", "port", local.Port2, "result_code", response.Result)
+		default:
+			// 连接中断，重新连接
+			clientLog.Warn("Tunnel connection interrupted, try to redial", "port", local.Port2, "target", local.String(), "result_code", response.Result)
+		}
+		closeConn(conn)
+		time.Sleep(retryIntervalTime * time.Second)
 	}
 }
 
 // 本地服务连接拨号，并建立双向通道
-func buildLocalConnection(local config.NetAddress, connCh chan net.Conn, flagCh chan bool) {
-	for {
-		select {
-		case cn := <-connCh:
-			// 建立本地连接访问
-			go func(conn net.Conn) {
-				// 本地连接，不需要重新拨号
-				if localConn := dial(local, 0); localConn != nil {
-					// 通知创建新桥
-					flagCh <- true
-					forward(localConn, conn)
-				} else {
-					// 放弃连接，重新建桥
-					closeConn(conn)
-					flagCh <- true
-				}
-			}(cn)
+func buildLocalConnection(local config.NetAddress, stream net.Conn, negotiated hello) {
+	start := time.Now()
+	// 访问者信息
+	var info visitor
+	if negotiated.Has(featureVisitor) {
+		var ok bool
+		if info, ok = receiveVisitor(stream); !ok {
+			closeConn(stream)
+			return
 		}
 	}
+	// 服务端已检查访问控制规则，客户端再检查一次
+	// 协商了访问者信息但地址为空时，为 HTTP 端口多个请求复用的流，服务端已按请求检查，不再检查
+	// 旧版服务端不发送访问者地址，配置了规则时拒绝
+	mapping := local.Mapping()
+	recheck := info.Source != "" || !negotiated.Has(featureVisitor)
+	if recheck && !local.ACL.Allowed(config.HostIP(info.Source)) {
+		if info.Source == "" {
+			visitorLog.Warn("Deny connection, visitor address unknown", "port", local.Port2)
+		} else {
+			visitorLog.Info("Deny connection", "port", local.Port2, "remote", info.Source)
+		}
+		countVisitor(mapping, false)
+		closeConn(stream)
+		return
+	}
+
+	if local.IsUDP() {
+		buildLocalPacketConnection(local, stream, info)
+		return
+	}
+	// 本地连接，不需要重新拨号
+	localConn := dial(local, 0)
+	if localConn == nil {
+		// 放弃连接
+		countVisitor(mapping, false)
+		closeConn(stream)
+		return
+	}
+	countVisitor(mapping, true)
+	// 发送 PROXY 协议头，使内网服务获得访问者真实地址
+	if header := proxyHeader(local, info); header != nil {
+		if _, err := localConn.Write(header); err != nil {
+			closeConn(localConn, stream)
+			return
+		}
+	}
+	result := forward(localConn, stream, nil)
+	countTransfer(mapping, result.written1, result.written2)
+	entry := accessEntry{remote: info.Source, mapping: mapping, clientID: clientID, target: local.String(), start: start}
+	entry.log(result.written1, result.written2, result.reason("target", "visitor"))
 }
 
 // 入口
 func Client(cfg config.ClientConfig) {
-	log.Println("Load config", cfg)
+	clientLog.Info("Load config", "config", fmt.Sprint(cfg))
+
+	tlsConfig, err := clientTLSConfig(cfg)
+	if err != nil {
+		clientLog.Fatal("Fail to load TLS config", "error", err)
+	}
+
+	go serveMetrics(cfg.MetricsListenAddr())
 
 	// 遍历所有端口
 	for index := range cfg.LocalAddr {
-		go handleClientConnection(cfg, index)
+		go handleClientConnection(cfg, index, tlsConfig)
 	}
 
 	select {}
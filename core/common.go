@@ -4,7 +4,6 @@ import (
 	"chuantou/config"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync"
 	"time"
@@ -15,7 +14,7 @@ const (
 	retryIntervalTime = 5
 
 	// 心跳间隔时间
-	heartBeatIntervalTime = 60 * time.Second
+	heartBeatIntervalTime = config.DefaultHeartBeat
 
 	// 最大重试次数
 	maxRetryTimes = 24 * 60 * 60 / retryIntervalTime
@@ -24,7 +23,7 @@ const (
 var bufferPool *sync.Pool
 
 func init() {
-	log.Println("Init copy buffer pool...")
+	forwardLog.Debug("Init copy buffer pool")
 	bufferPool = &sync.Pool{}
 	bufferPool.New = func() interface{} {
 		return make([]byte, 32*1024)
@@ -69,27 +68,66 @@ func copyWithPool(dst io.Writer, src io.Reader) (written int64, err error) {
 	return written, err
 }
 
-// 连接数据复制
-func connCopy(dist, source net.Conn, wg *sync.WaitGroup) {
-	if _, err := copyWithPool(dist, source); err != nil {
-		//log.Println("Connection interrupted", err)
+// 连接数据复制，配置了限速时按令牌桶限速，返回写入的字节数，source 正常关闭时错误为空
+// 复制结束后由调用方关闭 dist
+func connCopy(dist, source net.Conn, limiters limiterChain) (int64, error) {
+	var reader io.Reader = source
+	if len(limiters) > 0 {
+		reader = &limitedReader{reader: source, limiters: limiters}
 	}
-	_ = dist.Close()
-	wg.Done()
+	written, err := copyWithPool(dist, reader)
+	if err != nil {
+		forwardLog.Debug("Connection interrupted", "remote", addrString(source.RemoteAddr()), "error", err)
+	}
+	return written, err
+}
+
+// 转发结果
+type forwardResult struct {
+	written1 int64 // 写入 conn1 的字节数
+	written2 int64 // 写入 conn2 的字节数
+	closedBy int   // 先结束的方向的来源连接，1 或 2
+	err      error // 先结束的方向的错误，来源连接正常关闭时为空
 }
 
-// 连接转发
-func forward(conn1, conn2 net.Conn) {
-	//log.Printf("Forward channel [%s/%s] <-> [%s/%s]\n",
-	//	conn1.RemoteAddr(), conn1.LocalAddr(), conn2.RemoteAddr(), conn2.LocalAddr())
+// 关闭原因，name1、name2 为两个连接的名称
+func (r forwardResult) reason(name1, name2 string) string {
+	name := name1
+	if r.closedBy == 2 {
+		name = name2
+	}
+	if r.err != nil {
+		return name + " error: " + r.err.Error()
+	}
+	return name + " closed"
+}
 
+// 连接转发，两个方向共用限速器，两个方向都结束后返回
+func forward(conn1, conn2 net.Conn, limiters limiterChain) forwardResult {
+	forwardLog.Debug("Forward channel",
+		"remote1", addrString(conn1.RemoteAddr()), "local1", addrString(conn1.LocalAddr()),
+		"remote2", addrString(conn2.RemoteAddr()), "local2", addrString(conn2.LocalAddr()))
+
+	var result forwardResult
+	var once sync.Once
 	var wg sync.WaitGroup
+	copyConn := func(dist, source net.Conn, written *int64, closedBy int) {
+		var err error
+		*written, err = connCopy(dist, source, limiters)
+		// 先结束的方向决定关闭原因，须在关闭 dist 前记录，否则另一方向的错误会被当作原因
+		once.Do(func() {
+			result.closedBy, result.err = closedBy, err
+		})
+		_ = dist.Close()
+		wg.Done()
+	}
 	// wait tow goroutines
 	wg.Add(2)
-	go connCopy(conn1, conn2, &wg)
-	go connCopy(conn2, conn1, &wg)
+	go copyConn(conn1, conn2, &result.written1, 2)
+	go copyConn(conn2, conn1, &result.written2, 1)
 	//blocking when the wg is locked
 	wg.Wait()
+	return result
 }
 
 // 关闭连接
@@ -105,18 +143,19 @@ func closeConn(connections ...net.Conn) {
 func dial(targetAddr config.NetAddress /*目标地址*/, maxRedialTimes int /*最大重拨次数*/) net.Conn {
 	redialTimes := 0
 	for {
-		conn, err := net.Dial("tcp", targetAddr.String())
+		conn, err := net.Dial(targetAddr.NetworkType(), targetAddr.String())
 		if err == nil {
-			//log.Printf("Dial to [%s] success.\n", targetAddr)
+			dialLog.Debug("Dial success", "target", targetAddr.String())
 			return conn
 		}
 		redialTimes++
 		if maxRedialTimes < 0 || redialTimes < maxRedialTimes {
+			metricDialRetries.inc("target", targetAddr.String())
 			// 重连模式，每5秒一次
-			log.Printf("Dial to [%s] failed, redial(%d) after %d seconeds.", targetAddr.String(), redialTimes, retryIntervalTime)
+			dialLog.Warn("Dial failed, redial later", "target", targetAddr.String(), "times", redialTimes, "interval", retryIntervalTime*time.Second)
 			time.Sleep(retryIntervalTime * time.Second)
 		} else {
-			log.Printf("Dial to [%s] failed. %s\n", targetAddr.String(), err.Error())
+			dialLog.Error("Dial failed", "target", targetAddr.String(), "error", err)
 			return nil
 		}
 	}
@@ -127,10 +166,10 @@ func listen(port uint32, id string) net.Listener {
 	address := fmt.Sprintf("0.0.0.0:%d", port)
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Println("Listen failed, the port may be used or closed", port)
+		tunnelLog.Warn("Listen failed, the port may be used or closed", "port", port, "client_id", id, "error", err)
 		return nil
 	}
-	log.Printf("Listening at address %s by %s\n", address, id)
+	tunnelLog.Info("Listening", "addr", address, "client_id", id)
 	return listener
 }
 
@@ -138,10 +177,10 @@ func listen(port uint32, id string) net.Listener {
 func accept(listener net.Listener) net.Conn {
 	conn, err := listener.Accept()
 	if err != nil {
-		log.Println("Accept connect failed ->", err.Error())
+		visitorLog.Info("Accept connect failed", "addr", addrString(listener.Addr()), "error", err)
 		return nil
 	}
-	//log.Println("Accept a new client ->", conn.RemoteAddr())
+	visitorLog.Debug("Accept a new client", "remote", addrString(conn.RemoteAddr()))
 	return conn
 }
 
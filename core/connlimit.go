@@ -0,0 +1,106 @@
+package core
+
+import (
+	"chuantou/config"
+	"sync/atomic"
+	"time"
+)
+
+// 访问者连接统计
+type ConnStats struct {
+	Active   int64  `json:"active"`   // 当前连接数
+	Accepted uint64 `json:"accepted"` // 累计接受的连接数
+	Rejected uint64 `json:"rejected"` // 累计因超出限制拒绝的连接数
+}
+
+// 访问者连接限制，限制同时连接数及新建连接速率
+type connLimiter struct {
+	limit    config.ConnLimit
+	slots    chan struct{} // 连接槽位，不限制同时连接数时为空
+	rate     *rateLimiter  // 新建连接速率，每个连接一个令牌
+	active   int64
+	accepted uint64
+	rejected uint64
+}
+
+// 创建连接限制
+func newConnLimiter(limit config.ConnLimit) *connLimiter {
+	limiter := &connLimiter{
+		limit: limit,
+		rate:  newRateLimiter(config.Bandwidth{Rate: uint64(limit.Rate)}),
+	}
+	if limit.MaxConns > 0 {
+		limiter.slots = make(chan struct{}, limit.MaxConns)
+	}
+	return limiter
+}
+
+// 取得连接许可，超出限制时按配置排队等待或立即拒绝
+// 取得许可后须调用 release 释放
+func (l *connLimiter) acquire(queue bool) bool {
+	timeout := time.Duration(0)
+	if queue {
+		timeout = l.limit.QueueTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	// 新建连接速率
+	wait, ok := l.rate.take(1, timeout)
+	if !ok {
+		atomic.AddUint64(&l.rejected, 1)
+		return false
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	// 同时连接数
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			remain := time.Until(deadline)
+			if remain <= 0 {
+				atomic.AddUint64(&l.rejected, 1)
+				return false
+			}
+			timer := time.NewTimer(remain)
+			defer timer.Stop()
+			select {
+			case l.slots <- struct{}{}:
+			case <-timer.C:
+				atomic.AddUint64(&l.rejected, 1)
+				return false
+			}
+		}
+	}
+	atomic.AddInt64(&l.active, 1)
+	atomic.AddUint64(&l.accepted, 1)
+	return true
+}
+
+// 释放连接许可
+func (l *connLimiter) release() {
+	atomic.AddInt64(&l.active, -1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// 连接统计
+func (l *connLimiter) stats() ConnStats {
+	return ConnStats{
+		Active:   atomic.LoadInt64(&l.active),
+		Accepted: atomic.LoadUint64(&l.accepted),
+		Rejected: atomic.LoadUint64(&l.rejected),
+	}
+}
+
+// 查询映射的访问者连接统计，key 为访问端口、访问域名或 SNI
+func ConnectionStats(key string) (ConnStats, bool) {
+	context := lookupTunnelContext(key)
+	if context == nil {
+		return ConnStats{}, false
+	}
+	return context.conns.stats(), true
+}
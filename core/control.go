@@ -0,0 +1,271 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"chuantou/config"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// 控制命令读写超时时间
+const controlTimeout = 10 * time.Second
+
+// 控制命令执行失败时，回复以此开头
+const controlErrorPrefix = "ERR "
+
+// 控制台帮助
+const controlHelp = `ports                 list registered mappings
+clients               list connected clients by machine ID
+kick <id>             close all tunnels of a client
+close <port>          close a mapping, port may also be a domain or SNI
+ban <ip> [duration]   ban an ip and close its tunnels, e.g. ban 1.2.3.4 1h
+reload                reload users, revocation list and geoip files
+stats                 show server statistics`
+
+// 本地控制台，通过 Unix Socket 接收命令，每个连接执行一条命令
+type controlServer struct {
+	cfg     config.ServerConfig
+	bans    *banList
+	traffic *trafficMeter
+	start   time.Time
+}
+
+// 监听控制台 Socket，残留的 Socket 文件会被删除
+func serveControl(cfg config.ServerConfig, bans *banList, traffic *trafficMeter) {
+	if cfg.ControlSocket == "" {
+		return
+	}
+	if info, err := os.Lstat(cfg.ControlSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(cfg.ControlSocket)
+	}
+	listener, err := net.Listen("unix", cfg.ControlSocket)
+	if err != nil {
+		adminLog.Fatal("Fail to listen the control socket", "socket", cfg.ControlSocket, "error", err)
+	}
+	// 只允许运行服务端的用户连接，在接受第一个连接前修改权限，失败时不提供控制台
+	if err = os.Chmod(cfg.ControlSocket, 0600); err != nil {
+		_ = listener.Close()
+		adminLog.Fatal("Fail to chmod the control socket", "socket", cfg.ControlSocket, "error", err)
+	}
+	adminLog.Info("Control socket listening", "socket", cfg.ControlSocket)
+
+	server := &controlServer{cfg: cfg, bans: bans, traffic: traffic, start: time.Now()}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			adminLog.Info("Control socket closed", "error", err)
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+// 读取一行命令，回复执行结果
+func (s *controlServer) handle(conn net.Conn) {
+	defer closeConn(conn)
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	args := strings.Fields(line)
+	output, err := s.execute(args)
+	if err != nil {
+		output = controlErrorPrefix + err.Error() + "\n"
+	}
+	_, _ = conn.Write([]byte(output))
+}
+
+// 执行命令
+func (s *controlServer) execute(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+	adminLog.Info("Control command", "command", strings.Join(args, " "))
+	command, args := args[0], args[1:]
+	switch command {
+	case "ports":
+		return s.ports(), nil
+	case "clients":
+		return s.clients(), nil
+	case "kick":
+		if len(args) != 1 {
+			return "", errors.New("usage: kick <id>")
+		}
+		closed := kickClient(args[0])
+		if closed == 0 {
+			return "", fmt.Errorf("client %s not found", args[0])
+		}
+		return fmt.Sprintf("Closed %d tunnels of %s\n", closed, args[0]), nil
+	case "close":
+		if len(args) != 1 {
+			return "", errors.New("usage: close <port>")
+		}
+		if !closeTunnel(strings.ToLower(args[0])) {
+			return "", fmt.Errorf("mapping %s not found", args[0])
+		}
+		return fmt.Sprintf("Closed %s\n", args[0]), nil
+	case "ban":
+		return s.ban(args)
+	case "reload":
+		return s.reload()
+	case "stats":
+		return s.stats(), nil
+	case "help":
+		return controlHelp + "\n", nil
+	default:
+		return "", fmt.Errorf("unknown command %q\n%s", command, controlHelp)
+	}
+}
+
+// 已注册的映射
+func (s *controlServer) ports() string {
+	return table(func(w *tabwriter.Writer) {
+		_, _ = fmt.Fprintln(w, "MAPPING\tNETWORK\tCLIENT\tUSER\tREMOTE\tSTREAMS\tACTIVE\tACCEPTED\tREJECTED\tTRAFFIC\tSINCE")
+		for _, t := range listTunnels() {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\n",
+				t.Key, t.Network, t.ClientID, orDash(t.User), t.RemoteAddr, t.Streams,
+				t.Connections.Active, t.Connections.Accepted, t.Connections.Rejected,
+				config.FormatSize(t.Traffic), t.CreateTime.Format("2006-01-02 15:04:05"))
+		}
+	})
+}
+
+// 已连接的客户端
+func (s *controlServer) clients() string {
+	return table(func(w *tabwriter.Writer) {
+		_, _ = fmt.Fprintln(w, "ID\tUSER\tREMOTE\tMAPPINGS\tSTREAMS\tTRANSFERRED\tSINCE")
+		for _, c := range listClients(listTunnels()) {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+				c.ID, orDash(c.User), c.RemoteAddr, strings.Join(c.Mappings, ","), c.Streams,
+				config.FormatSize(c.Transferred), c.Since.Format("2006-01-02 15:04:05"))
+		}
+	})
+}
+
+// 封禁 IP 并关闭来自该 IP 的隧道
+func (s *controlServer) ban(args []string) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", errors.New("usage: ban <ip> [duration]")
+	}
+	ip := net.ParseIP(args[0])
+	if ip == nil {
+		return "", fmt.Errorf("illegal ip %s", args[0])
+	}
+	var duration time.Duration
+	if len(args) == 2 {
+		var err error
+		if duration, err = time.ParseDuration(args[1]); err != nil || duration <= 0 {
+			return "", fmt.Errorf("illegal duration %s", args[1])
+		}
+	}
+	duration = s.bans.ban(ip.String(), duration)
+
+	var contexts []*TunnelContext
+	tunnelContextMap.Range(func(_, value interface{}) bool {
+		context := value.(*TunnelContext)
+		if addr, ok := context.remoteAddr.(*net.TCPAddr); ok && addr.IP.Equal(ip) && context.registeredAt(s.cfg.Port) {
+			contexts = append(contexts, context)
+		}
+		return true
+	})
+	for _, context := range contexts {
+		unregisterTunnelContext(context)
+	}
+	return fmt.Sprintf("Banned %s for %s, closed %d tunnels\n", ip, duration, len(contexts)), nil
+}
+
+// 重新加载用户文件、吊销列表及国家 IP 库，并重新校验已注册的隧道
+func (s *controlServer) reload() (string, error) {
+	var failures []string
+	if s.cfg.Users != nil {
+		if err := s.cfg.Users.Reload(); err != nil {
+			failures = append(failures, "users: "+err.Error())
+		}
+	}
+	if err := s.cfg.Revocations.Reload(); err != nil {
+		failures = append(failures, "revocations: "+err.Error())
+	}
+	if err := s.cfg.GeoIP.Reload(); err != nil {
+		failures = append(failures, "geoip: "+err.Error())
+	}
+	if len(failures) > 0 {
+		return "", errors.New(strings.Join(failures, "; "))
+	}
+	closed := checkTunnels(s.cfg)
+	return fmt.Sprintf("Reloaded, closed %d tunnels\n", closed), nil
+}
+
+// 运行统计
+func (s *controlServer) stats() string {
+	tunnels := listTunnels()
+	traffic := s.traffic.snapshot()
+	var monthly uint64
+	for _, n := range traffic.Mappings {
+		monthly += n
+	}
+	return table(func(w *tabwriter.Writer) {
+		rows := [][2]string{
+			{"version", fmt.Sprint(Version)},
+			{"uptime", time.Since(s.start).Truncate(time.Second).String()},
+			{"mappings", fmt.Sprint(len(tunnels))},
+			{"clients", fmt.Sprint(len(listClients(tunnels)))},
+			{"visitors accepted", fmt.Sprint(metricVisitors.total(`result="accepted"`))},
+			{"visitors rejected", fmt.Sprint(metricVisitors.total(`result="rejected"`))},
+			{"bytes in", config.FormatSize(uint64(metricTransfer.total(`direction="in"`)))},
+			{"bytes out", config.FormatSize(uint64(metricTransfer.total(`direction="out"`)))},
+			{"traffic " + traffic.Month, config.FormatSize(monthly)},
+			{"auth failures", fmt.Sprint(metricAuthFailures.total())},
+			{"heartbeat failures", fmt.Sprint(metricHeartbeatFailures.total())},
+			{"banned ips", fmt.Sprint(s.bans.active())},
+			{"bans total", fmt.Sprint(s.bans.count())},
+		}
+		for _, row := range rows {
+			_, _ = fmt.Fprintf(w, "%s\t%s\n", row[0], row[1])
+		}
+	})
+}
+
+// 对齐输出表格
+func table(write func(w *tabwriter.Writer)) string {
+	var buffer bytes.Buffer
+	w := tabwriter.NewWriter(&buffer, 0, 4, 2, ' ', 0)
+	write(w)
+	_ = w.Flush()
+	return buffer.String()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// 向运行中的服务端发送控制命令，返回执行结果
+func Control(socket string, args []string) (string, error) {
+	conn, err := net.DialTimeout("unix", socket, controlTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer closeConn(conn)
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+	if _, err = conn.Write([]byte(strings.Join(args, " ") + "\n")); err != nil {
+		return "", err
+	}
+	output, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(string(output), controlErrorPrefix) {
+		return "", errors.New(strings.TrimSpace(strings.TrimPrefix(string(output), controlErrorPrefix)))
+	}
+	return string(output), nil
+}
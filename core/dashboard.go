@@ -0,0 +1,63 @@
+package core
+
+import (
+	"chuantou/config"
+	"crypto/subtle"
+	"embed"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 控制台页面，编译进程序，不依赖外部资源
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// 网页控制台，使用 HTTP Basic 认证，用户名任意，密码为控制台密码
+// 踢出客户端、关闭映射等非 GET 请求须来自控制台页面本身
+//
+// GET  /                 控制台页面
+// *    /dashboard/api/*  同管理接口 /api/*
+func DashboardHandler(cfg config.ServerConfig) http.Handler {
+	static, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/dashboard/api/", http.StripPrefix("/dashboard", apiHandler(cfg)))
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	return requirePassword(cfg.DashboardPassword, sameOrigin(mux))
+}
+
+// 校验非 GET 请求的 Origin 或 Referer 与控制台同源
+// 浏览器会自动携带 Basic 认证信息，只凭认证无法阻止其他网站伪造的 POST 请求
+func sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			source := r.Header.Get("Origin")
+			if source == "" {
+				source = r.Header.Get("Referer")
+			}
+			u, err := url.Parse(source)
+			if source == "" || err != nil || u.Host == "" || !strings.EqualFold(u.Host, r.Host) {
+				writeError(w, http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 校验控制台密码，未配置密码时拒绝所有请求
+func requirePassword(password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, given, ok := r.BasicAuth()
+		if password == "" || !ok || subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chuantou", charset="UTF-8"`)
+			writeError(w, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,137 @@
+"use strict";
+
+// 刷新间隔，毫秒
+const refreshInterval = 2000;
+
+// 上次刷新的时间及各映射、客户端转发的字节数，用于计算吞吐
+let last = {time: 0, tunnels: {}, clients: {}};
+
+function api(path, method) {
+    return fetch("dashboard/api/" + path, {method: method || "GET", credentials: "same-origin"})
+        .then(response => {
+            if (!response.ok) {
+                throw new Error(response.status + " " + response.statusText);
+            }
+            return response.json();
+        });
+}
+
+function formatBytes(bytes) {
+    const units = ["B", "K", "M", "G", "T"];
+    let i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+        bytes /= 1024;
+        i++;
+    }
+    return (i === 0 ? bytes : bytes.toFixed(1)) + units[i];
+}
+
+function formatTime(value) {
+    const time = new Date(value);
+    return isNaN(time) ? "" : time.toLocaleString();
+}
+
+// 吞吐，两次刷新之间转发的字节数除以间隔
+function throughput(previous, current, seconds) {
+    if (previous === undefined || seconds <= 0 || current < previous) {
+        return "-";
+    }
+    return formatBytes((current - previous) / seconds) + "/s";
+}
+
+function cell(text, className) {
+    const td = document.createElement("td");
+    td.textContent = text === undefined || text === null ? "" : text;
+    if (className) {
+        td.className = className;
+    }
+    return td;
+}
+
+function buttonCell(label, confirmText, onClick) {
+    const td = document.createElement("td");
+    const button = document.createElement("button");
+    button.textContent = label;
+    button.onclick = () => {
+        if (confirm(confirmText)) {
+            onClick().then(refresh).catch(err => alert(err.message));
+        }
+    };
+    td.appendChild(button);
+    return td;
+}
+
+function render(id, rows, build) {
+    const tbody = document.getElementById(id);
+    tbody.replaceChildren(...rows.map(row => {
+        const tr = document.createElement("tr");
+        build(row).forEach(td => tr.appendChild(td));
+        return tr;
+    }));
+}
+
+function refresh() {
+    return api("overview").then(data => {
+        const now = new Date(data.time).getTime();
+        const seconds = last.time ? (now - last.time) / 1000 : 0;
+        const current = {time: now, tunnels: {}, clients: {}};
+
+        render("tunnels", data.tunnels, t => {
+            current.tunnels[t.key] = t.transferred;
+            const c = t.connections;
+            return [
+                cell(t.key, "mono"),
+                cell(t.domain ? "http" : t.sni ? "sni" : t.network),
+                cell(t.client_id, "mono"),
+                cell(t.user),
+                cell(t.remote_addr, "mono"),
+                cell(formatTime(t.create_time)),
+                cell(t.streams),
+                cell(c.active + "/" + c.accepted + "/" + c.rejected),
+                cell(throughput(last.tunnels[t.key], t.transferred, seconds)),
+                cell(formatBytes(t.traffic)),
+                buttonCell("关闭", "关闭映射 " + t.key + "？", () => api("close?key=" + encodeURIComponent(t.key), "POST")),
+            ];
+        });
+        render("clients", data.clients, c => {
+            current.clients[c.id] = c.transferred;
+            return [
+                cell(c.id, "mono"),
+                cell(c.user),
+                cell(c.remote_addr, "mono"),
+                cell(c.mappings.join(", ")),
+                cell(c.streams),
+                cell(formatTime(c.since)),
+                cell(throughput(last.clients[c.id], c.transferred, seconds)),
+                buttonCell("踢出", "关闭客户端 " + c.id + " 的所有映射？", () => api("kick?id=" + encodeURIComponent(c.id), "POST")),
+            ];
+        });
+        render("visitors", data.visitors, v => [
+            cell(formatTime(v.time)),
+            cell(v.mapping, "mono"),
+            cell(v.remote, "mono"),
+            cell(v.result === "accepted" ? "接受" : "拒绝", v.result),
+        ]);
+        render("auth-failures", data.auth_failures, a => [
+            cell(formatTime(a.time)),
+            cell(a.remote, "mono"),
+            cell(a.mapping, "mono"),
+            cell(a.user),
+            cell(a.code),
+        ]);
+
+        document.getElementById("tunnel-count").textContent = data.tunnels.length;
+        document.getElementById("client-count").textContent = data.clients.length;
+        const status = document.getElementById("status");
+        status.textContent = "更新于 " + formatTime(data.time);
+        status.className = "";
+        last = current;
+    }).catch(err => {
+        const status = document.getElementById("status");
+        status.textContent = "刷新失败：" + err.message;
+        status.className = "error";
+    });
+}
+
+refresh();
+setInterval(refresh, refreshInterval);
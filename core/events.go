@@ -0,0 +1,61 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// 保留的最近事件数
+const recentEventSize = 100
+
+// 事件，访问者连接或隧道鉴权失败
+type Event struct {
+	Time     time.Time `json:"time"`
+	Mapping  string    `json:"mapping,omitempty"`   // 访问端口、访问域名或 SNI
+	Remote   string    `json:"remote"`              // 访问者或客户端地址
+	ClientID string    `json:"client_id,omitempty"` // 客户端机器码
+	User     string    `json:"user,omitempty"`      // 登录用户
+	Result   string    `json:"result,omitempty"`    // 访问者连接结果
+	Code     byte      `json:"code,omitempty"`      // 注册结果
+}
+
+// 最近的事件，环形缓冲，超出容量时丢弃最早的事件
+type eventLog struct {
+	mutex  sync.Mutex
+	events []Event
+	next   int
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{events: make([]Event, 0, size)}
+}
+
+// 记录事件
+func (l *eventLog) add(event Event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.events) < cap(l.events) {
+		l.events = append(l.events, event)
+		return
+	}
+	l.events[l.next] = event
+	l.next = (l.next + 1) % len(l.events)
+}
+
+// 最近的事件，最新的在前
+func (l *eventLog) recent() []Event {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	events := make([]Event, 0, len(l.events))
+	for i := len(l.events) - 1; i >= 0; i-- {
+		events = append(events, l.events[(l.next+i)%len(l.events)])
+	}
+	return events
+}
+
+var (
+	// 最近的访问者连接
+	recentVisitors = newEventLog(recentEventSize)
+	// 最近的隧道鉴权失败
+	recentAuthFailures = newEventLog(recentEventSize)
+)
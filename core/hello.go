@@ -0,0 +1,235 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// 通讯协议版本，与软件版本号无关，只有通讯方式不兼容时才递增
+	// 1 为 1.4.x 及之前使用的旧协议，不再支持
+	protocolVersionMin = 2
+	protocolVersionMax = 2
+
+	// 特性
+	featureMux       = 1 << 0 // 多路复用
+	featureUDP       = 1 << 1 // UDP 转发
+	featureVisitor   = 1 << 2 // 新建流时发送访问者信息
+	featureChallenge = 1 << 3 // 挑战应答鉴权，密钥不再传输
+
+	// 本端支持的特性
+	supportedFeatures = featureMux | featureUDP | featureVisitor | featureChallenge
+	// 双方必须同时支持的特性
+	requiredFeatures = featureMux | featureChallenge
+
+	// 挑战随机数长度
+	nonceSize = 16
+)
+
+// 特性名称，用于日志
+var featureNames = []struct {
+	feature uint32
+	name    string
+}{
+	{featureMux, "mux"},
+	{featureUDP, "udp"},
+	{featureVisitor, "visitor"},
+	{featureChallenge, "challenge"},
+}
+
+// 握手信息
+// 客户端发送支持的协议版本范围及特性，服务端回复协商结果
+type hello struct {
+	Result      byte   // 协商结果
+	Version     uint32 // 软件版本号，仅用于日志
+	MinProtocol uint32 // 最低协议版本
+	MaxProtocol uint32 // 最高协议版本，协商结果中为选定的协议版本
+	Features    uint32 // 特性，协商结果中为双方共同支持的特性
+	Nonce       []byte // 挑战随机数，服务端在协商结果中下发，每个连接只使用一次
+
+	legacy bool // 对端是否为旧版协议
+}
+
+// 本端握手信息
+func localHello() hello {
+	return hello{
+		Result:      protocolResultSuccess,
+		Version:     Version,
+		MinProtocol: protocolVersionMin,
+		MaxProtocol: protocolVersionMax,
+		Features:    supportedFeatures,
+	}
+}
+
+// 转字符串
+func (h *hello) String() string {
+	return fmt.Sprintf("version=%d protocol=%d-%d features=%s", h.Version, h.MinProtocol, h.MaxProtocol, featureString(h.Features))
+}
+
+// 是否成功
+func (h *hello) Success() bool {
+	return h.Result == protocolResultSuccess
+}
+
+// 是否支持某个特性
+func (h *hello) Has(feature uint32) bool {
+	return h.Features&feature == feature
+}
+
+// 序列化
+func (h *hello) Bytes() []byte {
+	buffer := bytes.NewBuffer([]byte{})
+
+	writeField(buffer, protocolFieldResult, []byte{h.Result})
+	writeUint32Field(buffer, protocolFieldVersion, h.Version)
+	writeUint32Field(buffer, protocolFieldMinProtocol, h.MinProtocol)
+	writeUint32Field(buffer, protocolFieldMaxProtocol, h.MaxProtocol)
+	writeUint32Field(buffer, protocolFieldFeatures, h.Features)
+	if len(h.Nonce) > 0 {
+		writeField(buffer, protocolFieldNonce, h.Nonce)
+	}
+	return buffer.Bytes()
+}
+
+// 解析握手信息
+func parseHello(body []byte) hello {
+	fields, err := parseFields(body)
+	if err != nil {
+		return hello{Result: protocolResultFail}
+	}
+	result, exists := fields[protocolFieldResult]
+	if !exists || len(result) != 1 {
+		return hello{Result: protocolResultFail}
+	}
+	return hello{
+		Result:      result[0],
+		Version:     uint32Field(fields, protocolFieldVersion),
+		MinProtocol: uint32Field(fields, protocolFieldMinProtocol),
+		MaxProtocol: uint32Field(fields, protocolFieldMaxProtocol),
+		Features:    uint32Field(fields, protocolFieldFeatures),
+		Nonce:       fields[protocolFieldNonce],
+	}
+}
+
+// 特性转字符串
+func featureString(features uint32) string {
+	var names []string
+	for _, item := range featureNames {
+		if features&item.feature != 0 {
+			names = append(names, item.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// 协商协议版本及特性，取双方共同支持的最高版本
+func negotiate(local, remote hello) hello {
+	result := hello{
+		Result:      protocolResultSuccess,
+		Version:     local.Version,
+		MinProtocol: local.MinProtocol,
+		MaxProtocol: local.MaxProtocol,
+		Features:    local.Features & remote.Features,
+	}
+	if remote.MinProtocol > result.MinProtocol {
+		result.MinProtocol = remote.MinProtocol
+	}
+	if remote.MaxProtocol < result.MaxProtocol {
+		result.MaxProtocol = remote.MaxProtocol
+	}
+	if result.MinProtocol > result.MaxProtocol || !result.Has(requiredFeatures) {
+		result.Result = protocolResultVersionMismatch
+	}
+	// 协商结果中最低、最高版本均为选定版本
+	result.MinProtocol = result.MaxProtocol
+	return result
+}
+
+// 发送握手信息
+func sendHello(conn net.Conn, h hello) bool {
+	if err := sendFrame(conn, protocolFrameHello, h.Bytes()); err != nil {
+		handshakeLog.Warn("Send hello failed", "hello", h.String(), "remote", addrString(conn.RemoteAddr()), "error", err)
+		return false
+	}
+	return true
+}
+
+// 接收握手信息
+// 对端使用旧版协议时，返回的 legacy 为 true，并附带解析出的旧版请求
+func receiveHello(conn net.Conn) (hello, Protocol) {
+	frameType, body, legacy, err := receiveFrame(conn)
+	if err != nil {
+		return hello{Result: protocolResultFailToReceive}, Protocol{}
+	}
+	if legacy {
+		req := parseLegacyProtocol(body)
+		return hello{Result: protocolResultVersionMismatch, Version: req.Version, legacy: true}, req
+	}
+	if frameType != protocolFrameHello {
+		return hello{Result: protocolResultVersionMismatch}, Protocol{}
+	}
+	return parseHello(body), Protocol{}
+}
+
+// 服务端握手，成功时返回协商结果
+func serverHandshake(conn net.Conn) (hello, bool) {
+	remote, legacyReq := receiveHello(conn)
+	if remote.legacy {
+		// 旧版客户端，以旧格式回复版本不匹配
+		handshakeLog.Warn("Version mismatch, legacy client", "request", legacyReq.String(), "remote", addrString(conn.RemoteAddr()))
+		sendProtocol(conn, legacyReq.NewResult(protocolResultVersionMismatch))
+		return remote, false
+	}
+	if remote.Result != protocolResultSuccess {
+		if remote.Result == protocolResultVersionMismatch {
+			sendHello(conn, hello{Result: protocolResultVersionMismatch, Version: Version})
+		}
+		return remote, false
+	}
+
+	result := negotiate(localHello(), remote)
+	if result.Success() {
+		// 下发挑战随机数，客户端以密钥计算应答
+		result.Nonce = make([]byte, nonceSize)
+		if _, err := rand.Read(result.Nonce); err != nil {
+			handshakeLog.Error("Fail to generate nonce", "error", err)
+			return result, false
+		}
+	}
+	if !sendHello(conn, result) || !result.Success() {
+		handshakeLog.Warn("Version mismatch", "hello", remote.String(), "remote", addrString(conn.RemoteAddr()))
+		return result, false
+	}
+	handshakeLog.Info("Negotiated protocol", "protocol", result.MaxProtocol, "features", featureString(result.Features),
+		"client_version", remote.Version, "remote", conn.RemoteAddr().String())
+	return result, true
+}
+
+// 客户端握手，返回协商结果
+func clientHandshake(conn net.Conn) hello {
+	if !sendHello(conn, localHello()) {
+		return hello{Result: protocolResultFailToReceive}
+	}
+	result, legacyResp := receiveHello(conn)
+	if result.legacy {
+		// 旧版服务端无法识别新协议
+		handshakeLog.Warn("Server uses legacy protocol", "response", legacyResp.String())
+		result.Result = protocolResultVersionMismatch
+		return result
+	}
+	if result.Success() {
+		handshakeLog.Info("Negotiated protocol", "protocol", result.MaxProtocol, "features", featureString(result.Features),
+			"server_version", result.Version)
+		if len(result.Nonce) != nonceSize {
+			handshakeLog.Warn("Server sent no challenge")
+			result.Result = protocolResultFail
+		}
+	}
+	return result
+}
@@ -0,0 +1,18 @@
+package core
+
+import "chuantou/logging"
+
+// 各子系统的日志，可在 [log] debug 中单独开启调试日志
+var (
+	serverLog    = logging.New("server")    // 服务端启动、监听及配置重新加载
+	clientLog    = logging.New("client")    // 客户端启动及注册
+	handshakeLog = logging.New("handshake") // 握手协商
+	tunnelLog    = logging.New("tunnel")    // 隧道注册及注销
+	visitorLog   = logging.New("visitor")   // 访问者连接
+	heartbeatLog = logging.New("heartbeat") // 心跳检查
+	dialLog      = logging.New("dial")      // 拨号
+	forwardLog   = logging.New("forward")   // 连接转发
+	authLog      = logging.New("auth")      // 鉴权及封禁
+	trafficLog   = logging.New("traffic")   // 流量统计
+	adminLog     = logging.New("admin")     // 管理接口、控制台及指标接口
+)
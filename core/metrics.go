@@ -0,0 +1,320 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus 文本格式的指标，服务端及客户端共用，不依赖第三方库
+
+// 指标，按 Prometheus 文本格式输出
+type metric interface {
+	write(w io.Writer)
+}
+
+// 带标签的计数器或仪表，标签以名称、值交替给出
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	mutex  sync.Mutex
+	values map[string]float64 // 格式化后的标签 -> 值
+}
+
+func newMetricVec(name, help, kind string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, values: make(map[string]float64)}
+}
+
+// 增加计数
+func (m *metricVec) add(value float64, labels ...string) {
+	key := formatLabels(labels)
+	m.mutex.Lock()
+	m.values[key] += value
+	m.mutex.Unlock()
+}
+
+// 计数加一
+func (m *metricVec) inc(labels ...string) {
+	m.add(1, labels...)
+}
+
+// 合计标签包含 match 的值，match 如 result="accepted"，为空时合计所有值
+func (m *metricVec) total(match ...string) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sum := 0.0
+	for key, value := range m.values {
+		matched := true
+		for _, label := range match {
+			matched = matched && strings.Contains(key, label)
+		}
+		if matched {
+			sum += value
+		}
+	}
+	return sum
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mutex.Lock()
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writeMetricHeader(w, m.name, m.help, m.kind)
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", m.name, key, formatValue(m.values[key]))
+	}
+	m.mutex.Unlock()
+}
+
+// 抓取时才计算的仪表，如已注册的端口数
+type gaugeFunc struct {
+	name    string
+	help    string
+	collect func(gauge *metricVec)
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	gauge := newMetricVec(g.name, g.help, "gauge")
+	g.collect(gauge)
+	gauge.write(w)
+}
+
+// 直方图，buckets 为递增的上界
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mutex   sync.Mutex
+	counts  []uint64 // 各上界的累计计数
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// 记录一次观测值
+func (h *histogram) observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	for i, bucket := range h.buckets {
+		_, _ = fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(bucket), h.counts[i])
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	_, _ = fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(h.sum))
+	_, _ = fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// 格式化标签，如 {mapping="13306",result="accepted"}
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	var builder strings.Builder
+	builder.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		builder.WriteString(labels[i])
+		builder.WriteString(`="`)
+		builder.WriteString(labelEscaper.Replace(labels[i+1]))
+		builder.WriteByte('"')
+	}
+	builder.WriteByte('}')
+	return builder.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// 访问者连接结果
+const (
+	visitorAccepted = "accepted"
+	visitorRejected = "rejected"
+)
+
+// 流量方向，in 为访问者发往内网服务，out 为内网服务回复访问者
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+var (
+	metricVisitors = newMetricVec("chuantou_visitor_connections_total",
+		"Visitor connections by mapping and result.", "counter")
+	metricTransfer = newMetricVec("chuantou_transfer_bytes_total",
+		"Bytes forwarded by mapping and direction, in is from visitors.", "counter")
+	metricHeartbeatFailures = newMetricVec("chuantou_heartbeat_failures_total",
+		"Tunnels closed by failed heartbeat or keepalive timeout.", "counter")
+	metricAuthFailures = newMetricVec("chuantou_auth_failures_total",
+		"Rejected tunnel handshakes and registrations by result code.", "counter")
+	metricDialRetries = newMetricVec("chuantou_dial_retries_total",
+		"Failed dials that will be retried, by target address.", "counter")
+	metricHandshake = newHistogram("chuantou_handshake_duration_seconds",
+		"Time from tunnel connection to registration result.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
+
+	metricRegisteredPorts = &gaugeFunc{
+		name: "chuantou_registered_ports",
+		help: "Registered mappings, including domain and SNI mappings.",
+		collect: func(gauge *metricVec) {
+			gauge.add(0)
+			forEachTunnel(func(string, *muxSession) {
+				gauge.inc()
+			})
+		},
+	}
+	metricTunnels = &gaugeFunc{
+		name: "chuantou_tunnel_connections",
+		help: "Open tunnel connections by mapping, one per mapping since multiplexing.",
+		collect: func(gauge *metricVec) {
+			forEachTunnel(func(mapping string, session *muxSession) {
+				if !session.isClosed() {
+					gauge.inc("mapping", mapping)
+				}
+			})
+		},
+	}
+	metricStreams = &gaugeFunc{
+		name: "chuantou_tunnel_streams",
+		help: "Open streams in tunnel connections by mapping.",
+		collect: func(gauge *metricVec) {
+			forEachTunnel(func(mapping string, session *muxSession) {
+				gauge.add(float64(session.numStreams()), "mapping", mapping)
+			})
+		},
+	}
+
+	metricList = []metric{
+		metricRegisteredPorts,
+		metricTunnels,
+		metricStreams,
+		metricVisitors,
+		metricTransfer,
+		metricHeartbeatFailures,
+		metricAuthFailures,
+		metricDialRetries,
+		metricHandshake,
+	}
+)
+
+func init() {
+	// 没有标签的计数器，未发生时也输出 0
+	metricHeartbeatFailures.add(0)
+}
+
+// 客户端已建立的会话
+// key:   映射名称，即访问端口、访问域名或 SNI
+// value: *muxSession
+var clientSessions sync.Map
+
+// 遍历服务端已注册的隧道及客户端已建立的会话
+func forEachTunnel(callback func(mapping string, session *muxSession)) {
+	tunnelContextMap.Range(func(key, value interface{}) bool {
+		if session := value.(*TunnelContext).session; session != nil {
+			callback(fmt.Sprint(key), session)
+		}
+		return true
+	})
+	clientSessions.Range(func(key, value interface{}) bool {
+		callback(fmt.Sprint(key), value.(*muxSession))
+		return true
+	})
+}
+
+// 记录访问者连接
+func countVisitor(mapping string, accepted bool) {
+	if accepted {
+		metricVisitors.inc("mapping", mapping, "result", visitorAccepted)
+	} else {
+		metricVisitors.inc("mapping", mapping, "result", visitorRejected)
+	}
+}
+
+// 记录转发的字节数
+func countTransfer(mapping string, in, out int64) {
+	if in > 0 {
+		metricTransfer.add(float64(in), "mapping", mapping, "direction", directionIn)
+	}
+	if out > 0 {
+		metricTransfer.add(float64(out), "mapping", mapping, "direction", directionOut)
+	}
+}
+
+// 记录注册结果，非成功结果计入鉴权失败
+func countRegistration(result byte, start time.Time) {
+	metricHandshake.observe(time.Since(start).Seconds())
+	if result != protocolResultSuccess {
+		metricAuthFailures.inc("code", strconv.Itoa(int(result)))
+	}
+}
+
+// 指标接口，Prometheus 文本格式
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writer := bufio.NewWriter(w)
+		for _, m := range metricList {
+			m.write(writer)
+		}
+		_ = writer.Flush()
+	})
+}
+
+// 监听指标接口，addr 为空时不启用
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		adminLog.Fatal("Fail to listen the metrics address", "addr", addr, "error", err)
+	}
+	adminLog.Info("Metrics listening", "addr", listener.Addr().String()+"/metrics")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: vhostReadTimeout,
+	}
+	if err = server.Serve(listener); err != nil {
+		adminLog.Info("Metrics closed", "error", err)
+	}
+}
@@ -0,0 +1,512 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// 多路复用-命令
+	muxCmdSyn = 0 // 新建流
+	muxCmdFin = 1 // 关闭流
+	muxCmdPsh = 2 // 数据
+	muxCmdUpd = 3 // 窗口更新
+	muxCmdNop = 4 // 保活
+
+	// 多路复用协议版本
+	muxVersion = 1
+	// 帧头长度
+	muxHeaderSize = 10
+	// 单帧最大数据长度
+	muxMaxFrameSize = 32 * 1024
+	// 每个流的接收窗口
+	muxStreamWindow = 256 * 1024
+	// 等待接受的流数量
+	muxAcceptBacklog = 1024
+
+	// 保活间隔时间
+	muxKeepAliveInterval = 15 * time.Second
+	// 保活超时时间，超过此时间未收到任何帧，认为会话失效
+	muxKeepAliveTimeout = 3 * muxKeepAliveInterval
+)
+
+var (
+	errMuxSessionClosed = errors.New("mux: session closed")
+	errMuxStreamClosed  = errors.New("mux: stream closed")
+	errMuxTimeout       = &muxTimeoutError{}
+)
+
+// 超时错误，实现 net.Error
+type muxTimeoutError struct{}
+
+func (e *muxTimeoutError) Error() string   { return "mux: i/o timeout" }
+func (e *muxTimeoutError) Timeout() bool   { return true }
+func (e *muxTimeoutError) Temporary() bool { return true }
+
+// 帧格式
+// 版本|命令|流ID|数据长度|数据
+// 1|1|4|4|n
+type muxFrame struct {
+	cmd  byte
+	id   uint32
+	data []byte
+}
+
+// 多路复用会话，在一条连接上承载多个逻辑流
+type muxSession struct {
+	conn       net.Conn
+	nextID     uint32                // 下一个流ID，客户端为奇数，服务端为偶数
+	streams    map[uint32]*muxStream // 活动的流
+	mutex      sync.Mutex            // 保护 nextID 与 streams
+	writeMutex sync.Mutex            // 保证帧写入完整
+	acceptChan chan *muxStream       // 对端新建的流
+	die        chan struct{}         // 会话关闭信号
+	dieOnce    sync.Once
+}
+
+// 新建会话，client 决定流ID的奇偶性，避免双方ID冲突
+func newMuxSession(conn net.Conn, client bool) *muxSession {
+	session := &muxSession{
+		conn:       conn,
+		nextID:     2,
+		streams:    make(map[uint32]*muxStream),
+		acceptChan: make(chan *muxStream, muxAcceptBacklog),
+		die:        make(chan struct{}),
+	}
+	if client {
+		session.nextID = 1
+	}
+	go session.recvLoop()
+	go session.keepAlive()
+	return session
+}
+
+// 新建一个流
+func (s *muxSession) openStream() (*muxStream, error) {
+	if s.isClosed() {
+		return nil, errMuxSessionClosed
+	}
+	s.mutex.Lock()
+	id := s.nextID
+	s.nextID += 2
+	stream := newMuxStream(id, s)
+	s.streams[id] = stream
+	s.mutex.Unlock()
+
+	if err := s.writeFrame(muxFrame{cmd: muxCmdSyn, id: id}); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// 等待对端新建的流
+func (s *muxSession) acceptStream() (*muxStream, error) {
+	select {
+	case stream := <-s.acceptChan:
+		return stream, nil
+	case <-s.die:
+		return nil, errMuxSessionClosed
+	}
+}
+
+// 活动流数量
+func (s *muxSession) numStreams() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.streams)
+}
+
+// 关闭会话及其所有流
+func (s *muxSession) close() {
+	s.dieOnce.Do(func() {
+		close(s.die)
+		closeConn(s.conn)
+
+		s.mutex.Lock()
+		for id, stream := range s.streams {
+			stream.notifyRead()
+			stream.notifyWrite()
+			delete(s.streams, id)
+		}
+		s.mutex.Unlock()
+	})
+}
+
+// 会话是否已关闭
+func (s *muxSession) isClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// 会话关闭通知
+func (s *muxSession) closeChan() <-chan struct{} {
+	return s.die
+}
+
+func (s *muxSession) removeStream(id uint32) {
+	s.mutex.Lock()
+	delete(s.streams, id)
+	s.mutex.Unlock()
+}
+
+func (s *muxSession) getStream(id uint32) *muxStream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.streams[id]
+}
+
+// 写帧
+func (s *muxSession) writeFrame(frame muxFrame) error {
+	buffer := bytes.NewBuffer(make([]byte, 0, muxHeaderSize+len(frame.data)))
+	buffer.WriteByte(muxVersion)
+	buffer.WriteByte(frame.cmd)
+	_ = binary.Write(buffer, binary.BigEndian, frame.id)
+	_ = binary.Write(buffer, binary.BigEndian, uint32(len(frame.data)))
+	buffer.Write(frame.data)
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if s.isClosed() {
+		return errMuxSessionClosed
+	}
+	// 写超时，避免对端失去响应时永久阻塞
+	if err := s.conn.SetWriteDeadline(time.Now().Add(muxKeepAliveTimeout)); err != nil {
+		s.close()
+		return err
+	}
+	if _, err := s.conn.Write(buffer.Bytes()); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+// 读帧
+func (s *muxSession) readFrame(header []byte) (muxFrame, error) {
+	// 超过保活超时时间未收到任何帧，认为连接已失效
+	if err := s.conn.SetReadDeadline(time.Now().Add(muxKeepAliveTimeout)); err != nil {
+		return muxFrame{}, err
+	}
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		return muxFrame{}, err
+	}
+	if header[0] != muxVersion {
+		return muxFrame{}, errors.New("mux: version mismatch")
+	}
+	frame := muxFrame{
+		cmd: header[1],
+		id:  binary.BigEndian.Uint32(header[2:6]),
+	}
+	length := binary.BigEndian.Uint32(header[6:10])
+	if length > muxMaxFrameSize {
+		return muxFrame{}, errors.New("mux: frame too large")
+	}
+	if length > 0 {
+		frame.data = make([]byte, length)
+		if _, err := io.ReadFull(s.conn, frame.data); err != nil {
+			return muxFrame{}, err
+		}
+	}
+	return frame, nil
+}
+
+// 接收循环，分发帧到对应的流
+func (s *muxSession) recvLoop() {
+	defer s.close()
+
+	header := make([]byte, muxHeaderSize)
+	for {
+		frame, err := s.readFrame(header)
+		if err != nil {
+			// 超过保活超时时间未收到任何帧
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				heartbeatLog.Warn("Keepalive timeout, close session", "remote", addrString(s.conn.RemoteAddr()))
+				metricHeartbeatFailures.inc()
+			}
+			return
+		}
+
+		switch frame.cmd {
+		case muxCmdNop:
+			// 保活帧，不做任何处理
+		case muxCmdSyn:
+			s.mutex.Lock()
+			if _, exists := s.streams[frame.id]; exists {
+				s.mutex.Unlock()
+				continue
+			}
+			stream := newMuxStream(frame.id, s)
+			s.streams[frame.id] = stream
+			s.mutex.Unlock()
+
+			select {
+			case s.acceptChan <- stream:
+			default:
+				// 积压过多，拒绝新流
+				s.removeStream(frame.id)
+				_ = s.writeFrame(muxFrame{cmd: muxCmdFin, id: frame.id})
+			}
+		case muxCmdPsh:
+			if stream := s.getStream(frame.id); stream != nil {
+				stream.pushData(frame.data)
+			}
+		case muxCmdUpd:
+			if stream := s.getStream(frame.id); stream != nil && len(frame.data) == 4 {
+				stream.addWindow(binary.BigEndian.Uint32(frame.data))
+			}
+		case muxCmdFin:
+			if stream := s.getStream(frame.id); stream != nil {
+				stream.remoteClose()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// 定时发送保活帧
+func (s *muxSession) keepAlive() {
+	ticker := time.NewTicker(muxKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.writeFrame(muxFrame{cmd: muxCmdNop}); err != nil {
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// 逻辑流，实现 net.Conn
+type muxStream struct {
+	id      uint32
+	session *muxSession
+
+	mutex         sync.Mutex
+	buffer        bytes.Buffer // 接收缓冲
+	consumed      uint32       // 已读取但未通知对端的字节数
+	sendWindow    uint32       // 对端剩余接收窗口
+	localClosed   bool
+	remoteClosed  bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readNotify  chan struct{}
+	writeNotify chan struct{}
+}
+
+func newMuxStream(id uint32, session *muxSession) *muxStream {
+	return &muxStream{
+		id:          id,
+		session:     session,
+		sendWindow:  muxStreamWindow,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+func (p *muxStream) notifyRead() {
+	select {
+	case p.readNotify <- struct{}{}:
+	default:
+	}
+}
+
+func (p *muxStream) notifyWrite() {
+	select {
+	case p.writeNotify <- struct{}{}:
+	default:
+	}
+}
+
+// 收到对端数据
+func (p *muxStream) pushData(data []byte) {
+	p.mutex.Lock()
+	// 超出窗口的数据说明对端不遵守流控，直接丢弃
+	if !p.localClosed && uint32(p.buffer.Len())+uint32(len(data)) <= muxStreamWindow {
+		p.buffer.Write(data)
+	}
+	p.mutex.Unlock()
+	p.notifyRead()
+}
+
+// 对端释放了接收窗口
+func (p *muxStream) addWindow(n uint32) {
+	p.mutex.Lock()
+	p.sendWindow += n
+	p.mutex.Unlock()
+	p.notifyWrite()
+}
+
+// 对端关闭了流
+func (p *muxStream) remoteClose() {
+	p.mutex.Lock()
+	p.remoteClosed = true
+	p.mutex.Unlock()
+
+	p.notifyRead()
+	p.notifyWrite()
+}
+
+// 等待通知，支持超时
+func (p *muxStream) wait(notify chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		delay := time.Until(deadline)
+		if delay <= 0 {
+			return errMuxTimeout
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-notify:
+		return nil
+	case <-p.session.die:
+		return errMuxSessionClosed
+	case <-timeout:
+		return errMuxTimeout
+	}
+}
+
+func (p *muxStream) Read(b []byte) (int, error) {
+	for {
+		p.mutex.Lock()
+		if p.buffer.Len() > 0 {
+			n, _ := p.buffer.Read(b)
+			p.consumed += uint32(n)
+			// 已读取超过半个窗口，通知对端继续发送
+			var update uint32
+			if p.consumed >= muxStreamWindow/2 {
+				update, p.consumed = p.consumed, 0
+			}
+			p.mutex.Unlock()
+
+			if update > 0 {
+				data := make([]byte, 4)
+				binary.BigEndian.PutUint32(data, update)
+				_ = p.session.writeFrame(muxFrame{cmd: muxCmdUpd, id: p.id, data: data})
+			}
+			return n, nil
+		}
+		if p.localClosed {
+			p.mutex.Unlock()
+			return 0, errMuxStreamClosed
+		}
+		if p.remoteClosed {
+			p.mutex.Unlock()
+			return 0, io.EOF
+		}
+		deadline := p.readDeadline
+		p.mutex.Unlock()
+
+		if p.session.isClosed() {
+			return 0, io.EOF
+		}
+		if err := p.wait(p.readNotify, deadline); err != nil {
+			if err == errMuxSessionClosed {
+				continue
+			}
+			return 0, err
+		}
+	}
+}
+
+func (p *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		p.mutex.Lock()
+		if p.localClosed || p.remoteClosed {
+			p.mutex.Unlock()
+			return written, errMuxStreamClosed
+		}
+		if p.sendWindow == 0 {
+			deadline := p.writeDeadline
+			p.mutex.Unlock()
+			if err := p.wait(p.writeNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(b) - written
+		if n > muxMaxFrameSize {
+			n = muxMaxFrameSize
+		}
+		if uint32(n) > p.sendWindow {
+			n = int(p.sendWindow)
+		}
+		p.sendWindow -= uint32(n)
+		p.mutex.Unlock()
+
+		if err := p.session.writeFrame(muxFrame{cmd: muxCmdPsh, id: p.id, data: b[written : written+n]}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (p *muxStream) Close() error {
+	p.mutex.Lock()
+	if p.localClosed {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.localClosed = true
+	p.buffer.Reset()
+	p.mutex.Unlock()
+
+	p.notifyRead()
+	p.notifyWrite()
+	// 本地关闭后即移除，对端后续发来的数据将被丢弃
+	p.session.removeStream(p.id)
+	return p.session.writeFrame(muxFrame{cmd: muxCmdFin, id: p.id})
+}
+
+func (p *muxStream) LocalAddr() net.Addr {
+	return p.session.conn.LocalAddr()
+}
+
+func (p *muxStream) RemoteAddr() net.Addr {
+	return p.session.conn.RemoteAddr()
+}
+
+func (p *muxStream) SetDeadline(t time.Time) error {
+	p.mutex.Lock()
+	p.readDeadline = t
+	p.writeDeadline = t
+	p.mutex.Unlock()
+	p.notifyRead()
+	p.notifyWrite()
+	return nil
+}
+
+func (p *muxStream) SetReadDeadline(t time.Time) error {
+	p.mutex.Lock()
+	p.readDeadline = t
+	p.mutex.Unlock()
+	p.notifyRead()
+	return nil
+}
+
+func (p *muxStream) SetWriteDeadline(t time.Time) error {
+	p.mutex.Lock()
+	p.writeDeadline = t
+	p.mutex.Unlock()
+	p.notifyWrite()
+	return nil
+}
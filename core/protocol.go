@@ -2,23 +2,29 @@ package core
 
 import (
 	"bytes"
+	"chuantou/config"
+	"chuantou/geo"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"time"
 )
 
 const (
 	// 协议-结果
-	protocolResultSuccess           = 0 // 成功，默认值
-	protocolResultFail              = 1 // 失败
-	protocolResultHeartBeat         = 2 // 心跳
-	protocolResultFailToReceive     = 3 // 接收失败
-	protocolResultFailToAuth        = 4 // 鉴权失败
-	protocolResultVersionMismatch   = 5 // 版本不匹配
-	protocolResultIllegalAccessPort = 6 // 访问端口不合法
-	protocolResultPortIsOccupied    = 7 // 访问端口被占用
+	protocolResultSuccess           = 0  // 成功，默认值
+	protocolResultFail              = 1  // 失败
+	protocolResultHeartBeat         = 2  // 心跳
+	protocolResultFailToReceive     = 3  // 接收失败
+	protocolResultFailToAuth        = 4  // 鉴权失败
+	protocolResultVersionMismatch   = 5  // 版本不匹配
+	protocolResultIllegalAccessPort = 6  // 访问端口不合法
+	protocolResultPortIsOccupied    = 7  // 访问端口被占用
+	protocolResultUnsupported       = 8  // 不支持的功能
+	protocolResultTooManyMappings   = 9  // 映射数超过用户上限
+	protocolResultQuotaExceeded     = 10 // 当月流量配额已用完
 
 	// 协议发送超时时间
 	protocolSendTimeout = 5 * time.Second
@@ -30,25 +36,94 @@ const (
 	// 第1位为小版本号，用于修复BUG
 	// 第2位为次版本号，用于增删功能
 	// 第3位为主版本号，用于结构等大的升级
-	Version = 140
+	Version = 150
 )
 
-// 协议格式
-// 结果|版本号|访问端口|machineid|Key
-// 1|2|13306|uuid|winshu
+const (
+	// 帧头标识，首字节小于旧协议的最小长度(42)，用于区分 1.4.x 及之前的客户端
+	protocolMagic = 0x1CC7
+	// 帧格式版本，只有帧头结构变化时才递增
+	protocolFrameVersion = 1
+	// 帧头长度
+	protocolHeaderSize = 8
+	// 帧内容最大长度
+	protocolMaxLength = 64 * 1024
+
+	// 帧类型
+	protocolFrameRequest = 1 // 请求及结果
+	protocolFrameHello   = 2 // 握手，协商协议版本及特性
+	protocolFrameVisitor = 3 // 访问者信息，新建流时发送
+
+	// 字段类型
+	protocolFieldResult      = 1  // 结果
+	protocolFieldVersion     = 2  // 版本号
+	protocolFieldPort        = 3  // 访问端口
+	protocolFieldID          = 4  // 机器码
+	protocolFieldKey         = 5  // 旧版协议的 Key，已废弃，不再发送及解析
+	protocolFieldMinProtocol = 6  // 最低协议版本
+	protocolFieldMaxProtocol = 7  // 最高协议版本
+	protocolFieldFeatures    = 8  // 特性
+	protocolFieldNetwork     = 9  // 网络类型
+	protocolFieldDomain      = 10 // 访问域名
+	protocolFieldSNI         = 11 // TLS 服务名称
+	protocolFieldSource      = 12 // 访问者地址
+	protocolFieldDestination = 13 // 访问端口地址
+	protocolFieldUser        = 14 // 用户名
+	protocolFieldNonce       = 15 // 服务端挑战随机数
+	protocolFieldProof       = 16 // 挑战应答
+	protocolFieldToken       = 17 // 令牌声明，不含签名
+	protocolFieldAllow       = 18 // 允许访问的 CIDR，逗号分隔
+	protocolFieldDeny        = 19 // 拒绝访问的 CIDR，逗号分隔
+	protocolFieldGeoAllow    = 20 // 允许访问的国家代码，逗号分隔
+	protocolFieldGeoDeny     = 21 // 拒绝访问的国家代码，逗号分隔
+	protocolFieldRate        = 22 // 映射限速，字节/秒
+	protocolFieldBurst       = 23 // 映射限速突发量，字节
+	protocolFieldMaxConns    = 24 // 最大同时连接数
+	protocolFieldConnRate    = 25 // 每秒新建连接数
+	protocolFieldQueue       = 26 // 超出连接限制时排队等待的毫秒数
+	protocolFieldTarget      = 27 // 内网服务地址，只用于访问日志
+	protocolFieldExpiry      = 28 // 旧版短期 key 的到期日期
+)
+
+// 帧格式
+// 标识|帧版本|帧类型|内容长度|内容
+// 2|1|1|4|n
+//
+// 内容由若干字段组成，每个字段格式为
+// 类型|长度|值
+// 1|2|n
+// 不认识的字段直接忽略，增加字段时不需要修改帧版本
 
 // 协议
 type Protocol struct {
-	Result  byte   // 结果：0 失败，1 成功
-	Version uint32 // 版本号，单调递增
-	Port    uint32 // 访问端口
-	ID      string // 机器码
-	Key     string // 身份验证
+	Result   byte   // 结果：0 失败，1 成功
+	Version  uint32 // 版本号，单调递增
+	Port     uint32 // 访问端口
+	ID       string // 机器码
+	Network  string // 网络类型，为空时表示 tcp
+	Domain   string // 访问域名，为空时按访问端口访问
+	SNI      string // TLS 服务名称，为空时按访问端口访问
+	User     string // 用户名，为空时使用共享 Key 校验
+	Token    string // 令牌声明，使用签名令牌时不为空
+	Proof    []byte // 挑战应答，以密钥对随机数、机器码及访问端口计算的 HMAC
+	Allow    string // 允许访问的 CIDR，为空时不限制
+	Deny     string // 拒绝访问的 CIDR
+	GeoAllow string // 允许访问的国家代码，为空时不限制
+	GeoDeny  string // 拒绝访问的国家代码
+	Rate     uint64 // 映射限速，字节/秒，0 表示不限制
+	Burst    uint64 // 映射限速突发量，0 表示等于限速
+	MaxConns uint32 // 最大同时连接数，0 表示不限制
+	ConnRate uint32 // 每秒新建连接数，0 表示不限制
+	Queue    uint32 // 超出连接限制时排队等待的毫秒数，0 表示立即拒绝
+	Target   string // 内网服务地址，只用于访问日志
+	Expiry   string // 旧版短期 key 的到期日期，如 2019-12-31，短期 key 本身不发送
+
+	legacy bool // 是否为旧版协议，回复时使用旧格式
 }
 
 // 转字符串
 func (p *Protocol) String() string {
-	return fmt.Sprintf("%d|%d|%d|%s|%s", p.Result, p.Version, p.Port, p.ID, p.Key)
+	return fmt.Sprintf("%d|%d|%d|%s|%s", p.Result, p.Version, p.Port, p.ID, p.User)
 }
 
 // 返回一个新结果
@@ -58,7 +133,11 @@ func (p *Protocol) NewResult(newResult byte) Protocol {
 		Version: p.Version,
 		Port:    p.Port,
 		ID:      p.ID,
-		Key:     p.Key,
+		Network: p.Network,
+		Domain:  p.Domain,
+		SNI:     p.SNI,
+		User:    p.User,
+		legacy:  p.legacy,
 	}
 }
 
@@ -66,95 +145,339 @@ func (p *Protocol) NewResult(newResult byte) Protocol {
 func (p *Protocol) Bytes() []byte {
 	buffer := bytes.NewBuffer([]byte{})
 
+	writeField(buffer, protocolFieldResult, []byte{p.Result})
+	writeUint32Field(buffer, protocolFieldVersion, p.Version)
+	writeUint32Field(buffer, protocolFieldPort, p.Port)
+	writeField(buffer, protocolFieldID, []byte(p.ID))
+	if p.Network != "" {
+		writeField(buffer, protocolFieldNetwork, []byte(p.Network))
+	}
+	if p.Domain != "" {
+		writeField(buffer, protocolFieldDomain, []byte(p.Domain))
+	}
+	if p.SNI != "" {
+		writeField(buffer, protocolFieldSNI, []byte(p.SNI))
+	}
+	if p.User != "" {
+		writeField(buffer, protocolFieldUser, []byte(p.User))
+	}
+	if p.Token != "" {
+		writeField(buffer, protocolFieldToken, []byte(p.Token))
+	}
+	if len(p.Proof) > 0 {
+		writeField(buffer, protocolFieldProof, p.Proof)
+	}
+	if p.Allow != "" {
+		writeField(buffer, protocolFieldAllow, []byte(p.Allow))
+	}
+	if p.Deny != "" {
+		writeField(buffer, protocolFieldDeny, []byte(p.Deny))
+	}
+	if p.GeoAllow != "" {
+		writeField(buffer, protocolFieldGeoAllow, []byte(p.GeoAllow))
+	}
+	if p.GeoDeny != "" {
+		writeField(buffer, protocolFieldGeoDeny, []byte(p.GeoDeny))
+	}
+	if p.Rate > 0 {
+		writeUint64Field(buffer, protocolFieldRate, p.Rate)
+	}
+	if p.Burst > 0 {
+		writeUint64Field(buffer, protocolFieldBurst, p.Burst)
+	}
+	if p.MaxConns > 0 {
+		writeUint32Field(buffer, protocolFieldMaxConns, p.MaxConns)
+	}
+	if p.ConnRate > 0 {
+		writeUint32Field(buffer, protocolFieldConnRate, p.ConnRate)
+	}
+	if p.Queue > 0 {
+		writeUint32Field(buffer, protocolFieldQueue, p.Queue)
+	}
+	if p.Target != "" {
+		writeField(buffer, protocolFieldTarget, []byte(p.Target))
+	}
+	if p.Expiry != "" {
+		writeField(buffer, protocolFieldExpiry, []byte(p.Expiry))
+	}
+	return buffer.Bytes()
+}
+
+// 旧版序列化，只用于回复 1.4.x 及之前的客户端
+func (p *Protocol) legacyBytes() []byte {
+	buffer := bytes.NewBuffer([]byte{})
+
 	buffer.WriteByte(p.Result)
 	_ = binary.Write(buffer, binary.BigEndian, p.Version)
 	_ = binary.Write(buffer, binary.BigEndian, p.Port)
 	buffer.WriteString(p.ID)
-	buffer.WriteString(p.Key)
+	// 旧版客户端要求 Key 非空，以占位符代替，不回传请求中的 Key
+	buffer.WriteString("-")
 	return buffer.Bytes()
 }
 
-// 协议长度
-func (p *Protocol) Len() byte {
-	return byte(len(p.Bytes()))
-}
-
 // 是否成功
 func (p *Protocol) Success() bool {
 	return p.Result == protocolResultSuccess
 }
 
+// 隧道标识，按域名或 SNI 访问时为对应名称，否则为访问端口
+func (p *Protocol) tunnelKey() interface{} {
+	if p.Domain != "" {
+		return domainKey(p.Domain)
+	}
+	if p.SNI != "" {
+		return sniKey(p.SNI)
+	}
+	return p.Port
+}
+
+// 映射的访问控制规则
+func (p *Protocol) acl() (config.ACL, error) {
+	return config.ParseACL(p.Allow, p.Deny)
+}
+
+// 映射的访问者连接限制
+func (p *Protocol) connLimit() config.ConnLimit {
+	return config.ConnLimit{
+		MaxConns:     p.MaxConns,
+		Rate:         p.ConnRate,
+		QueueTimeout: time.Duration(p.Queue) * time.Millisecond,
+	}
+}
+
+// 映射的国家策略
+func (p *Protocol) geoPolicy() (geo.Policy, error) {
+	return geo.ParsePolicy(p.GeoAllow, p.GeoDeny)
+}
+
+// 是否共用服务端端口，不需要单独监听
+func (p *Protocol) sharedPort() bool {
+	return p.Domain != "" || p.SNI != ""
+}
+
 // 检查是否是同一客户端
 func (p *Protocol) IsSameID(other *Protocol) bool {
 	return p.ID == other.ID
 }
 
+// 写入字段
+func writeField(buffer *bytes.Buffer, fieldType byte, value []byte) {
+	buffer.WriteByte(fieldType)
+	_ = binary.Write(buffer, binary.BigEndian, uint16(len(value)))
+	buffer.Write(value)
+}
+
+func writeUint32Field(buffer *bytes.Buffer, fieldType byte, value uint32) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	writeField(buffer, fieldType, data)
+}
+
+func writeUint64Field(buffer *bytes.Buffer, fieldType byte, value uint64) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	writeField(buffer, fieldType, data)
+}
+
+// 解析字段，同类型字段以最后一个为准
+func parseFields(body []byte) (map[byte][]byte, error) {
+	fields := make(map[byte][]byte)
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return nil, errors.New("truncated field header")
+		}
+		fieldType := body[0]
+		length := int(binary.BigEndian.Uint16(body[1:3]))
+		if len(body) < 3+length {
+			return nil, errors.New("truncated field value")
+		}
+		fields[fieldType] = body[3 : 3+length]
+		body = body[3+length:]
+	}
+	return fields, nil
+}
+
+func uint32Field(fields map[byte][]byte, fieldType byte) uint32 {
+	if value := fields[fieldType]; len(value) == 4 {
+		return binary.BigEndian.Uint32(value)
+	}
+	return 0
+}
+
+func uint64Field(fields map[byte][]byte, fieldType byte) uint64 {
+	if value := fields[fieldType]; len(value) == 8 {
+		return binary.BigEndian.Uint64(value)
+	}
+	return 0
+}
+
 // 解析协议
 func parseProtocol(body []byte) Protocol {
+	fields, err := parseFields(body)
+	if err != nil {
+		return Protocol{Result: protocolResultFail}
+	}
+	// 结果字段必须存在
+	result, exists := fields[protocolFieldResult]
+	if !exists || len(result) != 1 {
+		return Protocol{Result: protocolResultFail}
+	}
+	return Protocol{
+		Result:   result[0],
+		Version:  uint32Field(fields, protocolFieldVersion),
+		Port:     uint32Field(fields, protocolFieldPort),
+		ID:       string(fields[protocolFieldID]),
+		Network:  string(fields[protocolFieldNetwork]),
+		Domain:   string(fields[protocolFieldDomain]),
+		SNI:      string(fields[protocolFieldSNI]),
+		User:     string(fields[protocolFieldUser]),
+		Token:    string(fields[protocolFieldToken]),
+		Proof:    fields[protocolFieldProof],
+		Allow:    string(fields[protocolFieldAllow]),
+		Deny:     string(fields[protocolFieldDeny]),
+		GeoAllow: string(fields[protocolFieldGeoAllow]),
+		GeoDeny:  string(fields[protocolFieldGeoDeny]),
+		Rate:     uint64Field(fields, protocolFieldRate),
+		Burst:    uint64Field(fields, protocolFieldBurst),
+		MaxConns: uint32Field(fields, protocolFieldMaxConns),
+		ConnRate: uint32Field(fields, protocolFieldConnRate),
+		Queue:    uint32Field(fields, protocolFieldQueue),
+		Target:   string(fields[protocolFieldTarget]),
+		Expiry:   string(fields[protocolFieldExpiry]),
+	}
+}
+
+// 解析旧版协议
+// 结果|版本号|访问端口|machineid|Key
+// 1|4|4|32|n
+// Key 不再使用，解析时丢弃
+func parseLegacyProtocol(body []byte) Protocol {
 	// 检查 body 长度，是否合法
 	if len(body) < 42 {
-		return Protocol{Result: protocolResultFail}
+		return Protocol{Result: protocolResultFail, legacy: true}
 	}
 	return Protocol{
 		Result:  body[0],
 		Version: binary.BigEndian.Uint32(body[1:5]),
 		Port:    binary.BigEndian.Uint32(body[5:9]),
 		ID:      string(body[9:41]),
-		Key:     string(body[41:]),
+		legacy:  true,
 	}
 }
 
-// 发送协议
-// 第一个字节为协议长度
-// 协议长度只支持到255
-func sendProtocol(conn net.Conn, req Protocol) bool {
-	buffer := bytes.NewBuffer([]byte{})
-	buffer.WriteByte(req.Len())
-	buffer.Write(req.Bytes())
+// 发送帧
+func sendFrame(conn net.Conn, frameType byte, body []byte) error {
+	if len(body) > protocolMaxLength {
+		return errors.New("frame too large")
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, protocolHeaderSize+len(body)))
+	_ = binary.Write(buffer, binary.BigEndian, uint16(protocolMagic))
+	buffer.WriteByte(protocolFrameVersion)
+	buffer.WriteByte(frameType)
+	_ = binary.Write(buffer, binary.BigEndian, uint32(len(body)))
+	buffer.Write(body)
 
 	// 设置写超时时间，避免连接断开的问题
 	if err := conn.SetWriteDeadline(time.Now().Add(protocolSendTimeout)); err != nil {
-		log.Println("Fail to set write deadline.", err.Error())
-		return false
+		return err
 	}
-	// 写协议内容
 	if _, err := conn.Write(buffer.Bytes()); err != nil {
-		log.Printf("Send protocol failed. [%s] %s\n", req.String(), err.Error())
-		return false
+		return err
 	}
 	// 清空写超时设置
-	if err := conn.SetWriteDeadline(time.Time{}); err != nil {
-		log.Println("Fail to clear write deadline.", err.Error())
+	return conn.SetWriteDeadline(time.Time{})
+}
+
+// 接收帧，首字节不是帧标识时按旧版协议读取，legacy 为 true
+func receiveFrame(conn net.Conn) (frameType byte, body []byte, legacy bool, err error) {
+	// 设置读超时时间略大于心跳时间，避免连接断开的问题
+	if err = conn.SetReadDeadline(time.Now().Add(protocolReceiveTimeout)); err != nil {
+		return
+	}
+	first := make([]byte, 1)
+	if _, err = io.ReadFull(conn, first); err != nil {
+		return
+	}
+
+	if first[0] != protocolMagic>>8 {
+		// 旧版协议，第一个字节为协议长度
+		legacy = true
+		body = make([]byte, first[0])
+		if _, err = io.ReadFull(conn, body); err != nil {
+			return
+		}
+	} else {
+		header := make([]byte, protocolHeaderSize-1)
+		if _, err = io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if header[0] != protocolMagic&0xFF {
+			err = errors.New("bad frame magic")
+			return
+		}
+		if header[1] != protocolFrameVersion {
+			err = errors.New("unsupported frame version")
+			return
+		}
+		frameType = header[2]
+		length := binary.BigEndian.Uint32(header[3:7])
+		if length > protocolMaxLength {
+			err = errors.New("frame too large")
+			return
+		}
+		body = make([]byte, length)
+		if _, err = io.ReadFull(conn, body); err != nil {
+			return
+		}
+	}
+	// 清空读超时设置
+	err = conn.SetReadDeadline(time.Time{})
+	return
+}
+
+// 发送协议
+func sendProtocol(conn net.Conn, req Protocol) bool {
+	var err error
+	if req.legacy {
+		// 旧版协议，第一个字节为协议长度，只支持到255
+		err = sendLegacyFrame(conn, req.legacyBytes())
+	} else {
+		err = sendFrame(conn, protocolFrameRequest, req.Bytes())
+	}
+	if err != nil {
+		tunnelLog.Warn("Send protocol failed", "request", req.String(), "remote", addrString(conn.RemoteAddr()), "error", err)
 		return false
 	}
-	//log.Println("Send protocol", req.String())
+	tunnelLog.Debug("Send protocol", "request", req.String(), "remote", addrString(conn.RemoteAddr()))
 	return true
 }
 
+// 发送旧版协议帧
+func sendLegacyFrame(conn net.Conn, body []byte) error {
+	if len(body) > 255 {
+		return errors.New("legacy frame too large")
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(protocolSendTimeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(append([]byte{byte(len(body))}, body...)); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(time.Time{})
+}
+
 // 接收协议
-// 第一个字节为协议长度
 func receiveProtocol(conn net.Conn) Protocol {
-	var err error
-	var length byte
-
-	// 设置读超时时间略大于心跳时间，避免连接断开的问题
-	if err := conn.SetReadDeadline(time.Now().Add(protocolReceiveTimeout)); err != nil {
-		log.Println("Fail to set read deadline.", err.Error())
-		return Protocol{Result: protocolResultFailToReceive}
+	frameType, body, legacy, err := receiveFrame(conn)
+	if err != nil {
+		return Protocol{Result: protocolResultFailToReceive, legacy: legacy}
 	}
-	// 读取协议长度
-	if err = binary.Read(conn, binary.BigEndian, &length); err != nil {
-		return Protocol{Result: protocolResultFailToReceive}
+	if legacy {
+		return parseLegacyProtocol(body)
 	}
-	// 读取协议内容
-	body := make([]byte, length)
-	if err = binary.Read(conn, binary.BigEndian, &body); err != nil {
-		return Protocol{Result: protocolResultFailToReceive}
-	}
-	// 清空读超时设置
-	if err := conn.SetReadDeadline(time.Time{}); err != nil {
-		log.Println("Fail to clear read deadline.", err.Error())
-		return Protocol{Result: protocolResultFailToReceive}
+	if frameType != protocolFrameRequest {
+		return Protocol{Result: protocolResultFail}
 	}
 	return parseProtocol(body)
 }
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"bytes"
+	"chuantou/config"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// HAProxy PROXY 协议 v2 签名
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// 解析地址，失败时返回 nil
+func splitAddr(address string) (net.IP, uint16) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0
+	}
+	ip := net.ParseIP(host)
+	number, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, 0
+	}
+	return ip, uint16(number)
+}
+
+// 解析访问者地址，两端地址族不一致或未知时 ok 为 false
+func visitorAddrs(info visitor) (srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, ok bool) {
+	srcIP, srcPort = splitAddr(info.Source)
+	dstIP, dstPort = splitAddr(info.Destination)
+	if srcIP == nil || dstIP == nil || (srcIP.To4() == nil) != (dstIP.To4() == nil) {
+		return nil, 0, nil, 0, false
+	}
+	return srcIP, srcPort, dstIP, dstPort, true
+}
+
+// 生成 PROXY 协议 v1 头，只支持 TCP
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func proxyHeaderV1(info visitor) []byte {
+	srcIP, srcPort, dstIP, dstPort, ok := visitorAddrs(info)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	if srcIP.To4() != nil {
+		family = "TCP4"
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP.String(), dstIP.String(), srcPort, dstPort))
+}
+
+// 生成 PROXY 协议 v2 头
+// 签名|版本及命令|地址族及协议|地址长度|地址
+// 12|1|1|2|n
+func proxyHeaderV2(info visitor, udp bool) []byte {
+	buffer := bytes.NewBuffer([]byte{})
+	buffer.Write(proxyV2Signature)
+
+	srcIP, srcPort, dstIP, dstPort, ok := visitorAddrs(info)
+	if !ok {
+		// LOCAL 命令，不携带地址
+		buffer.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buffer.Bytes()
+	}
+
+	transport := byte(0x01)
+	if udp {
+		transport = 0x02
+	}
+	buffer.WriteByte(0x21)
+	if srcIP.To4() != nil {
+		buffer.WriteByte(0x10 | transport)
+		_ = binary.Write(buffer, binary.BigEndian, uint16(12))
+		buffer.Write(srcIP.To4())
+		buffer.Write(dstIP.To4())
+	} else {
+		buffer.WriteByte(0x20 | transport)
+		_ = binary.Write(buffer, binary.BigEndian, uint16(36))
+		buffer.Write(srcIP.To16())
+		buffer.Write(dstIP.To16())
+	}
+	_ = binary.Write(buffer, binary.BigEndian, srcPort)
+	_ = binary.Write(buffer, binary.BigEndian, dstPort)
+	return buffer.Bytes()
+}
+
+// 按映射配置生成 PROXY 协议头，未配置时返回 nil
+func proxyHeader(local config.NetAddress, info visitor) []byte {
+	switch local.ProxyProtocol {
+	case config.ProxyProtocolV1:
+		return proxyHeaderV1(info)
+	case config.ProxyProtocolV2:
+		return proxyHeaderV2(info, local.IsUDP())
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"chuantou/config"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 令牌桶限速
+// 令牌按速率补充，最多积累到突发量；令牌不足时预支，由调用方等待相应时间
+type rateLimiter struct {
+	total  uint64 // 经过的字节数，不限速时也统计，用于计算实时吞吐，放在首位保证 64 位对齐
+	mutex  sync.Mutex
+	limit  config.Bandwidth
+	tokens float64
+	last   time.Time
+}
+
+// 创建限速器
+func newRateLimiter(limit config.Bandwidth) *rateLimiter {
+	limiter := &rateLimiter{}
+	limiter.set(limit)
+	return limiter
+}
+
+// 调整限速，已建立的连接立即按新的限速传输
+func (l *rateLimiter) set(limit config.Bandwidth) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limit = limit.WithDefaults()
+	l.tokens = float64(l.limit.Burst)
+	l.last = time.Now()
+}
+
+// 当前限速
+func (l *rateLimiter) get() config.Bandwidth {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limit
+}
+
+// 取得 n 字节的令牌，返回需要等待的时间
+func (l *rateLimiter) reserve(n int) time.Duration {
+	if l != nil {
+		atomic.AddUint64(&l.total, uint64(n))
+	}
+	wait, _ := l.take(n, -1)
+	return wait
+}
+
+// 经过的字节数
+func (l *rateLimiter) transferred() uint64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.total)
+}
+
+// 取得 n 个令牌，需要等待的时间超过 maxWait 时不取并返回 false，maxWait 小于 0 表示不限
+func (l *rateLimiter) take(n int, maxWait time.Duration) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.limit.Unlimited() {
+		return 0, true
+	}
+	now := time.Now()
+	rate, burst := float64(l.limit.Rate), float64(l.limit.Burst)
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	var wait time.Duration
+	if remain := l.tokens - float64(n); remain < 0 {
+		wait = time.Duration(-remain / rate * float64(time.Second))
+	}
+	if maxWait >= 0 && wait > maxWait {
+		return wait, false
+	}
+	l.tokens -= float64(n)
+	return wait, true
+}
+
+// 归还 n 个令牌，用于取得部分限速器的令牌后放弃传输
+func (l *rateLimiter) refund(n int) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.limit.Unlimited() {
+		return
+	}
+	if l.tokens += float64(n); l.tokens > float64(l.limit.Burst) {
+		l.tokens = float64(l.limit.Burst)
+	}
+}
+
+// 单次最多读取的字节数，不超过突发量，0 表示不限制
+func (l *rateLimiter) maxRead() int {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.limit.Unlimited() {
+		return 0
+	}
+	return int(l.limit.Burst)
+}
+
+// 限速器链，依次为全局、客户端及映射限速，数据须同时满足所有限速
+type limiterChain []*rateLimiter
+
+// 等待直到所有限速器都允许传输 n 字节
+func (c limiterChain) wait(n int) {
+	var delay time.Duration
+	for _, limiter := range c {
+		if d := limiter.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// 不等待地取得所有限速器 n 字节的令牌，任一限速器令牌不足时归还已取的令牌并返回 false
+// 用于可以丢弃的 UDP 数据报
+func (c limiterChain) tryTake(n int) bool {
+	for i, limiter := range c {
+		if _, ok := limiter.take(n, 0); !ok {
+			for _, taken := range c[:i] {
+				taken.refund(n)
+			}
+			return false
+		}
+	}
+	for _, limiter := range c {
+		if limiter != nil {
+			atomic.AddUint64(&limiter.total, uint64(n))
+		}
+	}
+	return true
+}
+
+// 单次最多读取的字节数，取所有限速器突发量的最小值
+func (c limiterChain) maxRead() int {
+	max := 0
+	for _, limiter := range c {
+		if n := limiter.maxRead(); n > 0 && (max == 0 || n < max) {
+			max = n
+		}
+	}
+	return max
+}
+
+// 限速读取，读取后等待令牌
+type limitedReader struct {
+	reader   io.Reader
+	limiters limiterChain
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if max := r.limiters.maxRead(); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiters.wait(n)
+	}
+	return n, err
+}
+
+// 限速连接，读写都会等待令牌，用于不经过 connCopy 的连接
+type limitedConn struct {
+	net.Conn
+	limiters limiterChain
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	return (&limitedReader{reader: c.Conn, limiters: c.limiters}).Read(p)
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	c.limiters.wait(len(p))
+	return c.Conn.Write(p)
+}
+
+// 全局及客户端限速器
+var (
+	globalLimiter  = newRateLimiter(config.Bandwidth{})
+	clientLimiters = make(map[string]*clientLimiter)
+	// 客户端默认限速
+	clientBandwidth config.Bandwidth
+	clientMutex     sync.Mutex
+)
+
+// 客户端限速器，custom 表示单独设置过，不随默认限速调整
+type clientLimiter struct {
+	*rateLimiter
+	custom bool
+}
+
+// 取客户端限速器，不存在时按默认限速创建
+func getClientLimiter(id string) *rateLimiter {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	limiter, exists := clientLimiters[id]
+	if !exists {
+		limiter = &clientLimiter{rateLimiter: newRateLimiter(clientBandwidth)}
+		clientLimiters[id] = limiter
+	}
+	return limiter.rateLimiter
+}
+
+// 调整全局限速，运行中立即生效
+func SetBandwidth(limit config.Bandwidth) {
+	globalLimiter.set(limit)
+}
+
+// 调整客户端限速，运行中立即生效
+// id 为空时调整客户端默认限速，单独设置过的客户端不受影响
+func SetClientBandwidth(id string, limit config.Bandwidth) {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	if id == "" {
+		clientBandwidth = limit
+		for _, limiter := range clientLimiters {
+			if !limiter.custom {
+				limiter.set(limit)
+			}
+		}
+		return
+	}
+	limiter, exists := clientLimiters[id]
+	if !exists {
+		limiter = &clientLimiter{rateLimiter: newRateLimiter(limit)}
+		clientLimiters[id] = limiter
+	}
+	limiter.custom = true
+	limiter.set(limit)
+}
+
+// 调整映射限速，运行中立即生效，key 为访问端口、访问域名或 SNI，映射不存在时返回 false
+func SetMappingBandwidth(key string, limit config.Bandwidth) bool {
+	context := lookupTunnelContext(key)
+	if context == nil {
+		return false
+	}
+	context.limiter.set(limit)
+	return true
+}
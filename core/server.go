@@ -2,203 +2,512 @@ package core
 
 import (
 	"chuantou/config"
-	"log"
+	"crypto/tls"
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// 隧道连接
-type TunnelConn struct {
-	conn       net.Conn
-	createTime time.Time
-}
-
 // 隧道上下文
 type TunnelContext struct {
-	request    Protocol        // 请求信息
-	listener   net.Listener    // 服务端监听
-	tunnelChan chan TunnelConn // 连接池
-	createTime time.Time       // 创建时间
-	lastTime   time.Time       // 最后检查时间
+	request    Protocol               // 请求信息
+	mapping    string                 // 映射名，即端口、域名或 SNI，统计及日志用
+	credential credential             // 登录凭据，心跳时重新校验
+	acl        accessControl          // 访问控制规则
+	limiter    *rateLimiter           // 映射限速，运行中可调整
+	limiters   limiterChain           // 全局、客户端及映射限速
+	conns      *connLimiter           // 访问者连接限制及统计
+	traffic    *trafficMeter          // 流量统计
+	listener   net.Listener           // 服务端监听
+	packetConn net.PacketConn         // 服务端 UDP 监听
+	session    *muxSession            // 多路复用会话
+	remoteAddr net.Addr               // 客户端地址
+	localAddr  net.Addr               // 隧道端口地址，区分同一进程中的多个服务端
+	hello      hello                  // 协商结果
+	proxy      *httputil.ReverseProxy // 按域名访问时的反向代理
+	createTime time.Time              // 创建时间
+	lastTime   time.Time              // 最后检查时间
+	mutex      sync.Mutex             // 保护 lastTime
+	exhausted  int32                  // 最近一次检查时流量配额已用完，转发中的连接不加锁读取
 }
 
-// 存放连接
-func (p *TunnelContext) pushConn(conn net.Conn) {
-	p.tunnelChan <- TunnelConn{
-		conn:       conn,
-		createTime: time.Now(),
+// 心跳，检测会话活性
+// 会话保活由多路复用层完成，此处只检查会话是否仍然有效
+func (p *TunnelContext) hearBeat() bool {
+	p.mutex.Lock()
+	p.lastTime = time.Now()
+	p.mutex.Unlock()
+	return !p.session.isClosed()
+}
+
+// 记录映射的流量，计入登录用户，in 为访问者发出的字节数，out 为回复访问者的字节数
+func (p *TunnelContext) addTraffic(in, out int64) {
+	p.traffic.add(p.credential.user.Name, p.mapping, in+out)
+	countTransfer(p.mapping, in, out)
+}
+
+// 记录访问者连接
+func (p *TunnelContext) countVisitor(remote string, accepted bool) {
+	countVisitor(p.mapping, accepted)
+	event := Event{Time: time.Now(), Mapping: p.mapping, Remote: remote, ClientID: p.request.ID, Result: visitorAccepted}
+	if !accepted {
+		event.Result = visitorRejected
 	}
+	recentVisitors.add(event)
 }
 
-// 心跳，检测连接活性
-// 连接池中有连接，则返回成功
-func (p *TunnelContext) hearBeat() bool {
-	tunnelCount := len(p.tunnelChan)
+// 访问者会话的访问日志
+func (p *TunnelContext) accessEntry(remote net.Addr, start time.Time) accessEntry {
+	return accessEntry{
+		remote:   addrString(remote),
+		mapping:  p.mapping,
+		clientID: p.request.ID,
+		user:     p.credential.user.Name,
+		target:   p.request.Target,
+		start:    start,
+	}
+}
+
+// 是否由监听该隧道端口的服务端注册
+func (p *TunnelContext) registeredAt(port uint32) bool {
+	addr, ok := p.localAddr.(*net.TCPAddr)
+	return !ok || addr.Port == int(port)
+}
 
-	for i := 0; i < tunnelCount; i++ {
-		tunnelConn := <-p.tunnelChan
-		//log.Println("heartbeat...", tunnelConn.createTime.UnixNano())
+// 登录用户当月流量配额是否已用完，结果同时缓存供 exhaustedQuota 读取
+func (p *TunnelContext) quotaExceeded() bool {
+	exceeded := p.traffic.exceeded(p.credential.user)
+	var flag int32
+	if exceeded {
+		flag = 1
+	}
+	atomic.StoreInt32(&p.exhausted, flag)
+	return exceeded
+}
 
-		// 检测活性
-		if sendProtocol(tunnelConn.conn, p.request.NewResult(protocolResultHeartBeat)) {
-			// 将连接重新放回连接池
-			p.tunnelChan <- tunnelConn
-		} else {
-			// 关闭失去活性的连接
-			closeConn(tunnelConn.conn)
-		}
+// 最近一次检查的配额结果，不加锁，供转发中的连接每次读写时检查
+func (p *TunnelContext) exhaustedQuota() bool {
+	return atomic.LoadInt32(&p.exhausted) == 1
+}
+
+// 关闭隧道，释放监听及会话
+func (p *TunnelContext) close() {
+	p.closeListener()
+	p.session.close()
+	if p.proxy != nil {
+		p.proxy.Transport.(*http.Transport).CloseIdleConnections()
 	}
-	// 当连接池中没有可用连接时，心跳失败
-	p.lastTime = time.Now()
-	return len(p.tunnelChan) > 0
 }
 
-// key:   accessPort
-// value: TunnelContext
+// 关闭监听
+func (p *TunnelContext) closeListener() {
+	if p.listener != nil {
+		_ = p.listener.Close()
+	}
+	if p.packetConn != nil {
+		_ = p.packetConn.Close()
+	}
+}
+
+// key:   访问端口 uint32、domainKey 或 sniKey
+// value: *TunnelContext
 var (
 	tunnelContextMap   sync.Map
 	tunnelContextMutex sync.Mutex
 )
 
 // 处理隧道连接
-func handleTunnelConnection(tunnelConn net.Conn, cfg config.ServerConfig, tunnelContextChan chan TunnelContext) {
+func handleTunnelConnection(tunnelConn net.Conn, cfg config.ServerConfig, bans *banList, traffic *trafficMeter, tunnelContextChan chan *TunnelContext) {
+	start := time.Now()
+	// 握手，协商协议版本及特性
+	negotiated, ok := serverHandshake(tunnelConn)
+	if !ok {
+		countRegistration(negotiated.Result, start)
+		recordAuthFailure(tunnelConn, Protocol{}, negotiated.Result)
+		authLog.Warn("Illegal request", "result_code", negotiated.Result, "remote", tunnelConn.RemoteAddr().String())
+		closeConn(tunnelConn)
+		return
+	}
+
 	// 接收协议消息
 	req := receiveProtocol(tunnelConn)
+	req.Domain = normalizeHost(req.Domain)
+	req.SNI = normalizeHost(req.SNI)
 
 	// 检查请求合法性
-	if protocolResult := checkRequest(req, cfg); protocolResult != protocolResultSuccess {
-		log.Printf("Illegal request, code = %b, ip = %s\n", protocolResult, tunnelConn.RemoteAddr().String())
+	cred, protocolResult := checkRequest(req, negotiated, cfg)
+	// 鉴权失败计数，达到阈值后封禁来源 IP
+	if protocolResult == protocolResultFailToAuth {
+		bans.fail(remoteIP(tunnelConn))
+	} else if protocolResult == protocolResultSuccess {
+		bans.success(remoteIP(tunnelConn))
+	}
+	// 当月流量配额已用完
+	if protocolResult == protocolResultSuccess && traffic.exceeded(cred.user) {
+		authLog.Warn("Traffic quota exceeded", "user", cred.user.Name, "quota", cred.user.MonthlyQuota)
+		protocolResult = protocolResultQuotaExceeded
+	}
+	if protocolResult != protocolResultSuccess {
+		countRegistration(protocolResult, start)
+		recordAuthFailure(tunnelConn, req, protocolResult)
+		authLog.Warn("Illegal request", "result_code", protocolResult, "remote", tunnelConn.RemoteAddr().String(),
+			"port", req.tunnelKey(), "client_id", req.ID, "user", req.User)
 		sendProtocol(tunnelConn, req.NewResult(protocolResult))
 		closeConn(tunnelConn)
 		return
 	}
 
-	// 获取隧道连接
-	context, exists := tunnelContextMap.Load(req.Port)
-	if exists {
-		tunnelContext := context.(TunnelContext)
-		// 端口的开启者是当前访问者
-		if tunnelContext.request.IsSameID(&req) {
-			tunnelContext.pushConn(tunnelConn)
-		} else {
-			// 端口已经被其他客户端占用，返回相应提示
-			sendProtocol(tunnelConn, req.NewResult(protocolResultPortIsOccupied))
-			closeConn(tunnelConn)
-		}
-		return
+	// 请求已校验，访问控制规则合法
+	acl, _ := newAccessControl(req, cfg)
+	protocolResult = registerTunnelContext(req, negotiated, cred, acl, traffic, tunnelConn, tunnelContextChan)
+	countRegistration(protocolResult, start)
+	if protocolResult != protocolResultSuccess {
+		recordAuthFailure(tunnelConn, req, protocolResult)
+		sendProtocol(tunnelConn, req.NewResult(protocolResult))
+		closeConn(tunnelConn)
+	}
+}
+
+// 记录注册失败，握手失败时请求为空
+func recordAuthFailure(tunnelConn net.Conn, req Protocol, result byte) {
+	event := Event{
+		Time:     time.Now(),
+		Remote:   tunnelConn.RemoteAddr().String(),
+		ClientID: req.ID,
+		User:     req.User,
+		Code:     result,
+	}
+	if key := fmt.Sprint(req.tunnelKey()); key != "0" {
+		event.Mapping = key
 	}
+	recentAuthFailures.add(event)
+}
 
-	// 第一次创建才会执行，避免每次都加锁
-	registerTunnelContext(req, tunnelContextChan)
+// 注册隧道，同一客户端重连时替换原有隧道
+func registerTunnelContext(req Protocol, negotiated hello, cred credential, acl accessControl, traffic *trafficMeter, tunnelConn net.Conn, tunnelContextChan chan *TunnelContext) byte {
 	tunnelContextMutex.Lock()
 	defer tunnelContextMutex.Unlock()
-	context, exists = tunnelContextMap.Load(req.Port)
-	if !exists {
-		context = TunnelContext{
-			request:    req,
-			listener:   listen(req.Port, req.ID),
-			tunnelChan: make(chan TunnelConn, config.MaxTunnelCount),
-			createTime: time.Now(),
-			lastTime:   time.Now(),
+
+	user := cred.user
+	key := req.tunnelKey()
+	if value, exists := tunnelContextMap.Load(key); exists {
+		context := value.(*TunnelContext)
+		// 端口已经被其他客户端占用，返回相应提示，不同用户的机器码相同也视为不同客户端
+		if context.credential.user.Name != user.Name || !context.request.IsSameID(&req) {
+			return protocolResultPortIsOccupied
+		}
+		// 同一客户端重连，原会话已失效
+		tunnelLog.Info("Replace tunnel", "port", key, "client_id", req.ID)
+		context.close()
+		tunnelContextMap.Delete(key)
+	}
+	// 检查用户映射数
+	if user.MaxMappings > 0 && countUserMappings(user.Name) >= user.MaxMappings {
+		tunnelLog.Warn("Too many mappings", "user", user.Name, "max_mappings", user.MaxMappings)
+		return protocolResultTooManyMappings
+	}
+
+	mappingLimiter := newRateLimiter(config.Bandwidth{Rate: req.Rate, Burst: req.Burst})
+	context := &TunnelContext{
+		request:    req,
+		mapping:    fmt.Sprint(req.tunnelKey()),
+		credential: cred,
+		acl:        acl,
+		limiter:    mappingLimiter,
+		conns:      newConnLimiter(req.connLimit()),
+		traffic:    traffic,
+		limiters:   limiterChain{globalLimiter, getClientLimiter(req.ID), mappingLimiter},
+		hello:      negotiated,
+		remoteAddr: tunnelConn.RemoteAddr(),
+		localAddr:  tunnelConn.LocalAddr(),
+		createTime: time.Now(),
+		lastTime:   time.Now(),
+	}
+	switch {
+	case req.sharedPort():
+		// 按域名或 SNI 访问，共用服务端 HTTP/HTTPS 端口，不需要单独监听
+	case req.Network == config.NetworkUDP:
+		context.packetConn = listenPacket(req.Port, req.ID)
+		if context.packetConn == nil {
+			return protocolResultFail
+		}
+	default:
+		context.listener = listen(req.Port, req.ID)
+		if context.listener == nil {
+			return protocolResultFail
 		}
-		tunnelContextMap.Store(req.Port, context)
-		tunnelContextChan <- context.(TunnelContext)
+	}
+	// 通知客户端注册成功，之后连接交由多路复用会话接管
+	if !sendProtocol(tunnelConn, req.NewResult(protocolResultSuccess)) {
+		context.closeListener()
+		return protocolResultFail
+	}
 
-		log.Printf("Register port [%d] [%s] [%s]\n", req.Port, tunnelConn.RemoteAddr().String(), req.ID)
+	context.session = newMuxSession(tunnelConn, false)
+	if req.Domain != "" {
+		context.proxy = newDomainProxy(context)
 	}
-	tunnelContext := context.(TunnelContext)
-	tunnelContext.pushConn(tunnelConn)
+	tunnelContextMap.Store(key, context)
+	tunnelContextChan <- context
+
+	tunnelLog.Info("Register port", "port", key, "remote", tunnelConn.RemoteAddr().String(), "client_id", req.ID, "user", user.Name)
+	return protocolResultSuccess
 }
 
-func registerTunnelContext(req Protocol, tunnelContextChan chan TunnelContext) TunnelContext {
+// 注销隧道，仅当注册的仍是该隧道时才删除
+func unregisterTunnelContext(context *TunnelContext) {
 	tunnelContextMutex.Lock()
 	defer tunnelContextMutex.Unlock()
 
-	context, exists := tunnelContextMap.Load(req.Port)
-	if !exists {
-		context = TunnelContext{
-			request:    req,
-			listener:   listen(req.Port, req.ID),
-			tunnelChan: make(chan TunnelConn, config.MaxTunnelCount),
-			createTime: time.Now(),
-			lastTime:   time.Now(),
+	context.close()
+	key := context.request.tunnelKey()
+	if value, exists := tunnelContextMap.Load(key); exists && value == context {
+		tunnelContextMap.Delete(key)
+	}
+}
+
+// 按访问端口、访问域名或 SNI 查找隧道，key 为数字时只查找访问端口，域名与 SNI 相同时优先域名
+func lookupTunnelContext(key string) *TunnelContext {
+	if port, err := strconv.ParseUint(key, 10, 32); err == nil {
+		if value, exists := tunnelContextMap.Load(uint32(port)); exists {
+			return value.(*TunnelContext)
 		}
-		tunnelContextMap.Store(req.Port, context)
-		tunnelContextChan <- context.(TunnelContext)
+		return nil
+	}
+	host := normalizeHost(key)
+	if context := lookupDomain(host); context != nil {
+		return context
 	}
-	return context.(TunnelContext)
+	return lookupSNI(host)
+}
+
+// 统计用户已注册的映射数
+func countUserMappings(user string) int {
+	count := 0
+	tunnelContextMap.Range(func(_, value interface{}) bool {
+		if value.(*TunnelContext).credential.user.Name == user {
+			count++
+		}
+		return true
+	})
+	return count
 }
 
-// 检查请求信息，返回结果
-func checkRequest(req Protocol, cfg config.ServerConfig) byte {
+// 检查请求信息，返回登录凭据及结果
+func checkRequest(req Protocol, negotiated hello, cfg config.ServerConfig) (credential, byte) {
 	if !req.Success() {
-		return req.Result
+		return credential{}, req.Result
 	}
-	// 检查版本号
-	if req.Version != Version {
-		log.Println("Version mismatch", req.String())
-		return protocolResultVersionMismatch
+	// 检查网络类型
+	if req.Network != "" && req.Network != config.NetworkTCP && req.Network != config.NetworkUDP {
+		authLog.Warn("Unsupported network", "request", req.String())
+		return credential{}, protocolResultUnsupported
+	}
+	if req.Network == config.NetworkUDP && !negotiated.Has(featureUDP) {
+		authLog.Warn("UDP is not negotiated", "request", req.String())
+		return credential{}, protocolResultUnsupported
+	}
+	// 检查访问控制规则
+	if _, err := newAccessControl(req, cfg); err != nil {
+		authLog.Warn("Illegal acl", "request", req.String(), "error", err)
+		return credential{}, protocolResultUnsupported
 	}
 	// 检查权限
-	if _, ok := config.CheckKey(cfg.Key, req.Key); !ok {
-		log.Println("Unauthorized access", req.String())
-		return protocolResultFailToAuth
+	cred, ok := authenticate(req, negotiated.Nonce, cfg)
+	if !ok {
+		authLog.Warn("Unauthorized access", "request", req.String())
+		return cred, protocolResultFailToAuth
+	}
+	// 按域名访问，需要服务端开启 HTTP 端口
+	if req.Domain != "" {
+		if cfg.HTTPPort == 0 || req.Network == config.NetworkUDP {
+			authLog.Warn("Domain is not supported", "request", req.String())
+			return cred, protocolResultUnsupported
+		}
+		return cred, protocolResultSuccess
+	}
+	// 按 SNI 访问，需要服务端开启 HTTPS 端口
+	if req.SNI != "" {
+		if cfg.HTTPSPort == 0 || req.Network == config.NetworkUDP {
+			authLog.Warn("SNI is not supported", "request", req.String())
+			return cred, protocolResultUnsupported
+		}
+		return cred, protocolResultSuccess
 	}
 	// 检查访问端口是否在允许范围内
-	if ok := cfg.PortInRange(req.Port); !ok {
-		log.Println("Access Port out of range", req.String())
-		return protocolResultIllegalAccessPort
+	if ok := cfg.PortInRange(req.Port) && cred.user.PortAllowed(req.Port); !ok {
+		authLog.Warn("Access Port out of range", "request", req.String())
+		return cred, protocolResultIllegalAccessPort
 	}
-	return protocolResultSuccess
+	return cred, protocolResultSuccess
 }
 
 // 处理访问连接
-func handleServerConnection(context TunnelContext) {
-	serverListener := context.listener
-	if serverListener == nil {
-		tunnelContextMap.Delete(context.request.Port)
+func handleServerConnection(context *TunnelContext) {
+	// 会话断开时，立即关闭监听
+	go func() {
+		<-context.session.closeChan()
+		unregisterTunnelContext(context)
+	}()
+
+	if context.packetConn != nil {
+		handleServerPacket(context)
+		return
+	}
+	if context.listener == nil {
+		// 按域名或 SNI 访问，由 HTTP/HTTPS 端口统一受理
 		return
 	}
 	for {
-		serverConn := accept(serverListener)
+		serverConn := accept(context.listener)
 		if serverConn == nil {
 			// 受理监听失败，可能是监听关闭了，结束连接
 			break
 		}
-		// 取隧道连接
-		tunnelConn := <-context.tunnelChan
-		if sendProtocol(tunnelConn.conn, context.request) {
-			log.Printf("Accept connection [%d] [%s]\n", context.request.Port, serverConn.RemoteAddr().String())
-			go forward(tunnelConn.conn, serverConn)
-		} else {
-			log.Printf("No tunnel available, close server listener. [%d]\n", context.request.Port)
+		if !context.acl.allowed(serverConn.RemoteAddr()) {
+			visitorLog.Info("Deny connection", "port", context.request.Port, "remote", serverConn.RemoteAddr().String(), "client_id", context.request.ID)
+			context.countVisitor(serverConn.RemoteAddr().String(), false)
 			closeConn(serverConn)
-			_ = serverListener.Close()
-			tunnelContextMap.Delete(context.request.Port)
-			break
+			continue
 		}
+		go handleVisitor(context, serverConn)
 	}
 }
 
+// 处理访问者连接，超出连接限制时按配置排队或拒绝
+func handleVisitor(context *TunnelContext, serverConn net.Conn) {
+	start := time.Now()
+	if context.quotaExceeded() {
+		visitorLog.Warn("Reject connection, traffic quota exceeded", "port", context.request.Port, "remote", serverConn.RemoteAddr().String(), "client_id", context.request.ID)
+		context.countVisitor(serverConn.RemoteAddr().String(), false)
+		closeConn(serverConn)
+		return
+	}
+	if !context.conns.acquire(true) {
+		visitorLog.Warn("Reject connection, too many connections", "port", context.request.Port, "remote", serverConn.RemoteAddr().String(), "client_id", context.request.ID)
+		context.countVisitor(serverConn.RemoteAddr().String(), false)
+		closeConn(serverConn)
+		return
+	}
+	defer context.conns.release()
+
+	// 为每个访问者新建一个流
+	stream, err := context.openStream(serverConn.RemoteAddr(), serverConn.LocalAddr())
+	if err != nil {
+		tunnelLog.Warn("No tunnel available, close server listener", "port", context.request.Port, "client_id", context.request.ID)
+		closeConn(serverConn)
+		unregisterTunnelContext(context)
+		return
+	}
+	visitorLog.Info("Accept connection", "port", context.request.Port, "remote", serverConn.RemoteAddr().String(), "client_id", context.request.ID)
+	context.countVisitor(serverConn.RemoteAddr().String(), true)
+	visitor := newMeteredConn(serverConn, context)
+	result := forward(stream, visitor, context.limiters)
+	context.accessEntry(serverConn.RemoteAddr(), start).log(result.written1, result.written2, visitor.reason(result, "tunnel", "visitor"))
+}
+
+// 检查本服务端注册的隧道，关闭会话已断开或登录凭据已失效的隧道，返回关闭的隧道数
+func checkTunnels(cfg config.ServerConfig) int {
+	checked, closed := 0, 0
+	tunnelContextMap.Range(func(key, value interface{}) bool {
+		tunnelContext := value.(*TunnelContext)
+		// 只校验本服务端注册的隧道
+		if !tunnelContext.registeredAt(cfg.Port) {
+			return true
+		}
+		checked++
+		if !tunnelContext.hearBeat() {
+			heartbeatLog.Info("Heartbeat failed, close tunnel", "port", key, "client_id", tunnelContext.request.ID)
+			metricHeartbeatFailures.inc()
+			unregisterTunnelContext(tunnelContext)
+			closed++
+			return true
+		}
+		if err := tunnelContext.credential.validate(cfg); err != nil {
+			heartbeatLog.Info("Close tunnel", "port", key, "user", tunnelContext.credential.user.Name, "error", err)
+			unregisterTunnelContext(tunnelContext)
+			closed++
+			return true
+		}
+		// 定时刷新配额结果，其他映射用完同一用户的配额后，转发中的连接也能及时断开
+		tunnelContext.quotaExceeded()
+		return true
+	})
+	heartbeatLog.Debug("Check tunnels", "server_port", cfg.Port, "checked", checked, "closed", closed)
+	return closed
+}
+
 // 入口
 func Server(cfg config.ServerConfig) {
-	log.Println("Load config", cfg)
+	serverLog.Info("Load config", "config", fmt.Sprint(cfg))
 
 	// 监听隧道端口
 	tunnelListener := listen(cfg.Port, "server")
 	if tunnelListener == nil {
-		log.Fatalln("Fail to listen the tunnel port.")
+		serverLog.Fatal("Fail to listen the tunnel port", "port", cfg.Port)
+	}
+	tlsConfig, err := serverTLSConfig(cfg)
+	if err != nil {
+		serverLog.Fatal("Fail to load TLS config", "error", err)
+	}
+	if tlsConfig != nil {
+		// 隧道端口使用 TLS，握手在首次读取协议时完成
+		tunnelListener = tls.NewListener(tunnelListener, tlsConfig)
+		serverLog.Info("TLS enabled on tunnel port", "port", cfg.Port)
 	}
 
-	tunnelContextChan := make(chan TunnelContext)
+	// 监听 HTTP 端口，按 Host 转发
+	if cfg.HTTPPort > 0 {
+		httpListener := listen(cfg.HTTPPort, "http")
+		if httpListener == nil {
+			serverLog.Fatal("Fail to listen the http port", "port", cfg.HTTPPort)
+		}
+		go serveHTTP(httpListener)
+	}
+	// 监听 HTTPS 端口，按 SNI 转发
+	if cfg.HTTPSPort > 0 {
+		httpsListener := listen(cfg.HTTPSPort, "https")
+		if httpsListener == nil {
+			serverLog.Fatal("Fail to listen the https port", "port", cfg.HTTPSPort)
+		}
+		go func() {
+			for {
+				if conn := accept(httpsListener); conn != nil {
+					go handleSNIConnection(conn)
+				}
+			}
+		}()
+	}
+
+	tunnelContextChan := make(chan *TunnelContext)
+	bans := newBanList(cfg.Ban)
+	traffic := newTrafficMeter(cfg.TrafficFile)
+	SetBandwidth(cfg.Bandwidth)
+	SetClientBandwidth("", cfg.ClientBandwidth)
+	// 管理接口及指标接口
+	if cfg.AdminListenAddr() != "" {
+		go serveAdmin(cfg)
+	}
+	go serveMetrics(cfg.MetricsListenAddr())
+	go serveControl(cfg, bans, traffic)
 	// 处理来自客户端的隧道请求
 	go func() {
 		for {
 			tunnelConn := accept(tunnelListener)
-			if tunnelConn != nil {
-				go handleTunnelConnection(tunnelConn, cfg, tunnelContextChan)
+			if tunnelConn == nil {
+				continue
+			}
+			// 已封禁的 IP 直接断开，不读取任何数据
+			if bans.banned(remoteIP(tunnelConn)) {
+				closeConn(tunnelConn)
+				continue
 			}
+			go handleTunnelConnection(tunnelConn, cfg, bans, traffic, tunnelContextChan)
 		}
 	}()
 
@@ -213,16 +522,18 @@ func Server(cfg config.ServerConfig) {
 	}()
 
 	// 心跳，需要考虑端口过多，心跳时间不够的情况
+	// 同时重新校验登录凭据，关闭已吊销或已到期的隧道
 	go setInterval(func() {
-		tunnelContextMap.Range(func(key, value interface{}) bool {
-			tunnelContext := value.(TunnelContext)
-			if !tunnelContext.hearBeat() {
-				_ = tunnelContext.listener.Close()
-				tunnelContextMap.Delete(key)
-			}
-			return true
-		})
-	}, heartBeatIntervalTime)
+		bans.prune()
+		traffic.save()
+		if err := cfg.Revocations.ReloadIfModified(); err != nil {
+			serverLog.Warn("Fail to reload revocation list", "error", err)
+		}
+		if err := cfg.GeoIP.ReloadIfModified(); err != nil {
+			serverLog.Warn("Fail to reload geoip files", "error", err)
+		}
+		checkTunnels(cfg)
+	}, cfg.HeartBeatInterval())
 
 	select {}
 }
@@ -0,0 +1,221 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// 读取 ClientHello 超时时间
+	sniReadTimeout = 10 * time.Second
+	// ClientHello 最大长度
+	sniMaxHelloSize = 64 * 1024
+
+	// TLS 记录类型：握手
+	tlsRecordHandshake = 0x16
+	// 握手类型：ClientHello
+	tlsHandshakeClientHello = 0x01
+	// 扩展类型：server_name
+	tlsExtensionServerName = 0x00
+)
+
+// SNI 隧道标识，与访问端口及域名区分
+type sniKey string
+
+// 重放连接，先读出已窥探的数据，再读原连接
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func newReplayConn(conn net.Conn, peeked []byte) net.Conn {
+	return &replayConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(peeked), conn),
+	}
+}
+
+func (p *replayConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+// 查找 SNI 对应的隧道
+func lookupSNI(serverName string) *TunnelContext {
+	if value, exists := tunnelContextMap.Load(sniKey(serverName)); exists {
+		return value.(*TunnelContext)
+	}
+	return nil
+}
+
+// 读取 ClientHello，返回 SNI 及读取过的原始数据
+// ClientHello 可能分散在多个 TLS 记录中，读取到完整的握手消息为止
+func readClientHello(reader io.Reader) (string, []byte, error) {
+	var peeked, handshake bytes.Buffer
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return "", peeked.Bytes(), err
+		}
+		peeked.Write(header)
+		if header[0] != tlsRecordHandshake {
+			return "", peeked.Bytes(), errors.New("not a tls handshake")
+		}
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if peeked.Len()+length > sniMaxHelloSize {
+			return "", peeked.Bytes(), errors.New("client hello too large")
+		}
+		fragment := make([]byte, length)
+		if _, err := io.ReadFull(reader, fragment); err != nil {
+			return "", peeked.Bytes(), err
+		}
+		peeked.Write(fragment)
+		handshake.Write(fragment)
+
+		// 握手消息头：类型|长度
+		// 1|3
+		data := handshake.Bytes()
+		if len(data) < 4 {
+			continue
+		}
+		if data[0] != tlsHandshakeClientHello {
+			return "", peeked.Bytes(), errors.New("not a client hello")
+		}
+		helloLength := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		if len(data) < 4+helloLength {
+			continue
+		}
+		serverName, err := parseServerName(data[4 : 4+helloLength])
+		return serverName, peeked.Bytes(), err
+	}
+}
+
+// 从 ClientHello 中解析 server_name 扩展
+// 版本|随机数|会话ID|密码套件|压缩方法|扩展
+// 2|32|1+n|2+n|1+n|2+n
+func parseServerName(hello []byte) (string, error) {
+	errMalformed := errors.New("malformed client hello")
+
+	if len(hello) < 34 {
+		return "", errMalformed
+	}
+	data := hello[34:]
+	// 会话ID
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", errMalformed
+	}
+	data = data[1+int(data[0]):]
+	// 密码套件
+	if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+		return "", errMalformed
+	}
+	data = data[2+int(binary.BigEndian.Uint16(data)):]
+	// 压缩方法
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", errMalformed
+	}
+	data = data[1+int(data[0]):]
+	// 没有扩展
+	if len(data) < 2 {
+		return "", errors.New("no server name")
+	}
+	extensionsLength := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < extensionsLength {
+		return "", errMalformed
+	}
+	data = data[:extensionsLength]
+
+	// 扩展：类型|长度|数据
+	for len(data) >= 4 {
+		extensionType := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+		if len(data) < length {
+			return "", errMalformed
+		}
+		if extensionType == tlsExtensionServerName {
+			return parseServerNameExtension(data[:length])
+		}
+		data = data[length:]
+	}
+	return "", errors.New("no server name")
+}
+
+// server_name 扩展：列表长度|类型|名称长度|名称
+// 2|1|2|n
+func parseServerNameExtension(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", errors.New("malformed server name")
+	}
+	data = data[2:]
+	for len(data) >= 3 {
+		nameType := data[0]
+		length := int(binary.BigEndian.Uint16(data[1:]))
+		data = data[3:]
+		if len(data) < length {
+			return "", errors.New("malformed server name")
+		}
+		// 只支持主机名类型
+		if nameType == 0 {
+			return string(data[:length]), nil
+		}
+		data = data[length:]
+	}
+	return "", errors.New("no server name")
+}
+
+// 处理 HTTPS 端口的访问，按 SNI 将原始 TLS 连接转发到对应的隧道
+// 服务端不解密 TLS，端到端加密不受影响
+func handleSNIConnection(conn net.Conn) {
+	start := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(sniReadTimeout))
+	serverName, peeked, err := readClientHello(conn)
+	if err != nil {
+		visitorLog.Info("Fail to read client hello", "remote", conn.RemoteAddr().String(), "error", err)
+		closeConn(conn)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	serverName = normalizeHost(serverName)
+	tunnelContext := lookupSNI(serverName)
+	if tunnelContext == nil {
+		visitorLog.Info("Unknown server name", "sni", serverName, "remote", conn.RemoteAddr().String())
+		closeConn(conn)
+		return
+	}
+
+	if !tunnelContext.acl.allowed(conn.RemoteAddr()) {
+		visitorLog.Info("Deny connection", "sni", serverName, "remote", conn.RemoteAddr().String(), "client_id", tunnelContext.request.ID)
+		tunnelContext.countVisitor(conn.RemoteAddr().String(), false)
+		closeConn(conn)
+		return
+	}
+	if tunnelContext.quotaExceeded() {
+		visitorLog.Warn("Reject connection, traffic quota exceeded", "sni", serverName, "remote", conn.RemoteAddr().String(), "client_id", tunnelContext.request.ID)
+		tunnelContext.countVisitor(conn.RemoteAddr().String(), false)
+		closeConn(conn)
+		return
+	}
+	if !tunnelContext.conns.acquire(true) {
+		visitorLog.Warn("Reject connection, too many connections", "sni", serverName, "remote", conn.RemoteAddr().String(), "client_id", tunnelContext.request.ID)
+		tunnelContext.countVisitor(conn.RemoteAddr().String(), false)
+		closeConn(conn)
+		return
+	}
+	defer tunnelContext.conns.release()
+	stream, err := tunnelContext.openStream(conn.RemoteAddr(), conn.LocalAddr())
+	if err != nil {
+		closeConn(conn)
+		return
+	}
+	visitorLog.Info("Accept connection", "sni", serverName, "remote", conn.RemoteAddr().String(), "client_id", tunnelContext.request.ID)
+	tunnelContext.countVisitor(conn.RemoteAddr().String(), true)
+	visitor := newMeteredConn(newReplayConn(conn, peeked), tunnelContext)
+	result := forward(stream, visitor, tunnelContext.limiters)
+	tunnelContext.accessEntry(conn.RemoteAddr(), start).log(result.written1, result.written2, visitor.reason(result, "tunnel", "visitor"))
+}
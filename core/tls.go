@@ -0,0 +1,86 @@
+package core
+
+import (
+	"chuantou/config"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// 服务端 TLS 配置，未启用时返回 nil
+func serverTLSConfig(cfg config.ServerConfig) (*tls.Config, error) {
+	if !cfg.TLSEnabled() {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// 客户端 TLS 配置，未启用时返回 nil
+// 配置了指纹时只校验证书指纹，否则使用 CA 或系统根证书校验
+func clientTLSConfig(cfg config.ClientConfig) (*tls.Config, error) {
+	if !cfg.TLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName: cfg.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = cfg.ServerAddr.IP
+	}
+
+	if cfg.TLSFingerprint != "" {
+		fingerprint := config.NormalizeFingerprint(cfg.TLSFingerprint)
+		// 证书固定模式，跳过证书链校验，改为比对指纹
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) > 0 && config.RawFingerprint(rawCerts[0]) == fingerprint {
+				return nil
+			}
+			return errors.New("certificate fingerprint mismatch")
+		}
+		return tlsConfig, nil
+	}
+
+	if cfg.TLSCA != "" {
+		caPEM, err := ioutil.ReadFile(cfg.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("fail to parse CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// 建立 TLS 客户端连接，握手失败时关闭连接
+func tlsClient(conn net.Conn, tlsConfig *tls.Config) net.Conn {
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.SetDeadline(time.Now().Add(protocolSendTimeout)); err != nil {
+		closeConn(conn)
+		return nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		clientLog.Warn("TLS handshake failed", "remote", addrString(conn.RemoteAddr()), "error", err)
+		closeConn(conn)
+		return nil
+	}
+	if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+		closeConn(conn)
+		return nil
+	}
+	return tlsConn
+}
@@ -0,0 +1,222 @@
+package core
+
+import (
+	"chuantou/config"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 流量统计月份格式
+const trafficMonthLayout = "2006-01"
+
+// 流量统计持久化格式，只保存当月的统计
+type trafficStats struct {
+	Month    string            `json:"month"`    // 统计月份，如 2006-01
+	Users    map[string]uint64 `json:"users"`    // 用户名 -> 字节数，使用共享 Key 的客户端用户名为空
+	Mappings map[string]uint64 `json:"mappings"` // 访问端口、访问域名或 SNI -> 字节数
+}
+
+// 按月统计用户及映射的流量，双向合计，跨月后清零
+type trafficMeter struct {
+	file  string
+	mutex sync.Mutex
+	stats trafficStats
+	dirty bool // 有未保存的统计
+}
+
+// 创建流量统计，配置了文件时加载当月的统计
+func newTrafficMeter(file string) *trafficMeter {
+	meter := &trafficMeter{file: file}
+	meter.reset(time.Now())
+	if file == "" {
+		return meter
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			trafficLog.Warn("Fail to load traffic stats", "file", file, "error", err)
+		}
+		return meter
+	}
+	var stats trafficStats
+	if err = json.Unmarshal(data, &stats); err != nil {
+		trafficLog.Warn("Fail to parse traffic stats", "file", file, "error", err)
+		return meter
+	}
+	if stats.Month == meter.stats.Month {
+		if stats.Users != nil {
+			meter.stats.Users = stats.Users
+		}
+		if stats.Mappings != nil {
+			meter.stats.Mappings = stats.Mappings
+		}
+		trafficLog.Info("Load traffic stats", "month", stats.Month, "file", file)
+	}
+	return meter
+}
+
+// 清零并开始统计新的月份，调用方持有锁
+func (m *trafficMeter) reset(now time.Time) {
+	m.stats = trafficStats{
+		Month:    now.Format(trafficMonthLayout),
+		Users:    make(map[string]uint64),
+		Mappings: make(map[string]uint64),
+	}
+	m.dirty = true
+}
+
+// 跨月时清零，调用方持有锁
+func (m *trafficMeter) rotate() {
+	if now := time.Now(); now.Format(trafficMonthLayout) != m.stats.Month {
+		trafficLog.Info("Reset traffic stats", "month", m.stats.Month)
+		m.reset(now)
+	}
+}
+
+// 记录流量
+func (m *trafficMeter) add(user, mapping string, bytes int64) {
+	if bytes <= 0 {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rotate()
+	m.stats.Users[user] += uint64(bytes)
+	m.stats.Mappings[mapping] += uint64(bytes)
+	m.dirty = true
+}
+
+// 用户当月已使用的流量
+func (m *trafficMeter) usage(user string) uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rotate()
+	return m.stats.Users[user]
+}
+
+// 用户当月流量配额是否已用完
+func (m *trafficMeter) exceeded(user config.User) bool {
+	return user.MonthlyQuota > 0 && m.usage(user.Name) >= user.MonthlyQuota
+}
+
+// 当月统计的副本
+func (m *trafficMeter) snapshot() trafficStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rotate()
+	stats := trafficStats{
+		Month:    m.stats.Month,
+		Users:    make(map[string]uint64, len(m.stats.Users)),
+		Mappings: make(map[string]uint64, len(m.stats.Mappings)),
+	}
+	for name, bytes := range m.stats.Users {
+		stats.Users[name] = bytes
+	}
+	for mapping, bytes := range m.stats.Mappings {
+		stats.Mappings[mapping] = bytes
+	}
+	return stats
+}
+
+// 保存统计，没有变化时不保存
+func (m *trafficMeter) save() {
+	if m.file == "" {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rotate()
+	if !m.dirty {
+		return
+	}
+	data, err := json.MarshalIndent(m.stats, "", "  ")
+	if err != nil {
+		trafficLog.Warn("Fail to encode traffic stats", "error", err)
+		return
+	}
+	if err = ioutil.WriteFile(m.file, data, 0644); err != nil {
+		trafficLog.Warn("Fail to save traffic stats", "file", m.file, "error", err)
+		return
+	}
+	m.dirty = false
+}
+
+// 流量先在连接上累计，满 meteredFlushBytes 或关闭连接时才计入统计
+const meteredFlushBytes = 64 * 1024
+
+// 访问者连接，收发数据时计入映射流量，流量配额用完时断开连接
+// 读出的是访问者发出的数据，写入的是回复访问者的数据，reply 为 true 时相反
+// 每次读写只做原子累加并读取缓存的配额结果，避免争用全局锁
+type meteredConn struct {
+	net.Conn
+	context *TunnelContext
+	reply   bool  // 包装的是隧道内的流，读出的是回复访问者的数据
+	in      int64 // 尚未计入的访问者发出的字节数
+	out     int64 // 尚未计入的回复访问者的字节数
+	cutOff  int32 // 因流量配额用完而断开
+}
+
+func newMeteredConn(conn net.Conn, context *TunnelContext) *meteredConn {
+	return &meteredConn{Conn: conn, context: context}
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.count(int64(n), 0)
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.count(0, int64(n))
+	}
+	return n, err
+}
+
+// 关闭前计入剩余的流量
+func (c *meteredConn) Close() error {
+	c.flush()
+	return c.Conn.Close()
+}
+
+// 累计流量，满 meteredFlushBytes 时计入统计并重新检查配额，配额用完后关闭连接，转发随之结束
+func (c *meteredConn) count(read, written int64) {
+	if c.reply {
+		read, written = written, read
+	}
+	pending := atomic.AddInt64(&c.in, read) + atomic.AddInt64(&c.out, written)
+	exhausted := c.context.exhaustedQuota()
+	if pending >= meteredFlushBytes {
+		exhausted = c.flush()
+	}
+	if exhausted && atomic.CompareAndSwapInt32(&c.cutOff, 0, 1) {
+		visitorLog.Warn("Close connection, traffic quota exceeded", "port", c.context.mapping, "remote", addrString(c.RemoteAddr()), "client_id", c.context.request.ID)
+		_ = c.Conn.Close()
+	}
+}
+
+// 计入累计的流量，返回配额是否已用完
+func (c *meteredConn) flush() bool {
+	in, out := atomic.SwapInt64(&c.in, 0), atomic.SwapInt64(&c.out, 0)
+	if in+out == 0 {
+		return c.context.exhaustedQuota()
+	}
+	c.context.addTraffic(in, out)
+	return c.context.quotaExceeded()
+}
+
+// 关闭原因，因流量配额断开时覆盖转发结果
+func (c *meteredConn) reason(result forwardResult, name1, name2 string) string {
+	if atomic.LoadInt32(&c.cutOff) == 1 {
+		return "traffic quota exceeded"
+	}
+	return result.reason(name1, name2)
+}
@@ -0,0 +1,242 @@
+package core
+
+import (
+	"chuantou/config"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// UDP 会话空闲超时时间，超过此时间双向都没有数据则关闭会话
+	udpIdleTimeout = 60 * time.Second
+	// 单个数据报最大长度
+	udpMaxDatagramSize = 64 * 1024
+	// 每个访问者等待写入流的数据报数，超出时丢弃
+	udpQueueSize = 64
+)
+
+// UDP 数据报在流中的格式
+// 长度|数据
+// 2|n
+
+// 写数据报，长度前缀与数据一次写入，避免与其他写入交错
+func writeDatagram(w io.Writer, data []byte) error {
+	if len(data) > udpMaxDatagramSize-1 {
+		return errors.New("datagram too large")
+	}
+	buffer := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buffer, uint16(len(data)))
+	copy(buffer[2:], data)
+	_, err := w.Write(buffer)
+	return err
+}
+
+// 读数据报，buf 长度不能小于 udpMaxDatagramSize
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return 0, err
+	}
+	length := int(binary.BigEndian.Uint16(buf[:2]))
+	if _, err := io.ReadFull(r, buf[:length]); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// 监听 UDP 端口
+func listenPacket(port uint32, id string) net.PacketConn {
+	address := fmt.Sprintf("0.0.0.0:%d", port)
+	packetConn, err := net.ListenPacket(config.NetworkUDP, address)
+	if err != nil {
+		tunnelLog.Warn("Listen failed, the port may be used or closed", "port", port, "network", config.NetworkUDP, "client_id", id, "error", err)
+		return nil
+	}
+	tunnelLog.Info("Listening", "addr", "udp://"+address, "client_id", id)
+	return packetConn
+}
+
+// 访问者的 UDP 会话，发往内网服务的数据报经有界队列写入流，队列满时丢弃
+// 单个访问者的流窗口已满时不会阻塞其他访问者
+type udpSession struct {
+	stream net.Conn
+	mutex  sync.Mutex
+	queue  chan []byte
+	closed bool
+}
+
+func newUDPSession(stream net.Conn) *udpSession {
+	session := &udpSession{stream: stream, queue: make(chan []byte, udpQueueSize)}
+	go session.writeLoop()
+	return session
+}
+
+// 数据报放入队列，队列已满或会话已关闭时返回 false
+func (s *udpSession) send(data []byte) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.queue <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// 依次写入流，写入失败时关闭流，由回复方向结束会话
+func (s *udpSession) writeLoop() {
+	for data := range s.queue {
+		if err := writeDatagram(s.stream, data); err != nil {
+			closeConn(s.stream)
+		}
+	}
+}
+
+// 关闭会话
+func (s *udpSession) close() {
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mutex.Unlock()
+	closeConn(s.stream)
+}
+
+// 处理 UDP 访问
+// 每个访问者地址对应一个流，空闲超时后关闭
+// 所有访问者共用一个读循环，限速令牌不足或队列已满时丢弃数据报，不会阻塞
+func handleServerPacket(context *TunnelContext) {
+	packetConn := context.packetConn
+	sessions := make(map[string]*udpSession)
+	var mutex sync.Mutex
+
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		n, visitorAddr, err := packetConn.ReadFrom(buf)
+		if err != nil {
+			// 监听关闭，结束会话
+			break
+		}
+
+		key := visitorAddr.String()
+		mutex.Lock()
+		session, exists := sessions[key]
+		mutex.Unlock()
+		if !exists {
+			if !context.acl.allowed(visitorAddr) {
+				context.countVisitor(key, false)
+				continue
+			}
+			// 数据报无法排队，超出连接限制或流量配额时直接丢弃
+			if context.quotaExceeded() || !context.conns.acquire(false) {
+				context.countVisitor(key, false)
+				continue
+			}
+			stream, err := context.openStream(visitorAddr, packetConn.LocalAddr())
+			if err != nil {
+				context.conns.release()
+				tunnelLog.Warn("No tunnel available, close server listener", "port", context.request.Port, "network", config.NetworkUDP, "client_id", context.request.ID)
+				unregisterTunnelContext(context)
+				break
+			}
+			visitorLog.Info("Accept connection", "port", context.request.Port, "network", config.NetworkUDP, "remote", key, "client_id", context.request.ID)
+			context.countVisitor(key, true)
+			session = newUDPSession(stream)
+			mutex.Lock()
+			sessions[key] = session
+			mutex.Unlock()
+
+			// 将内网服务的回复发回访问者
+			go func(session *udpSession, visitorAddr net.Addr) {
+				reply := make([]byte, udpMaxDatagramSize)
+				for {
+					n, err := readDatagram(session.stream, reply)
+					if err != nil {
+						break
+					}
+					_ = session.stream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+					if !context.limiters.tryTake(n) {
+						continue
+					}
+					context.addTraffic(0, int64(n))
+					if _, err = packetConn.WriteTo(reply[:n], visitorAddr); err != nil {
+						break
+					}
+				}
+				mutex.Lock()
+				delete(sessions, visitorAddr.String())
+				mutex.Unlock()
+				session.close()
+				context.conns.release()
+			}(session, visitorAddr)
+		}
+
+		// 收发任一方向的数据都会延长空闲超时
+		_ = session.stream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		if !context.limiters.tryTake(n) {
+			continue
+		}
+		if session.send(append([]byte(nil), buf[:n]...)) {
+			context.addTraffic(int64(n), 0)
+		}
+	}
+
+	mutex.Lock()
+	for _, session := range sessions {
+		session.close()
+	}
+	mutex.Unlock()
+}
+
+// 本地 UDP 服务连接，并在流与本地服务之间转发数据报
+// 配置了 PROXY 协议时，每个发往本地服务的数据报前都附加协议头
+func buildLocalPacketConnection(local config.NetAddress, stream net.Conn, info visitor) {
+	mapping := local.Mapping()
+	localConn, err := net.Dial(config.NetworkUDP, local.String())
+	if err != nil {
+		dialLog.Error("Dial failed", "target", "udp://"+local.String(), "error", err)
+		countVisitor(mapping, false)
+		closeConn(stream)
+		return
+	}
+	countVisitor(mapping, true)
+
+	// 本地服务的回复写回流中，流关闭时本地连接随之关闭
+	go func() {
+		reply := make([]byte, udpMaxDatagramSize)
+		for {
+			n, err := localConn.Read(reply)
+			if err != nil {
+				break
+			}
+			if err = writeDatagram(stream, reply[:n]); err != nil {
+				break
+			}
+			countTransfer(mapping, 0, int64(n))
+		}
+		closeConn(stream)
+	}()
+
+	header := proxyHeader(local, info)
+	buf := make([]byte, len(header)+udpMaxDatagramSize)
+	copy(buf, header)
+	for {
+		n, err := readDatagram(stream, buf[len(header):])
+		if err != nil {
+			break
+		}
+		if _, err = localConn.Write(buf[:len(header)+n]); err != nil {
+			break
+		}
+		countTransfer(mapping, int64(n), 0)
+	}
+	closeConn(localConn, stream)
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"chuantou/config"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+const (
+	// 读取请求头超时时间
+	vhostReadTimeout = 10 * time.Second
+	// 隧道内空闲连接保持时间
+	vhostIdleTimeout = 90 * time.Second
+)
+
+// 域名隧道标识，与访问端口区分
+type domainKey string
+
+// 规范化 Host，去除端口并转小写
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// 查找域名对应的隧道
+func lookupDomain(host string) *TunnelContext {
+	if value, exists := tunnelContextMap.Load(domainKey(host)); exists {
+		return value.(*TunnelContext)
+	}
+	return nil
+}
+
+// 域名隧道的反向代理，每个请求都通过隧道新建或复用一个流
+func newDomainProxy(tunnelContext *TunnelContext) *httputil.ReverseProxy {
+	transport := &http.Transport{
+		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			// 隧道内的连接会被多个请求复用，访问者地址通过 X-Forwarded-For 传递
+			stream, err := tunnelContext.openStream(nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			// 写入流的是访问者的请求，读出的是回复，流量配额用完时断开
+			conn := newMeteredConn(&limitedConn{Conn: stream, limiters: tunnelContext.limiters}, tunnelContext)
+			conn.reply = true
+			return conn, nil
+		},
+		IdleConnTimeout: vhostIdleTimeout,
+	}
+	return &httputil.ReverseProxy{
+		// 保留原 Host，内网服务可以据此区分站点
+		Director: func(request *http.Request) {
+			request.URL.Scheme = "http"
+			request.URL.Host = request.Host
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, request *http.Request, err error) {
+			visitorLog.Warn("Fail to proxy", "domain", request.Host, "remote", request.RemoteAddr, "client_id", tunnelContext.request.ID, "error", err)
+			if recorder, ok := w.(*accessRecorder); ok {
+				recorder.err = err
+			}
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+}
+
+// 处理 HTTP 端口的访问，按 Host 将每个请求转发到对应域名的隧道
+func handleHTTPRequest(w http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+	host := normalizeHost(request.Host)
+	tunnelContext := lookupDomain(host)
+	if tunnelContext == nil {
+		visitorLog.Info("Unknown host", "domain", host, "remote", request.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if !tunnelContext.acl.allowed(&net.TCPAddr{IP: config.HostIP(request.RemoteAddr)}) {
+		visitorLog.Info("Deny connection", "domain", host, "remote", request.RemoteAddr, "client_id", tunnelContext.request.ID)
+		tunnelContext.countVisitor(request.RemoteAddr, false)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if tunnelContext.quotaExceeded() {
+		visitorLog.Warn("Reject connection, traffic quota exceeded", "domain", host, "remote", request.RemoteAddr, "client_id", tunnelContext.request.ID)
+		tunnelContext.countVisitor(request.RemoteAddr, false)
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	// 每个请求占用一个连接槽位，超出限制时按配置排队或返回 503
+	if !tunnelContext.conns.acquire(true) {
+		visitorLog.Warn("Reject connection, too many connections", "domain", host, "remote", request.RemoteAddr, "client_id", tunnelContext.request.ID)
+		tunnelContext.countVisitor(request.RemoteAddr, false)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer tunnelContext.conns.release()
+	visitorLog.Info("Accept connection", "domain", host, "remote", request.RemoteAddr, "client_id", tunnelContext.request.ID)
+	tunnelContext.countVisitor(request.RemoteAddr, true)
+	recorder := newAccessRecorder(w, request)
+	tunnelContext.proxy.ServeHTTP(recorder, request)
+	entry := tunnelContext.accessEntry(nil, start)
+	entry.remote = request.RemoteAddr
+	recorder.log(entry)
+}
+
+// 监听 HTTP 端口
+func serveHTTP(listener net.Listener) {
+	server := &http.Server{
+		Handler:           http.HandlerFunc(handleHTTPRequest),
+		ReadHeaderTimeout: vhostReadTimeout,
+	}
+	if err := server.Serve(listener); err != nil {
+		serverLog.Info("HTTP port closed", "error", err)
+	}
+}
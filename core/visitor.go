@@ -0,0 +1,68 @@
+package core
+
+import (
+	"bytes"
+	"net"
+)
+
+// 访问者信息，服务端新建流时首先发送，客户端据此生成 PROXY 协议头
+type visitor struct {
+	Source      string // 访问者地址
+	Destination string // 访问端口地址
+}
+
+// 序列化
+func (v *visitor) Bytes() []byte {
+	buffer := bytes.NewBuffer([]byte{})
+
+	writeField(buffer, protocolFieldSource, []byte(v.Source))
+	writeField(buffer, protocolFieldDestination, []byte(v.Destination))
+	return buffer.Bytes()
+}
+
+// 解析访问者信息
+func parseVisitor(body []byte) (visitor, bool) {
+	fields, err := parseFields(body)
+	if err != nil {
+		return visitor{}, false
+	}
+	return visitor{
+		Source:      string(fields[protocolFieldSource]),
+		Destination: string(fields[protocolFieldDestination]),
+	}, true
+}
+
+// 地址转字符串，地址未知时为空
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// 为访问者新建一个流，协商了访问者信息特性时先发送访问者地址
+// source、destination 为空时表示地址未知，如 HTTP 端口复用的连接
+func (p *TunnelContext) openStream(source, destination net.Addr) (net.Conn, error) {
+	stream, err := p.session.openStream()
+	if err != nil {
+		return nil, err
+	}
+	if p.hello.Has(featureVisitor) {
+		info := visitor{Source: addrString(source), Destination: addrString(destination)}
+		if err = sendFrame(stream, protocolFrameVisitor, info.Bytes()); err != nil {
+			closeConn(stream)
+			return nil, err
+		}
+	}
+	return stream, nil
+}
+
+// 接收访问者信息
+func receiveVisitor(stream net.Conn) (visitor, bool) {
+	frameType, body, legacy, err := receiveFrame(stream)
+	if err != nil || legacy || frameType != protocolFrameVisitor {
+		visitorLog.Warn("Fail to receive visitor info", "remote", addrString(stream.RemoteAddr()))
+		return visitor{}, false
+	}
+	return parseVisitor(body)
+}
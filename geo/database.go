@@ -0,0 +1,181 @@
+package geo
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 国家 IP 库，每个国家一个 IP 段文件，文件修改后可重新加载
+type Database struct {
+	files    map[string]string // 国家代码 -> 文件
+	mutex    sync.RWMutex
+	ranges   map[string][]Range   // 国家代码 -> 有序 IP 段
+	modTimes map[string]time.Time // 文件最后加载时的修改时间
+}
+
+// 解析国家文件配置，以逗号分隔，如 CN=cn_ips.txt,JP=jp_ips.txt
+// 省略国家代码时取文件名中第一个“_”或“.”之前的部分，如 cn_ips.txt 为 CN
+func ParseFiles(str string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		country, file := "", item
+		if index := strings.Index(item, "="); index >= 0 {
+			country, file = item[:index], strings.TrimSpace(item[index+1:])
+		} else {
+			country = filepath.Base(file)
+			if index = strings.IndexAny(country, "_."); index >= 0 {
+				country = country[:index]
+			}
+		}
+		country, err := normalizeCountry(country)
+		if err != nil || file == "" {
+			return nil, fmt.Errorf("illegal geoip file %q", item)
+		}
+		files[country] = file
+	}
+	return files, nil
+}
+
+// 加载国家 IP 库
+func Load(files map[string]string) (*Database, error) {
+	db := &Database{
+		files:    files,
+		ranges:   make(map[string][]Range),
+		modTimes: make(map[string]time.Time),
+	}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// 使用给定 IP 段创建国家 IP 库，不关联文件
+func New(ranges map[string][]Range) *Database {
+	db := &Database{ranges: make(map[string][]Range), modTimes: make(map[string]time.Time)}
+	for country, items := range ranges {
+		db.ranges[strings.ToUpper(country)] = Merge(items)
+	}
+	return db
+}
+
+// 重新加载全部文件，失败时保留原有内容
+func (d *Database) Reload() error {
+	if d == nil {
+		return nil
+	}
+	for country, file := range d.files {
+		if err := d.load(country, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 重新加载修改过的文件
+func (d *Database) ReloadIfModified() error {
+	if d == nil {
+		return nil
+	}
+	for country, file := range d.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		d.mutex.RLock()
+		modified := !info.ModTime().Equal(d.modTimes[country])
+		d.mutex.RUnlock()
+		if !modified {
+			continue
+		}
+		if err = d.load(country, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 加载单个国家文件
+func (d *Database) load(country, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	ranges, err := ParseRanges(f)
+	if err != nil {
+		return fmt.Errorf("%s %s", file, err.Error())
+	}
+	d.mutex.Lock()
+	d.ranges[country] = ranges
+	d.modTimes[country] = info.ModTime()
+	d.mutex.Unlock()
+	log.Printf("Load %d %s ip ranges from %s\n", len(ranges), country, file)
+	return nil
+}
+
+// 是否有国家的 IP 段
+func (d *Database) Has(country string) bool {
+	if d == nil {
+		return false
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	_, exists := d.ranges[strings.ToUpper(country)]
+	return exists
+}
+
+// IP 是否属于国家
+func (d *Database) Contains(country string, ip net.IP) bool {
+	if d == nil {
+		return false
+	}
+	d.mutex.RLock()
+	ranges := d.ranges[strings.ToUpper(country)]
+	d.mutex.RUnlock()
+	return search(ranges, ip)
+}
+
+// 已加载的国家代码
+func (d *Database) Countries() []string {
+	if d == nil {
+		return nil
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	countries := make([]string, 0, len(d.ranges))
+	for country := range d.ranges {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	return countries
+}
+
+// 国家代码统一为大写字母
+func normalizeCountry(country string) (string, error) {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if country == "" {
+		return "", errors.New("empty country")
+	}
+	for _, r := range country {
+		if r < 'A' || r > 'Z' {
+			return "", errors.New("illegal country " + country)
+		}
+	}
+	return country, nil
+}
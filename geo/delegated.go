@@ -0,0 +1,125 @@
+package geo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 解析 APNIC 等 RIR 发布的 delegated 格式统计文件，返回各国家合并后的 IP 段
+// 下载地址 http://ftp.apnic.net/apnic/stats/apnic/delegated-apnic-latest
+//
+// 每行格式为 注册机构|国家|类型|起始地址|数量|日期|状态，IPv4 数量为地址数，IPv6 数量为前缀长度
+// apnic|CN|ipv4|1.0.1.0|256|20110414|allocated
+// apnic|CN|ipv6|2001:250::|35|20000426|allocated
+// 版本行、汇总行、注释及 asn 记录直接忽略
+func ParseDelegated(reader io.Reader, countries []string) (map[string][]Range, error) {
+	wanted := make(map[string]bool)
+	for _, country := range countries {
+		country, err := normalizeCountry(country)
+		if err != nil {
+			return nil, err
+		}
+		wanted[country] = true
+	}
+
+	result := make(map[string][]Range)
+	scanner := bufio.NewScanner(reader)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		if len(fields) < 7 {
+			continue
+		}
+		country := strings.ToUpper(fields[1])
+		if !wanted[country] {
+			continue
+		}
+		// 只统计已分配的地址
+		if status := fields[6]; status != "allocated" && status != "assigned" {
+			continue
+		}
+		var r Range
+		var err error
+		switch fields[2] {
+		case "ipv4":
+			var count uint64
+			if count, err = strconv.ParseUint(fields[4], 10, 64); err == nil {
+				r, err = IPv4Range(net.ParseIP(fields[3]), count)
+			}
+		case "ipv6":
+			var ipNet *net.IPNet
+			if _, ipNet, err = net.ParseCIDR(fields[3] + "/" + fields[4]); err == nil {
+				r = CIDRRange(ipNet)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", number, err.Error())
+		}
+		result[country] = append(result[country], r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for country, ranges := range result {
+		result[country] = Merge(ranges)
+	}
+	return result, nil
+}
+
+// 写入 IP 段文件，格式与 ParseRanges 一致
+// IPv4 写为“起始IP,地址数”，IPv6 拆分为尽量少的 CIDR
+func WriteRanges(writer io.Writer, ranges []Range) error {
+	w := bufio.NewWriter(writer)
+	for _, r := range ranges {
+		if start, end := r.Start.To4(), r.End.To4(); start != nil && end != nil {
+			count := uint64(binary.BigEndian.Uint32(end)) - uint64(binary.BigEndian.Uint32(start)) + 1
+			if _, err := fmt.Fprintf(w, "%s,%d\n", start, count); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, ipNet := range rangeCIDRs(r) {
+			if _, err := fmt.Fprintln(w, ipNet.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// 将 IP 段拆分为 CIDR，每次取起始地址对齐且不超出结束地址的最大块
+func rangeCIDRs(r Range) []*net.IPNet {
+	var result []*net.IPNet
+	start := new(big.Int).SetBytes(r.Start.To16())
+	end := new(big.Int).SetBytes(r.End.To16())
+	one := big.NewInt(1)
+	for start.Cmp(end) <= 0 {
+		bits := start.TrailingZeroBits()
+		if start.Sign() == 0 || bits > net.IPv6len*8 {
+			bits = net.IPv6len * 8
+		}
+		for ; bits > 0; bits-- {
+			last := new(big.Int).Lsh(one, bits)
+			last.Add(last, start).Sub(last, one)
+			if last.Cmp(end) <= 0 {
+				break
+			}
+		}
+		ip := make(net.IP, net.IPv6len)
+		start.FillBytes(ip)
+		result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(net.IPv6len*8-int(bits), net.IPv6len*8)})
+		start.Add(start, new(big.Int).Lsh(one, bits))
+	}
+	return result
+}
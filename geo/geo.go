@@ -0,0 +1,154 @@
+package geo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IP 段，包含边界，统一使用 16 字节表示，IPv4 映射到 ::ffff:0:0/96
+type Range struct {
+	Start net.IP
+	End   net.IP
+}
+
+// 是否包含 IP
+func (r Range) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	return ip != nil && bytes.Compare(ip, r.Start) >= 0 && bytes.Compare(ip, r.End) <= 0
+}
+
+// 转字符串
+func (r Range) String() string {
+	return fmt.Sprintf("%s~%s", r.Start, r.End)
+}
+
+// 由起始 IPv4 及地址数计算 IP 段
+func IPv4Range(start net.IP, count uint64) (Range, error) {
+	start = start.To4()
+	if start == nil || count == 0 {
+		return Range{}, fmt.Errorf("illegal ipv4 range %s,%d", start, count)
+	}
+	first := uint64(binary.BigEndian.Uint32(start))
+	last := first + count - 1
+	if last > 0xFFFFFFFF {
+		return Range{}, fmt.Errorf("ipv4 range %s,%d overflow", start, count)
+	}
+	end := make(net.IP, 4)
+	binary.BigEndian.PutUint32(end, uint32(last))
+	return Range{Start: start.To16(), End: end.To16()}, nil
+}
+
+// 由 CIDR 计算 IP 段
+func CIDRRange(ipNet *net.IPNet) Range {
+	start := ipNet.IP.Mask(ipNet.Mask).To16()
+	end := make(net.IP, net.IPv6len)
+	copy(end, start)
+	ones, bits := ipNet.Mask.Size()
+	// IPv4 掩码只覆盖后 4 个字节
+	for i := ones + net.IPv6len*8 - bits; i < net.IPv6len*8; i++ {
+		end[i/8] |= 0x80 >> uint(i%8)
+	}
+	return Range{Start: start, End: end}
+}
+
+// 解析 IP 段文件
+// 每行一个 IP 段，IPv4 为“起始IP,地址数”，与 cn_ips.txt 一致，也可以是 CIDR，# 开头为注释
+//
+// 1.0.1.0,256
+// 2001:250::/35
+func ParseRanges(reader io.Reader) ([]Range, error) {
+	var ranges []Range
+	scanner := bufio.NewScanner(reader)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRange(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", number, err.Error())
+		}
+		ranges = append(ranges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return Merge(ranges), nil
+}
+
+// 解析单行 IP 段
+func parseRange(line string) (Range, error) {
+	if strings.Contains(line, "/") {
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			return Range{}, err
+		}
+		return CIDRRange(ipNet), nil
+	}
+	fields := strings.SplitN(line, ",", 2)
+	if len(fields) != 2 {
+		return Range{}, fmt.Errorf("illegal range %q", line)
+	}
+	count, err := strconv.ParseUint(strings.TrimSpace(fields[1]), 10, 64)
+	if err != nil {
+		return Range{}, fmt.Errorf("illegal range %q", line)
+	}
+	return IPv4Range(net.ParseIP(strings.TrimSpace(fields[0])), count)
+}
+
+// 排序并合并重叠或相邻的 IP 段
+func Merge(ranges []Range) []Range {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sorted := make([]Range, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Start, sorted[j].Start) < 0
+	})
+	merged := []Range{sorted[0]}
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if next := nextIP(last.End); next != nil && bytes.Compare(r.Start, next) > 0 {
+			merged = append(merged, r)
+			continue
+		}
+		if bytes.Compare(r.End, last.End) > 0 {
+			last.End = r.End
+		}
+	}
+	return merged
+}
+
+// 在有序且不重叠的 IP 段中二分查找
+func search(ranges []Range, ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	// 第一个起始 IP 大于 ip 的段，ip 只可能落在它前一个段中
+	i := sort.Search(len(ranges), func(i int) bool {
+		return bytes.Compare(ranges[i].Start, ip) > 0
+	})
+	return i > 0 && bytes.Compare(ip, ranges[i-1].End) <= 0
+}
+
+// 下一个 IP，已是最大 IP 时返回 nil
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package geo
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// 按国家的访问控制策略
+// 属于拒绝国家的 IP 一律拒绝；配置了允许国家时，只允许属于允许国家的 IP
+type Policy struct {
+	Allow []string // 允许的国家代码
+	Deny  []string // 拒绝的国家代码
+}
+
+// 解析策略，国家代码以逗号、竖线或空白分隔
+func ParsePolicy(allow, deny string) (Policy, error) {
+	var policy Policy
+	var err error
+	if policy.Allow, err = parseCountries(allow); err != nil {
+		return Policy{}, err
+	}
+	if policy.Deny, err = parseCountries(deny); err != nil {
+		return Policy{}, err
+	}
+	return policy, nil
+}
+
+// 是否没有任何规则
+func (p *Policy) Empty() bool {
+	return len(p.Allow) == 0 && len(p.Deny) == 0
+}
+
+// 允许国家字符串，逗号分隔
+func (p *Policy) AllowString() string {
+	return strings.Join(p.Allow, ",")
+}
+
+// 拒绝国家字符串，逗号分隔
+func (p *Policy) DenyString() string {
+	return strings.Join(p.Deny, ",")
+}
+
+// 检查国家 IP 库是否包含策略中的所有国家
+func (p *Policy) Check(db *Database) error {
+	for _, countries := range [][]string{p.Allow, p.Deny} {
+		for _, country := range countries {
+			if !db.Has(country) {
+				return errors.New("unknown country " + country)
+			}
+		}
+	}
+	return nil
+}
+
+// 检查 IP 是否允许访问，IP 为空时视为未知，不做限制
+func (p *Policy) Allowed(db *Database, ip net.IP) bool {
+	if ip == nil || p.Empty() {
+		return true
+	}
+	for _, country := range p.Deny {
+		if db.Contains(country, ip) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, country := range p.Allow {
+		if db.Contains(country, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析国家代码列表
+func parseCountries(str string) ([]string, error) {
+	var countries []string
+	items := strings.FieldsFunc(str, func(r rune) bool {
+		return r == ',' || r == '|' || r == ' ' || r == '\t'
+	})
+	for _, item := range items {
+		country, err := normalizeCountry(item)
+		if err != nil {
+			return nil, err
+		}
+		countries = append(countries, country)
+	}
+	return countries, nil
+}
@@ -0,0 +1,397 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志级别
+type Level int
+
+const (
+	LevelDebug Level = iota + 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return "info"
+}
+
+// 解析日志级别，为空时为 info
+func ParseLevel(str string) (Level, error) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	if str == "" {
+		return LevelInfo, nil
+	}
+	if str == "warning" {
+		return LevelWarn, nil
+	}
+	for level, name := range levelNames {
+		if name == str {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("illegal log level %s", str)
+}
+
+// 输出格式
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// 日志配置
+type Config struct {
+	Level      Level    // 日志级别，为 0 时为 info
+	Format     string   // 输出格式，text 或 json，为空时为 text
+	File       string   // 日志文件，为空时输出到标准错误
+	MaxSize    uint64   // 日志文件达到该大小后轮转，为 0 时使用默认值
+	MaxBackups int      // 保留的轮转文件数，为 0 时使用默认值
+	Debug      []string // 输出 debug 日志的子系统，如 heartbeat、dial
+
+	Access       bool   // 是否记录访问日志，不受日志级别影响
+	AccessFormat string // 访问日志格式，为空时与 Format 相同
+	AccessFile   string // 访问日志文件，为空时写入日志，与日志文件同样轮转
+}
+
+const (
+	// 默认日志文件轮转大小
+	DefaultMaxSize = 10 << 20
+	// 默认保留的轮转文件数
+	DefaultMaxBackups = 5
+)
+
+// 未配置的项使用默认值
+func (c Config) WithDefaults() Config {
+	if c.Level == 0 {
+		c.Level = LevelInfo
+	}
+	if c.Format == "" {
+		c.Format = FormatText
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = DefaultMaxSize
+	}
+	if c.MaxBackups <= 0 {
+		c.MaxBackups = DefaultMaxBackups
+	}
+	if c.AccessFormat == "" {
+		c.AccessFormat = c.Format
+	}
+	return c
+}
+
+// 日志输出状态
+// 未调用 Setup 时通过标准库 log 输出，保持原有格式及输出位置
+type state struct {
+	mutex  sync.Mutex
+	setup  bool
+	config Config
+	debug  map[string]bool
+	output io.Writer
+	closer io.Closer
+
+	access       io.Writer // 访问日志输出，未单独配置文件时为空，写入日志
+	accessCloser io.Closer
+}
+
+var current = &state{config: Config{}.WithDefaults()}
+
+// 标准库 log 原有的输出格式，Reset 时恢复
+var stdFlags = log.Flags()
+
+// 按配置输出日志，同时接管标准库 log 的输出，作为 info 级别记录
+func Setup(cfg Config) error {
+	cfg = cfg.WithDefaults()
+	for _, format := range []string{cfg.Format, cfg.AccessFormat} {
+		if format != FormatText && format != FormatJSON {
+			return fmt.Errorf("illegal log format %s", format)
+		}
+	}
+	var output io.Writer = os.Stderr
+	var closer io.Closer
+	if cfg.File != "" {
+		file, err := openRotatingFile(cfg.File, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return err
+		}
+		output, closer = file, file
+	}
+	var access io.Writer
+	var accessCloser io.Closer
+	if cfg.Access && cfg.AccessFile != "" {
+		file, err := openRotatingFile(cfg.AccessFile, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			if closer != nil {
+				_ = closer.Close()
+			}
+			return err
+		}
+		access, accessCloser = file, file
+	}
+	debug := make(map[string]bool)
+	for _, name := range cfg.Debug {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			debug[name] = true
+		}
+	}
+
+	current.mutex.Lock()
+	if !current.setup {
+		stdFlags = log.Flags()
+	}
+	previous := []io.Closer{current.closer, current.accessCloser}
+	current.setup, current.config, current.debug = true, cfg, debug
+	current.output, current.closer = output, closer
+	current.access, current.accessCloser = access, accessCloser
+	current.mutex.Unlock()
+	closeAll(previous)
+
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+	return nil
+}
+
+// 恢复为标准库 log 输出
+func Reset() {
+	current.mutex.Lock()
+	closers := []io.Closer{current.closer, current.accessCloser}
+	wasSetup := current.setup
+	current.setup, current.config, current.debug = false, Config{}.WithDefaults(), nil
+	current.output, current.closer = nil, nil
+	current.access, current.accessCloser = nil, nil
+	current.mutex.Unlock()
+	closeAll(closers)
+	if wasSetup {
+		log.SetFlags(stdFlags)
+		log.SetOutput(os.Stderr)
+	}
+}
+
+func closeAll(closers []io.Closer) {
+	for _, closer := range closers {
+		if closer != nil {
+			_ = closer.Close()
+		}
+	}
+}
+
+// 是否记录访问日志
+func AccessEnabled() bool {
+	current.mutex.Lock()
+	defer current.mutex.Unlock()
+	return current.setup && current.config.Access
+}
+
+// 记录一条访问日志，配置了访问日志文件时写入该文件，否则写入日志
+func Access(msg string, kv ...interface{}) {
+	current.mutex.Lock()
+	enabled, format, output := current.setup && current.config.Access, current.config.AccessFormat, current.access
+	current.mutex.Unlock()
+	if !enabled {
+		return
+	}
+	line := record(time.Now(), LevelInfo, "access", msg, kv, format)
+	if output == nil {
+		write(line)
+		return
+	}
+	_, _ = output.Write(line)
+}
+
+// 子系统的日志
+type Logger struct {
+	subsystem string
+}
+
+// 创建子系统的日志，如 heartbeat、dial
+func New(subsystem string) *Logger {
+	return &Logger{subsystem: strings.ToLower(subsystem)}
+}
+
+// 是否输出该级别的日志，开启了子系统 debug 时输出所有级别
+func (l *Logger) Enabled(level Level) bool {
+	current.mutex.Lock()
+	defer current.mutex.Unlock()
+	return level >= current.config.Level || current.debug[l.subsystem]
+}
+
+// 调试日志，kv 为交替的键和值，如 "port", 13306, "client_id", id
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+// 致命错误，不受日志级别影响，记录后退出进程
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.output(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.output(level, msg, kv)
+}
+
+func (l *Logger) output(level Level, msg string, kv []interface{}) {
+	current.mutex.Lock()
+	setup, format := current.setup, current.config.Format
+	current.mutex.Unlock()
+	if !setup {
+		// 未配置时通过标准库 log 输出
+		_ = log.Output(4, formatText(level, l.subsystem, msg, kv))
+		return
+	}
+	write(record(time.Now(), level, l.subsystem, msg, kv, format))
+}
+
+// 标准库 log 的输出，每次写入一行，作为 info 级别记录
+// 无法区分 log.Fatal 的输出，需要退出进程时应使用 Logger.Fatal，不受日志级别影响
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	current.mutex.Lock()
+	level, format := current.config.Level, current.config.Format
+	current.mutex.Unlock()
+	if LevelInfo >= level {
+		msg := strings.TrimRight(string(p), "\n")
+		write(record(time.Now(), LevelInfo, "", msg, nil, format))
+	}
+	return len(p), nil
+}
+
+func write(line []byte) {
+	current.mutex.Lock()
+	defer current.mutex.Unlock()
+	output := current.output
+	if output == nil {
+		output = os.Stderr
+	}
+	_, _ = output.Write(line)
+}
+
+// 格式化一条记录，以换行结尾
+func record(t time.Time, level Level, subsystem, msg string, kv []interface{}, format string) []byte {
+	if format == FormatJSON {
+		return formatJSON(t, level, subsystem, msg, kv)
+	}
+	return []byte(t.Format("2006/01/02 15:04:05.000000 ") + formatText(level, subsystem, msg, kv) + "\n")
+}
+
+// 文本格式，如 INFO  [tunnel] Register port port=13306 client_id=abc
+func formatText(level Level, subsystem, msg string, kv []interface{}) string {
+	var buffer bytes.Buffer
+	_, _ = fmt.Fprintf(&buffer, "%-5s ", strings.ToUpper(level.String()))
+	if subsystem != "" {
+		buffer.WriteString("[" + subsystem + "] ")
+	}
+	buffer.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		key, value := pair(kv, i)
+		text := fmt.Sprint(value)
+		if text == "" || strings.ContainsAny(text, " \t\"=") {
+			text = fmt.Sprintf("%q", text)
+		}
+		buffer.WriteString(" " + key + "=" + text)
+	}
+	return buffer.String()
+}
+
+// JSON 格式，字段与 time、level、subsystem、msg 同级
+func formatJSON(t time.Time, level Level, subsystem, msg string, kv []interface{}) []byte {
+	fields := map[string]interface{}{
+		"time":  t.Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	if subsystem != "" {
+		fields["subsystem"] = subsystem
+	}
+	for i := 0; i < len(kv); i += 2 {
+		key, value := pair(kv, i)
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		} else if s, ok := value.(fmt.Stringer); ok {
+			value = s.String()
+		}
+		fields[key] = value
+	}
+	// 固定字段在前，其余按名称排序，便于阅读
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	order := map[string]int{"time": 1, "level": 2, "subsystem": 3, "msg": 4}
+	sort.Slice(keys, func(i, j int) bool {
+		oi, oj := order[keys[i]], order[keys[j]]
+		if oi == 0 {
+			oi = len(order) + 1
+		}
+		if oj == 0 {
+			oj = len(order) + 1
+		}
+		if oi != oj {
+			return oi < oj
+		}
+		return keys[i] < keys[j]
+	})
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		value, err := json.Marshal(fields[key])
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[key]))
+		}
+		buffer.Write(name)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteString("}\n")
+	return buffer.Bytes()
+}
+
+// 取第 i 个键值对，缺少值时值为空
+func pair(kv []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(kv[i])
+	if i+1 < len(kv) {
+		return key, kv[i+1]
+	}
+	return key, ""
+}
@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// 按大小轮转的日志文件
+// 写入后超过 maxSize 时，file 改名为 file.1，原 file.1 改名为 file.2，依此类推，最多保留 maxBackups 个
+type rotatingFile struct {
+	path       string
+	maxSize    uint64
+	maxBackups int
+	mutex      sync.Mutex
+	file       *os.File
+	size       uint64
+}
+
+func openRotatingFile(path string, maxSize uint64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// 以追加方式打开日志文件
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size = file, uint64(info.Size())
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.size+uint64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// 轮转失败时继续写入原文件
+			_, _ = fmt.Fprintln(os.Stderr, "Fail to rotate log file.", err.Error())
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += uint64(n)
+	return n, err
+}
+
+// 轮转，调用方持有锁
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	_ = os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	renameErr := os.Rename(f.path, f.path+".1")
+	if err := f.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"chuantou/config"
 	"chuantou/core"
+	"chuantou/geo"
+	"chuantou/logging"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func init() {
@@ -21,10 +28,24 @@ func printHelp() {
 	fmt.Println(`A: "-server" load "config.ini" and start as server`)
 	fmt.Println(`   "-client" load "config.ini" and start as client`)
 	fmt.Println(`B: "-server <key> <port>" start as server, and listening at port x', e.g. -server 6666`)
-	fmt.Println(`   "-client <key> <server:port> <local:port:mapping> [tunnel-count]" start as client,`)
+	fmt.Println(`   "-client <key> <server:port> <local:port:mapping>" start as client,`)
 	fmt.Println(`   "e.g. -client winshu 123.54.23.67:6666 127.0.0.1:3306:13306`)
 	fmt.Println(`Generate trial key: `)
-	fmt.Println(`   "-generate <key> [expired-time]" make a trial client key, e.g. -generate winshu 2019-12-31`)
+	fmt.Println(`   "-generate <key> [expired-time]" make a legacy trial client key (requires legacy-keys when token-key is set), e.g. -generate winshu 2019-12-31`)
+	fmt.Println(`Generate signed token: `)
+	fmt.Println(`   "-generate -token-key [private-key-file] [public-key-file]" make a token signing key pair`)
+	fmt.Println(`   "-generate -token <private-key-file> <subject> [expired-time] [ports] [max-tunnels]" make a signed client token,`)
+	fmt.Println(`   "e.g. -generate -token token.key alice "2019-12-31 18:00" 10000-10100,12000 3`)
+	fmt.Println(`   "-check <public-key-file> <token>" or "-check <key> <trial-key>" inspect a token or trial key`)
+	fmt.Println(`Revoke token: `)
+	fmt.Println(`   "-revoke <revocation-file> <token|token-id|trial-key> [reason]" e.g. -revoke revoked.txt a20313d86dbd45d6 leaked`)
+	fmt.Println(`Generate self-signed certificate: `)
+	fmt.Println(`   "-gen-cert <host,...> [cert-file] [key-file]" e.g. -gen-cert 123.54.23.67 server.crt server.key`)
+	fmt.Println(`Build country ip ranges: `)
+	fmt.Println(`   "-geoip-build <delegated-file> <country...>" write "<country>_ips.txt" for geoip-files, e.g. -geoip-build delegated-apnic-latest CN JP`)
+	fmt.Println(`Control running server: `)
+	fmt.Println(`   "-ctl [-socket <ctl-socket>] <ports|clients|kick <id>|close <port>|ban <ip> [duration]|reload|stats>"`)
+	fmt.Println(`   "e.g. -ctl kick 2b4f1a6c9d, socket defaults to ctl-socket in "config.ini"`)
 	fmt.Println(`more details please read "README.md"`)
 }
 
@@ -43,12 +64,22 @@ func main() {
 	switch args[1] {
 	case "-server": //服务器端参数启动
 		serverConfig := config.InitServerConfig(argsConfig)
+		setupLogging(serverConfig.Log)
 		core.Server(serverConfig)
 	case "-client": //客户端参数启动
 		clientConfig := config.InitClientConfig(argsConfig)
+		setupLogging(clientConfig.Log)
 		core.Client(clientConfig)
 	case "-generate": //生成短期 key
-		// 生成短期 key
+		if len(argsConfig) > 0 && argsConfig[0] == "-token-key" {
+			generateTokenKey(argsConfig[1:])
+			return
+		}
+		if len(argsConfig) > 0 && argsConfig[0] == "-token" {
+			generateToken(argsConfig[1:])
+			return
+		}
+		// 生成旧版短期 key
 		var seed, expired string
 		if len(argsConfig) > 0 {
 			seed = argsConfig[0]
@@ -57,16 +88,196 @@ func main() {
 			expired = argsConfig[1]
 		}
 		if len(argsConfig) > 0 {
-			trialKey, _ := config.NewKey(seed, expired)
+			trialKey, _ := config.NewTrialKey(seed, expired)
 			fmt.Println("You got a new key ->    ", trialKey)
 		}
 	case "-check":
+		if len(argsConfig) == 2 && config.IsToken(argsConfig[1]) {
+			checkToken(argsConfig[0], argsConfig[1])
+			return
+		}
 		if len(argsConfig) == 2 {
 			fmt.Println(config.CheckKey(argsConfig[0], argsConfig[1]))
 		}
+	case "-revoke": //吊销令牌
+		if len(argsConfig) < 2 {
+			printHelp()
+			return
+		}
+		id, err := config.RevokeToken(argsConfig[0], argsConfig[1], strings.Join(argsConfig[2:], " "))
+		if err != nil {
+			log.Fatalln("Fail to revoke token.", err.Error())
+		}
+		fmt.Println("Revoked token ->    ", id)
+	case "-gen-cert": //生成自签名证书
+		if len(argsConfig) == 0 {
+			printHelp()
+			return
+		}
+		certFile, keyFile := "server.crt", "server.key"
+		if len(argsConfig) > 1 {
+			certFile = argsConfig[1]
+		}
+		if len(argsConfig) > 2 {
+			keyFile = argsConfig[2]
+		}
+		certPEM, keyPEM, err := config.NewCert(strings.Split(argsConfig[0], ","))
+		if err != nil {
+			log.Fatalln("Fail to generate certificate.", err.Error())
+		}
+		if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+			log.Fatalln("Fail to write certificate.", err.Error())
+		}
+		if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			log.Fatalln("Fail to write private key.", err.Error())
+		}
+		fingerprint, _ := config.CertFingerprint(certPEM)
+		fmt.Println("Certificate ->    ", certFile)
+		fmt.Println("Private key ->    ", keyFile)
+		fmt.Println("Fingerprint ->    ", fingerprint)
+	case "-geoip-build": //生成国家 IP 段文件
+		if len(argsConfig) < 2 {
+			printHelp()
+			return
+		}
+		buildGeoIP(argsConfig[0], argsConfig[1:])
+	case "-ctl": //控制运行中的服务端
+		socket := ""
+		if len(argsConfig) > 1 && argsConfig[0] == "-socket" {
+			socket, argsConfig = argsConfig[1], argsConfig[2:]
+		}
+		if len(argsConfig) == 0 {
+			printHelp()
+			return
+		}
+		var err error
+		if socket == "" {
+			if socket, err = config.LoadControlSocket(); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		}
+		output, err := core.Control(socket, argsConfig)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Print(output)
 	case "-version":
 		fmt.Println("Version", core.Version)
 	default:
 		printHelp()
 	}
 }
+
+// 按配置输出日志
+func setupLogging(cfg logging.Config) {
+	if err := logging.Setup(cfg); err != nil {
+		log.Fatalln("Fail to setup logging.", err.Error())
+	}
+}
+
+// 由 delegated 统计文件生成各国家的 IP 段文件，文件名如 cn_ips.txt
+func buildGeoIP(source string, countries []string) {
+	f, err := os.Open(source)
+	if err != nil {
+		log.Fatalln("Fail to open delegated file.", err.Error())
+	}
+	defer f.Close()
+	result, err := geo.ParseDelegated(f, countries)
+	if err != nil {
+		log.Fatalln("Fail to parse delegated file.", err.Error())
+	}
+	for _, country := range countries {
+		country = strings.ToUpper(country)
+		var buffer bytes.Buffer
+		if err = geo.WriteRanges(&buffer, result[country]); err != nil {
+			log.Fatalln("Fail to encode ip ranges.", err.Error())
+		}
+		target := strings.ToLower(country) + "_ips.txt"
+		if err = ioutil.WriteFile(target, buffer.Bytes(), 0644); err != nil {
+			log.Fatalln("Fail to write ip ranges.", err.Error())
+		}
+		fmt.Printf("%s ->    %s (%d ranges)\n", country, target, len(result[country]))
+	}
+}
+
+// 生成令牌签名密钥对
+func generateTokenKey(args []string) {
+	privateFile, publicFile := "token.key", "token.pub"
+	if len(args) > 0 {
+		privateFile = args[0]
+	}
+	if len(args) > 1 {
+		publicFile = args[1]
+	}
+	privatePEM, publicPEM, err := config.NewTokenKey()
+	if err != nil {
+		log.Fatalln("Fail to generate token key.", err.Error())
+	}
+	if err = ioutil.WriteFile(privateFile, privatePEM, 0600); err != nil {
+		log.Fatalln("Fail to write private key.", err.Error())
+	}
+	if err = ioutil.WriteFile(publicFile, publicPEM, 0644); err != nil {
+		log.Fatalln("Fail to write public key.", err.Error())
+	}
+	fmt.Println("Private key ->    ", privateFile)
+	fmt.Println("Public key  ->    ", publicFile)
+}
+
+// 签发令牌
+func generateToken(args []string) {
+	if len(args) < 2 {
+		printHelp()
+		return
+	}
+	privateKey, err := config.LoadTokenPrivateKey(args[0])
+	if err != nil {
+		log.Fatalln("Fail to load private key.", err.Error())
+	}
+	claims := config.TokenClaims{Subject: args[1]}
+
+	expired := ""
+	if len(args) > 2 {
+		expired = args[2]
+	}
+	expiry, err := config.ParseExpiry(expired)
+	if err != nil {
+		log.Fatalln("Fail to parse expired time.", err.Error())
+	}
+	claims.ExpiresAt = expiry.Unix()
+	if len(args) > 3 {
+		claims.Ports = args[3]
+	}
+	if len(args) > 4 {
+		if claims.MaxTunnels, err = strconv.Atoi(args[4]); err != nil || claims.MaxTunnels < 0 {
+			log.Fatalln("Fail to parse max-tunnels.", args[4])
+		}
+	}
+
+	token, err := config.NewToken(privateKey, claims)
+	if err != nil {
+		log.Fatalln("Fail to generate token.", err.Error())
+	}
+	fmt.Println("You got a new token ->    ", token)
+}
+
+// 查看令牌
+func checkToken(publicKeyFile, token string) {
+	publicKey, err := config.LoadTokenPublicKey(publicKeyFile)
+	if err != nil {
+		log.Fatalln("Fail to load public key.", err.Error())
+	}
+	claims, err := config.ParseToken(publicKey, token)
+	if err != nil {
+		fmt.Println("Invalid token.", err.Error())
+		return
+	}
+	fmt.Println("Token ID    ->    ", claims.ID)
+	fmt.Println("Subject     ->    ", claims.Subject)
+	fmt.Println("Issued at   ->    ", time.Unix(claims.IssuedAt, 0).Format(time.RFC3339))
+	fmt.Println("Expires at  ->    ", claims.Expiry().Format(time.RFC3339))
+	fmt.Println("Ports       ->    ", claims.Ports)
+	fmt.Println("Max tunnels ->    ", claims.MaxTunnels)
+	fmt.Println("Valid       ->    ", !claims.Expired(time.Now()))
+}
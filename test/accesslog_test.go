@@ -0,0 +1,114 @@
+package test
+
+import (
+	"bytes"
+	"chuantou/config"
+	"chuantou/core"
+	"chuantou/logging"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 测试访问日志
+
+func TestAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "access.log")
+	if err = logging.Setup(logging.Config{Access: true, AccessFormat: logging.FormatJSON, AccessFile: file}); err != nil {
+		t.Fatal(err)
+	}
+	defer logging.Reset()
+
+	echoPort := startEchoServer(t)
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16735,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		HTTPPort:      16742,
+	})
+	webPort := startWebServer(t, "access")
+	domain, ok := config.ParseNetAddress(fmt.Sprintf("127.0.0.1:%d?domain=access.example.com", webPort))
+	if !ok {
+		t.Fatal("Fail to parse domain mapping")
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16735},
+		LocalAddr:  []config.NetAddress{{IP: "127.0.0.1", Port: echoPort, Port2: 16736}, domain},
+	})
+	waitForPort(t, 16736)
+	waitForPort(t, 16742)
+
+	// 访问者发送后关闭连接
+	conn, err := net.Dial("tcp", "127.0.0.1:16736")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("a"), 1000)
+	if _, err = conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	// 服务端及客户端各记录一条
+	target := fmt.Sprintf("127.0.0.1:%d", echoPort)
+	for i := 0; i < 50; i++ {
+		var matched []map[string]interface{}
+		for _, record := range readJSONLog(t, file) {
+			if record["port"] == "16736" && record["bytes_in"] == float64(1000) && record["bytes_out"] == float64(1000) {
+				matched = append(matched, record)
+			}
+		}
+		if len(matched) >= 2 {
+			for _, record := range matched {
+				if record["subsystem"] != "access" || record["target"] != target || record["reason"] != "visitor closed" ||
+					record["client_id"] == "" || record["remote"] == "" || record["start"] == nil || record["duration_ms"] == nil {
+					t.Fatalf("Unexpected access record %v", record)
+				}
+			}
+			break
+		}
+		if i == 49 {
+			t.Fatal("Access records of 16736 not found")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// HTTP 端口每个请求记录一条，等待域名注册完成
+	body := ""
+	for i := 0; i < 50; i++ {
+		var code int
+		if code, body = getWithHost(t, 16742, "access.example.com"); code == http.StatusOK {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for i := 0; i < 50; i++ {
+		for _, record := range readJSONLog(t, file) {
+			if record["port"] == "access.example.com" && record["reason"] == "status 200" {
+				if record["bytes_out"] != float64(len(body)) || record["bytes_in"] != float64(0) ||
+					record["target"] != fmt.Sprintf("127.0.0.1:%d", webPort) || record["remote"] == "" || record["duration_ms"] == nil {
+					t.Fatalf("Unexpected access record %v", record)
+				}
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("Access record of access.example.com not found")
+}
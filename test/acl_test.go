@@ -0,0 +1,107 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// 测试访问控制规则
+
+func TestParseACL(t *testing.T) {
+	acl, err := config.ParseACL("10.0.0.0/8,192.168.1.1|2001:db8::/32", "10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"10.2.3.4":        true,
+		"10.1.3.4":        false,
+		"192.168.1.1":     true,
+		"192.168.1.2":     false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"::ffff:10.2.3.4": true,
+	}
+	for ip, expect := range cases {
+		if acl.Allowed(net.ParseIP(ip)) != expect {
+			t.Fatalf("Expect %s allowed=%v", ip, expect)
+		}
+	}
+	// 访问者地址未知时，配置了规则则拒绝，否则不做限制
+	if acl.Allowed(nil) || config.HostIP("") != nil {
+		t.Fatal("Expect unknown visitor to be denied")
+	}
+	if denyOnly, _ := config.ParseACL("", "10.1.0.0/16"); denyOnly.Allowed(nil) {
+		t.Fatal("Expect unknown visitor to be denied by deny rules")
+	}
+	if empty := (config.ACL{}); !empty.Allowed(nil) {
+		t.Fatal("Expect unknown visitor to be allowed without rules")
+	}
+	if acl.AllowString() != "10.0.0.0/8,192.168.1.1/32,2001:db8::/32" {
+		t.Fatalf("Unexpected allow %s", acl.AllowString())
+	}
+	if _, err = config.ParseACL("10.0.0.0/33", ""); err == nil {
+		t.Fatal("Expect illegal cidr to fail")
+	}
+
+	addr, ok := config.ParseNetAddress("127.0.0.1:3306:13306?allow=10.0.0.0/8|192.168.0.0/16&deny=10.1.0.0/16")
+	if !ok || addr.ACL.AllowString() != "10.0.0.0/8,192.168.0.0/16" || addr.ACL.DenyString() != "10.1.0.0/16" {
+		t.Fatalf("Unexpected address %+v", addr)
+	}
+	if _, ok = config.ParseNetAddress("127.0.0.1:3306?deny=localhost"); ok {
+		t.Fatal("Expect illegal deny to fail")
+	}
+}
+
+// 连接被访问端口直接关闭
+func assertRejected(t *testing.T, port uint32) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("hello"))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 5)); err == nil || n > 0 {
+		t.Fatalf("Expect visitor to be rejected on port %d", port)
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	echoPort := startEchoServer(t)
+
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16702,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+	})
+
+	var locals []config.NetAddress
+	for _, item := range []string{
+		"127.0.0.1:%d:16703?allow=127.0.0.0/8",
+		"127.0.0.1:%d:16704?deny=127.0.0.1",
+		"127.0.0.1:%d:16705?allow=10.0.0.0/8",
+	} {
+		local, ok := config.ParseNetAddress(fmt.Sprintf(item, echoPort))
+		if !ok {
+			t.Fatalf("Fail to parse mapping %s", item)
+		}
+		locals = append(locals, local)
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16702},
+		LocalAddr:  locals,
+	})
+
+	waitForPort(t, 16703)
+	waitForPort(t, 16704)
+	waitForPort(t, 16705)
+	assertEcho(t, 16703)
+	assertRejected(t, 16704)
+	assertRejected(t, 16705)
+}
@@ -0,0 +1,141 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试管理接口
+
+// 请求管理接口，返回状态码，响应解析到 value
+func adminRequest(t *testing.T, method, url, token string, value interface{}) int {
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if value != nil && response.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(response.Body).Decode(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	echoPort := startEchoServer(t)
+	cfg := config.ServerConfig{
+		Key:           "winshu",
+		Port:          16720,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		AdminToken:    "admin-token",
+	}
+	go core.Server(cfg)
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16720},
+		LocalAddr:  []config.NetAddress{{IP: "127.0.0.1", Port: echoPort, Port2: 16721}},
+	})
+	waitForPort(t, 16721)
+	assertEcho(t, 16721)
+
+	admin := httptest.NewServer(core.AdminHandler(cfg))
+	defer admin.Close()
+
+	// 未携带令牌或令牌错误
+	if status := adminRequest(t, http.MethodGet, admin.URL+"/api/tunnels", "", nil); status != http.StatusUnauthorized {
+		t.Fatalf("Expect 401 without token, got %d", status)
+	}
+	if status := adminRequest(t, http.MethodGet, admin.URL+"/api/tunnels", "wrong", nil); status != http.StatusUnauthorized {
+		t.Fatalf("Expect 401 with wrong token, got %d", status)
+	}
+
+	// 隧道列表，其它测试注册的隧道也在列表中
+	var tunnels []core.TunnelInfo
+	if status := adminRequest(t, http.MethodGet, admin.URL+"/api/tunnels", "admin-token", &tunnels); status != http.StatusOK {
+		t.Fatalf("Fail to list tunnels, status = %d", status)
+	}
+	var found *core.TunnelInfo
+	for i := range tunnels {
+		if tunnels[i].Key == "16721" {
+			found = &tunnels[i]
+		}
+	}
+	if found == nil {
+		t.Fatalf("Tunnel 16721 not found in %v", tunnels)
+	}
+	if found.Tunnels != 1 || found.ClientID == "" || found.RemoteAddr == "" {
+		t.Fatalf("Unexpected tunnel info %+v", *found)
+	}
+	if found.Connections.Accepted == 0 {
+		t.Fatalf("Expect accepted connections, got %+v", found.Connections)
+	}
+
+	// 配置中不含密钥
+	var view map[string]interface{}
+	if status := adminRequest(t, http.MethodGet, admin.URL+"/api/config", "admin-token", &view); status != http.StatusOK {
+		t.Fatalf("Fail to get config, status = %d", status)
+	}
+	if view["port"].(float64) != 16720 || view["legacy_keys"] != true {
+		t.Fatalf("Unexpected config %v", view)
+	}
+	data, _ := json.Marshal(view)
+	for _, secret := range []string{"winshu", "admin-token"} {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("Config leaks secret %q: %s", secret, data)
+		}
+	}
+
+	// 关闭映射，客户端稍后会重连
+	if status := adminRequest(t, http.MethodPost, admin.URL+"/api/close?key=16799", "admin-token", nil); status != http.StatusNotFound {
+		t.Fatalf("Expect 404 for unknown tunnel, got %d", status)
+	}
+	if status := adminRequest(t, http.MethodGet, admin.URL+"/api/close?key=16721", "admin-token", nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("Expect 405 for GET, got %d", status)
+	}
+	if status := adminRequest(t, http.MethodPost, admin.URL+"/api/close?key=16721", "admin-token", nil); status != http.StatusOK {
+		t.Fatalf("Fail to close tunnel, status = %d", status)
+	}
+	waitForPortClosed(t, 16721)
+
+	// 踢出客户端，关闭其所有隧道
+	id := strings.Repeat("e", 32)
+	conn, result := register(t, 16720, 16722, id, "", "winshu")
+	defer conn.Close()
+	if result != 0 {
+		t.Fatalf("Fail to register, result = %d", result)
+	}
+	waitForPort(t, 16722)
+	var kicked map[string]int
+	if status := adminRequest(t, http.MethodPost, admin.URL+"/api/kick?id="+id, "admin-token", &kicked); status != http.StatusOK {
+		t.Fatalf("Fail to kick client, status = %d", status)
+	}
+	if kicked["closed"] != 1 {
+		t.Fatalf("Expect 1 tunnel closed, got %v", kicked)
+	}
+	waitForPortClosed(t, 16722)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if strings.Contains(err.Error(), "timeout") {
+				t.Fatal("Expect tunnel connection to be closed")
+			}
+			break
+		}
+	}
+}
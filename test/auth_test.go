@@ -0,0 +1,155 @@
+package test
+
+import (
+	"bytes"
+	"chuantou/config"
+	"chuantou/core"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试挑战应答鉴权
+
+// 重放其他连接上的应答无效
+func TestChallengeReplay(t *testing.T) {
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16691,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+	})
+	waitForPort(t, 16691)
+
+	id := strings.Repeat("c", 32)
+	conn, err := net.Dial("tcp", "127.0.0.1:16691")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write(helloFrame(core.Version, 2, 2, 9)); err != nil {
+		t.Fatal(err)
+	}
+	nonce := readFields(t, conn)[15]
+	frame := requestFrame(16692, id, "", "", "", proofOf([]byte("winshu"), nonce, id, 16692))
+	if _, err = conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	if result := readFields(t, conn)[1][0]; result != 0 {
+		t.Fatalf("Expect success, got %d", result)
+	}
+
+	// 新连接的随机数不同，原应答失效
+	replay, err := net.Dial("tcp", "127.0.0.1:16691")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	if _, err = replay.Write(helloFrame(core.Version, 2, 2, 9)); err != nil {
+		t.Fatal(err)
+	}
+	if newNonce := readFields(t, replay)[15]; bytes.Equal(nonce, newNonce) {
+		t.Fatal("Expect a fresh nonce for each connection")
+	}
+	if _, err = replay.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	if result := readFields(t, replay)[1][0]; result != 4 {
+		t.Fatalf("Expect replayed proof to fail, got %d", result)
+	}
+}
+
+// 记录中间人转发的数据
+type recorder struct {
+	mutex sync.Mutex
+	data  bytes.Buffer
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.data.Write(p)
+}
+
+func (r *recorder) Contains(sub string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return bytes.Contains(r.data.Bytes(), []byte(sub))
+}
+
+// 客户端与服务端之间的数据不包含密钥，包括短期 key 及形似短期 key 的十六进制共享 Key
+func TestKeyNeverSent(t *testing.T) {
+	echoPort := startEchoServer(t)
+	hexKey := strings.Repeat("0123456789abcdef", 4)
+	trialKey, err := config.NewTrialKey("winshu-trial", time.Now().AddDate(0, 1, 0).Format("2006-01-02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, trialSecret, _ := config.SplitTrialKey(trialKey)
+
+	// 服务端端口、中间人端口、访问端口依次递增
+	cases := []struct {
+		name      string
+		serverKey string
+		clientKey string
+		secrets   []string
+		port      uint32
+	}{
+		{"shared key", "secret-winshu", "secret-winshu", []string{"secret-winshu"}, 16693},
+		{"hex shared key", hexKey, hexKey, []string{hexKey}, 16744},
+		{"trial key", "winshu-trial", trialKey, []string{"winshu-trial", trialSecret}, 16747},
+	}
+	for _, c := range cases {
+		go core.Server(config.ServerConfig{
+			Key:           c.serverKey,
+			Port:          c.port,
+			MinAccessPort: 10000,
+			MaxAccessPort: 20000,
+		})
+		waitForPort(t, c.port)
+
+		// 中间人转发并记录双向数据
+		record := &recorder{}
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", c.port+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func(port uint32) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				server, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+				if err != nil {
+					_ = conn.Close()
+					continue
+				}
+				go func() { _, _ = io.Copy(io.MultiWriter(server, record), conn) }()
+				go func() { _, _ = io.Copy(io.MultiWriter(conn, record), server) }()
+			}
+		}(c.port)
+
+		go core.Client(config.ClientConfig{
+			Key:        c.clientKey,
+			ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: c.port + 1},
+			LocalAddr:  []config.NetAddress{{IP: "127.0.0.1", Port: echoPort, Port2: c.port + 2}},
+		})
+		waitForPort(t, c.port+2)
+		assertEcho(t, c.port+2)
+
+		for _, secret := range c.secrets {
+			if record.Contains(secret) {
+				t.Fatalf("%s: secret %q is sent over the wire", c.name, secret)
+			}
+		}
+		if !record.Contains(fmt.Sprintf("%c", 0x1C)) {
+			t.Fatalf("%s: expect traffic to be recorded", c.name)
+		}
+	}
+}
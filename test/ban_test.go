@@ -0,0 +1,111 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试鉴权失败封禁
+
+// 连接被服务端直接断开，收不到握手回复
+func assertDropped(t *testing.T, port uint32) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write(helloFrame(core.Version, 2, 2, 9))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil || n > 0 {
+		t.Fatal("Expect banned connection to be dropped")
+	}
+}
+
+// 读取封禁列表文件
+func readBanFile(t *testing.T, file string) map[string]time.Time {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var banned []struct {
+		IP    string    `json:"ip"`
+		Bans  int       `json:"bans"`
+		Until time.Time `json:"until"`
+	}
+	if err = json.Unmarshal(data, &banned); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]time.Time)
+	for _, item := range banned {
+		result[fmt.Sprintf("%s#%d", item.IP, item.Bans)] = item.Until
+	}
+	return result
+}
+
+func TestBanAfterFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	banFile := filepath.Join(dir, "banned.json")
+	policy := config.BanConfig{Threshold: 3, Duration: time.Second, File: banFile}
+
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16699,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		Ban:           policy,
+	})
+	waitForPort(t, 16699)
+
+	id := strings.Repeat("e", 32)
+	failTimes := func(times int) {
+		for i := 0; i < times; i++ {
+			conn, result := register(t, 16699, 16701, id, "", "wrong")
+			_ = conn.Close()
+			if result != 4 {
+				t.Fatalf("Expect auth failure, got %d", result)
+			}
+		}
+	}
+
+	// 达到阈值后封禁
+	failTimes(3)
+	assertDropped(t, 16699)
+	if _, exists := readBanFile(t, banFile)["127.0.0.1#1"]; !exists {
+		t.Fatal("Expect ban to be persisted")
+	}
+
+	// 封禁到期后可以再次连接，再次封禁时长加倍
+	time.Sleep(1200 * time.Millisecond)
+	failTimes(3)
+	until, exists := readBanFile(t, banFile)["127.0.0.1#2"]
+	if !exists {
+		t.Fatal("Expect second ban to be persisted")
+	}
+	if remaining := time.Until(until); remaining < 1500*time.Millisecond || remaining > 2*time.Second {
+		t.Fatalf("Expect doubled ban duration, remaining %s", remaining)
+	}
+
+	// 重启后封禁仍然有效
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16700,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		Ban:           policy,
+	})
+	waitForPort(t, 16700)
+	assertDropped(t, 16700)
+}
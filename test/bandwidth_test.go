@@ -0,0 +1,97 @@
+package test
+
+import (
+	"bytes"
+	"chuantou/config"
+	"chuantou/core"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 测试限速
+
+func TestParseBandwidth(t *testing.T) {
+	bandwidth, err := config.ParseBandwidth("512K", "2MB")
+	if err != nil || bandwidth.Rate != 512<<10 || bandwidth.Burst != 2<<20 {
+		t.Fatalf("Unexpected bandwidth %+v %v", bandwidth, err)
+	}
+	if bandwidth.String() != "512K/s burst 2M" {
+		t.Fatalf("Unexpected bandwidth %s", bandwidth)
+	}
+	if _, err = config.ParseBandwidth("1T", ""); err == nil {
+		t.Fatal("Expect illegal size to fail")
+	}
+	addr, ok := config.ParseNetAddress("127.0.0.1:873:10873?bandwidth=1M&burst=2M")
+	if !ok || addr.Bandwidth.Rate != 1<<20 || addr.Bandwidth.Burst != 2<<20 {
+		t.Fatalf("Unexpected address %+v", addr)
+	}
+}
+
+// 经回显服务往返传输数据，返回耗时
+func echoTransfer(t *testing.T, conn net.Conn, size int) time.Duration {
+	payload := bytes.Repeat([]byte("x"), size)
+	start := time.Now()
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		errChan <- err
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	echoPort := startEchoServer(t)
+
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16710,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+	})
+	local, ok := config.ParseNetAddress(fmt.Sprintf("127.0.0.1:%d:16711?bandwidth=256K&burst=64K", echoPort))
+	if !ok {
+		t.Fatal("Fail to parse mapping")
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16710},
+		LocalAddr:  []config.NetAddress{local},
+	})
+	waitForPort(t, 16711)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:16711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 往返共 512K，限速 256K/s，突发 64K
+	if elapsed := echoTransfer(t, conn, 256<<10); elapsed < time.Second {
+		t.Fatalf("Expect transfer to be limited, took %s", elapsed)
+	}
+
+	// 运行中取消映射限速，已建立的连接不断开
+	if !core.SetMappingBandwidth("16711", config.Bandwidth{}) {
+		t.Fatal("Expect mapping to exist")
+	}
+	if elapsed := echoTransfer(t, conn, 1<<20); elapsed > time.Second {
+		t.Fatalf("Expect transfer to be unlimited, took %s", elapsed)
+	}
+
+	// 全局限速同样对已建立的连接生效
+	core.SetBandwidth(config.Bandwidth{Rate: 256 << 10, Burst: 64 << 10})
+	defer core.SetBandwidth(config.Bandwidth{})
+	if elapsed := echoTransfer(t, conn, 256<<10); elapsed < time.Second {
+		t.Fatalf("Expect transfer to be limited globally, took %s", elapsed)
+	}
+}
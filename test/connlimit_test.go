@@ -0,0 +1,132 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 测试访问者连接限制
+
+// 建立连接并完成一次回显，失败时返回错误
+func dialEcho(port uint32) (net.Conn, error) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("hello")); err == nil {
+		_, err = io.ReadFull(conn, make([]byte, 5))
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func TestConnectionLimit(t *testing.T) {
+	echoPort := startEchoServer(t)
+
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16712,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+	})
+	var locals []config.NetAddress
+	for _, item := range []string{
+		"127.0.0.1:%d:16713?max-conns=2",
+		"127.0.0.1:%d:16714?max-conns=1&queue=3s",
+		"127.0.0.1:%d:16715?conn-rate=2",
+	} {
+		local, ok := config.ParseNetAddress(fmt.Sprintf(item, echoPort))
+		if !ok {
+			t.Fatalf("Fail to parse mapping %s", item)
+		}
+		locals = append(locals, local)
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16712},
+		LocalAddr:  locals,
+	})
+	for _, port := range []uint32{16713, 16714, 16715} {
+		waitForPort(t, port)
+	}
+
+	// 超出同时连接数立即拒绝，释放后可以再次连接
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := dialEcho(16713)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	if conn, err := dialEcho(16713); err == nil {
+		_ = conn.Close()
+		t.Fatal("Expect third connection to be rejected")
+	}
+	stats, ok := core.ConnectionStats("16713")
+	// waitForPort 的连接也计入接受的连接数
+	if !ok || stats.Active != 2 || stats.Accepted != 3 || stats.Rejected != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	closeConns(conns...)
+	time.Sleep(200 * time.Millisecond)
+	if conn, err := dialEcho(16713); err != nil {
+		t.Fatal(err)
+	} else {
+		_ = conn.Close()
+	}
+
+	// 排队等待，前一个连接关闭后继续
+	first, err := dialEcho(16714)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		_ = first.Close()
+	}()
+	start := time.Now()
+	second, err := dialEcho(16714)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = second.Close()
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("Expect second connection to be queued, took %s", elapsed)
+	}
+
+	// 超出新建连接速率立即拒绝，先等待令牌补满
+	time.Sleep(1100 * time.Millisecond)
+	rejected := 0
+	for i := 0; i < 3; i++ {
+		if conn, err := dialEcho(16715); err != nil {
+			rejected++
+		} else {
+			_ = conn.Close()
+		}
+	}
+	if stats, _ = core.ConnectionStats("16715"); rejected != 1 || stats.Rejected != 1 {
+		t.Fatalf("Expect one connection to be rejected, got %d %+v", rejected, stats)
+	}
+
+	addr, ok := config.ParseNetAddress("127.0.0.1:3389:13389?max-conns=10&conn-rate=5&queue=5s")
+	if !ok || addr.ConnLimit.String() != "max 10 rate 5/s queue 5s" {
+		t.Fatalf("Unexpected conn limit %+v", addr.ConnLimit)
+	}
+}
+
+func closeConns(conns ...net.Conn) {
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
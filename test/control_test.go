@@ -0,0 +1,116 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 测试本地控制台
+
+// 执行控制命令，失败时终止测试
+func control(t *testing.T, socket string, args ...string) string {
+	output, err := core.Control(socket, args)
+	if err != nil {
+		t.Fatalf("Fail to execute %v. %s", args, err.Error())
+	}
+	return output
+}
+
+// 注册隧道，失败时终止测试
+func mustRegister(t *testing.T, accessPort uint32, id string) net.Conn {
+	conn, result := register(t, 16731, accessPort, id, "frank", "frank-secret")
+	if result != 0 {
+		t.Fatalf("Fail to register %d, result = %d", accessPort, result)
+	}
+	waitForPort(t, accessPort)
+	return conn
+}
+
+func TestControlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	usersFile := filepath.Join(dir, "users.ini")
+	if err = ioutil.WriteFile(usersFile, []byte("[frank]\nsecret = frank-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := config.LoadUserStore(usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "chuantou.sock")
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16731,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		UsersFile:     usersFile,
+		Users:         users,
+		ControlSocket: socket,
+	})
+	waitForPort(t, 16731)
+
+	kickID, closeID, reloadID := strings.Repeat("1", 32), strings.Repeat("2", 32), strings.Repeat("3", 32)
+	for port, id := range map[uint32]string{16732: kickID, 16733: closeID, 16734: reloadID} {
+		conn := mustRegister(t, port, id)
+		defer conn.Close()
+	}
+
+	// 只有运行服务端的用户可以连接
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm()&0077 != 0 {
+		t.Fatalf("Expect the control socket to be private, %v %v", info, err)
+	}
+
+	// 映射及客户端列表
+	ports := control(t, socket, "ports")
+	if !strings.HasPrefix(ports, "MAPPING") || !strings.Contains(ports, "16732") || !strings.Contains(ports, "frank") {
+		t.Fatalf("Unexpected ports\n%s", ports)
+	}
+	if clients := control(t, socket, "clients"); !strings.Contains(clients, kickID) || !strings.Contains(clients, reloadID) {
+		t.Fatalf("Unexpected clients\n%s", clients)
+	}
+	if stats := control(t, socket, "stats"); !strings.Contains(stats, "mappings") || !strings.Contains(stats, "banned ips") {
+		t.Fatalf("Unexpected stats\n%s", stats)
+	}
+
+	// 关闭映射及踢出客户端
+	if _, err = core.Control(socket, []string{"close", "16799"}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("Expect not found error, got %v", err)
+	}
+	control(t, socket, "close", "16733")
+	waitForPortClosed(t, 16733)
+	if output := control(t, socket, "kick", kickID); !strings.Contains(output, "Closed 1 tunnels") {
+		t.Fatalf("Unexpected kick output %q", output)
+	}
+	waitForPortClosed(t, 16732)
+
+	// 停用用户后重新加载，关闭该用户的隧道
+	if err = ioutil.WriteFile(usersFile, []byte("[frank]\nsecret = frank-secret\nenabled = false\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if output := control(t, socket, "reload"); !strings.Contains(output, "closed 1 tunnels") {
+		t.Fatalf("Unexpected reload output %q", output)
+	}
+	waitForPortClosed(t, 16734)
+
+	// 封禁后新的隧道连接直接断开
+	if _, err = core.Control(socket, []string{"ban", "not-an-ip"}); err == nil {
+		t.Fatal("Expect illegal ip error")
+	}
+	if output := control(t, socket, "ban", "127.0.0.1", "1m"); !strings.Contains(output, "Banned 127.0.0.1 for 1m0s") {
+		t.Fatalf("Unexpected ban output %q", output)
+	}
+	assertDropped(t, 16731)
+
+	if _, err = core.Control(socket, []string{"unknown"}); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Fatalf("Expect unknown command error, got %v", err)
+	}
+}
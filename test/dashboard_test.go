@@ -0,0 +1,149 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 测试网页控制台
+
+// 请求控制台，返回状态码及响应内容，origin 不为空时作为请求来源
+func dashboardRequest(t *testing.T, method, url, password string, origin ...string) (int, []byte) {
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "" {
+		request.SetBasicAuth("admin", password)
+	}
+	if len(origin) > 0 {
+		request.Header.Set("Origin", origin[0])
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, body
+}
+
+func TestDashboard(t *testing.T) {
+	echoPort := startEchoServer(t)
+	cfg := config.ServerConfig{
+		Key:               "winshu",
+		Port:              16728,
+		MinAccessPort:     10000,
+		MaxAccessPort:     20000,
+		DashboardPassword: "dashboard-password",
+	}
+	go core.Server(cfg)
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16728},
+		LocalAddr:  []config.NetAddress{{IP: "127.0.0.1", Port: echoPort, Port2: 16729}},
+	})
+	waitForPort(t, 16729)
+	assertEcho(t, 16729)
+	id := strings.Repeat("d", 32)
+	conn, result := register(t, 16728, 16730, id, "", "wrong-key")
+	_ = conn.Close()
+	if result != 4 {
+		t.Fatalf("Expect auth failure, result = %d", result)
+	}
+
+	dashboard := httptest.NewServer(core.DashboardHandler(cfg))
+	defer dashboard.Close()
+
+	// 未认证或密码错误
+	for _, password := range []string{"", "wrong"} {
+		if status, _ := dashboardRequest(t, http.MethodGet, dashboard.URL+"/", password); status != http.StatusUnauthorized {
+			t.Fatalf("Expect 401 with password %q, got %d", password, status)
+		}
+	}
+
+	// 页面及脚本编译在程序中
+	status, body := dashboardRequest(t, http.MethodGet, dashboard.URL+"/", "dashboard-password")
+	if status != http.StatusOK || !strings.Contains(string(body), "app.js") {
+		t.Fatalf("Fail to load dashboard, status = %d", status)
+	}
+	if status, _ = dashboardRequest(t, http.MethodGet, dashboard.URL+"/app.js", "dashboard-password"); status != http.StatusOK {
+		t.Fatalf("Fail to load app.js, status = %d", status)
+	}
+
+	// 概览，其它测试的隧道及事件也在其中
+	status, body = dashboardRequest(t, http.MethodGet, dashboard.URL+"/dashboard/api/overview", "dashboard-password")
+	if status != http.StatusOK {
+		t.Fatalf("Fail to get overview, status = %d", status)
+	}
+	var overview struct {
+		Tunnels      []core.TunnelInfo `json:"tunnels"`
+		Clients      []core.ClientInfo `json:"clients"`
+		Visitors     []core.Event      `json:"visitors"`
+		AuthFailures []core.Event      `json:"auth_failures"`
+	}
+	if err := json.Unmarshal(body, &overview); err != nil {
+		t.Fatal(err)
+	}
+	var clientID string
+	for _, tunnel := range overview.Tunnels {
+		if tunnel.Key == "16729" {
+			clientID = tunnel.ClientID
+			if tunnel.Transferred < 10 {
+				t.Fatalf("Expect live transferred bytes, got %+v", tunnel)
+			}
+		}
+	}
+	if clientID == "" {
+		t.Fatalf("Tunnel 16729 not found in %v", overview.Tunnels)
+	}
+	foundClient := false
+	for _, client := range overview.Clients {
+		if client.ID == clientID {
+			foundClient = true
+		}
+	}
+	if !foundClient {
+		t.Fatalf("Client %s not found in %v", clientID, overview.Clients)
+	}
+	foundVisitor := false
+	for _, event := range overview.Visitors {
+		if event.Mapping == "16729" && event.Result == "accepted" {
+			foundVisitor = true
+		}
+	}
+	if !foundVisitor {
+		t.Fatalf("Visitor of 16729 not found in %v", overview.Visitors)
+	}
+	foundFailure := false
+	for _, event := range overview.AuthFailures {
+		if event.ClientID == id && event.Code == 4 && event.Mapping == "16730" {
+			foundFailure = true
+		}
+	}
+	if !foundFailure {
+		t.Fatalf("Auth failure of %s not found in %v", id, overview.AuthFailures)
+	}
+
+	// 跨站或未携带来源的请求被拒绝，防止其他网站借用浏览器保存的认证信息
+	for _, origin := range []string{"http://evil.example", "null", ""} {
+		if status, _ = dashboardRequest(t, http.MethodPost, dashboard.URL+"/dashboard/api/close?key=16729", "dashboard-password", origin); status != http.StatusForbidden {
+			t.Fatalf("Expect 403 for origin %q, got %d", origin, status)
+		}
+	}
+
+	// 关闭映射
+	if status, _ = dashboardRequest(t, http.MethodPost, dashboard.URL+"/dashboard/api/close?key=16729", "dashboard-password", dashboard.URL); status != http.StatusOK {
+		t.Fatalf("Fail to close tunnel, status = %d", status)
+	}
+	waitForPortClosed(t, 16729)
+}
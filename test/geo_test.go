@@ -0,0 +1,136 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"chuantou/geo"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试国家 IP 库及国家策略
+
+func TestGeoDatabase(t *testing.T) {
+	files, err := geo.ParseFiles("../cn_ips.txt")
+	if err != nil || files["CN"] != "../cn_ips.txt" {
+		t.Fatalf("Unexpected files %v %v", files, err)
+	}
+	db, err := geo.Load(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 与线性查找的结果一致
+	for _, ip := range []string{"39.184.149.118", "121.17.142.60", "45.141.87.9", "1.0.1.0", "1.0.1.255", "1.0.3.0", "8.8.8.8"} {
+		if db.Contains("cn", net.ParseIP(ip)) != IsCnIp(ip) {
+			t.Fatalf("Unexpected result of %s", ip)
+		}
+	}
+	if !db.Contains("CN", net.ParseIP("39.184.149.118")) || db.Contains("CN", net.ParseIP("45.141.87.9")) {
+		t.Fatal("Unexpected cn ip")
+	}
+
+	ranges, err := geo.ParseRanges(strings.NewReader("# test\n10.0.0.0,256\n10.0.1.0,256\n2001:db8::/32\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[0].String() != "10.0.0.0~10.0.1.255" {
+		t.Fatalf("Expect adjacent ranges to be merged, got %v", ranges)
+	}
+	db = geo.New(map[string][]geo.Range{"xx": ranges})
+	for ip, expect := range map[string]bool{"10.0.1.8": true, "10.0.2.0": false, "2001:db8:ffff::1": true, "2001:db9::": false} {
+		if db.Contains("XX", net.ParseIP(ip)) != expect {
+			t.Fatalf("Expect %s in XX = %v", ip, expect)
+		}
+	}
+
+	policy, err := geo.ParsePolicy("", "xx")
+	if err != nil || policy.Check(db) != nil {
+		t.Fatalf("Unexpected policy %v %v", policy, err)
+	}
+	if policy.Allowed(db, net.ParseIP("10.0.0.1")) || !policy.Allowed(db, net.ParseIP("8.8.8.8")) {
+		t.Fatal("Unexpected deny policy result")
+	}
+	if policy, _ = geo.ParsePolicy("CN", ""); policy.Check(db) == nil {
+		t.Fatal("Expect unknown country to fail")
+	}
+}
+
+func TestGeoPolicy(t *testing.T) {
+	echoPort := startEchoServer(t)
+	dir, err := ioutil.TempDir("", "geo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// 用 LO 表示本机地址，便于测试
+	loFile := filepath.Join(dir, "lo_ips.txt")
+	if err = ioutil.WriteFile(loFile, []byte("127.0.0.0,16777216\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := geo.ParseFiles("../cn_ips.txt," + loFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := geo.Load(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16706,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		HeartBeat:     time.Second,
+		GeoIP:         db,
+	})
+
+	var locals []config.NetAddress
+	for _, item := range []string{
+		"127.0.0.1:%d:16707?geo-deny=CN",
+		"127.0.0.1:%d:16708?geo-allow=CN",
+		"127.0.0.1:%d:16709?geo-allow=LO",
+	} {
+		local, ok := config.ParseNetAddress(fmt.Sprintf(item, echoPort))
+		if !ok {
+			t.Fatalf("Fail to parse mapping %s", item)
+		}
+		locals = append(locals, local)
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16706},
+		LocalAddr:  locals,
+	})
+
+	for _, port := range []uint32{16707, 16708, 16709} {
+		waitForPort(t, port)
+	}
+	assertEcho(t, 16707)
+	assertRejected(t, 16708)
+	assertEcho(t, 16709)
+
+	// 修改文件后在下次心跳时重新加载，已注册的映射立即生效
+	time.Sleep(10 * time.Millisecond)
+	if err = ioutil.WriteFile(loFile, []byte("10.0.0.0,256\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Contains("LO", net.ParseIP("127.0.0.1")) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expect geoip file to be reloaded")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assertRejected(t, 16709)
+
+	if _, ok := config.ParseNetAddress("127.0.0.1:3306?geo-allow=C1"); ok {
+		t.Fatal("Expect illegal country to fail")
+	}
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"bytes"
+	"chuantou/geo"
+	"net"
+	"os"
+	"testing"
+)
+
+// 测试由 delegated 统计文件生成国家 IP 段文件
+
+func TestParseDelegated(t *testing.T) {
+	f, err := os.Open("testdata/delegated-apnic-sample.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	result, err := geo.ParseDelegated(f, []string{"cn", "JP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := result["AU"]; exists {
+		t.Fatal("Unexpected country AU")
+	}
+
+	// 相邻的段合并，未分配的段忽略，IPv6 按前缀长度计算
+	var buffer bytes.Buffer
+	if err = geo.WriteRanges(&buffer, result["CN"]); err != nil {
+		t.Fatal(err)
+	}
+	expect := "1.0.1.0,768\n1.0.8.0,2048\n1.0.32.0,1280\n2001:250::/34\n"
+	if buffer.String() != expect {
+		t.Fatalf("Unexpected cn ranges\n%s", buffer.String())
+	}
+
+	// 生成的文件可以被国家 IP 库加载
+	ranges, err := geo.ParseRanges(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := geo.New(map[string][]geo.Range{"CN": ranges, "JP": result["JP"]})
+	for ip, country := range map[string]string{
+		"1.0.3.255":        "CN",
+		"1.0.36.255":       "CN",
+		"2001:250:3fff::1": "CN",
+		"1.0.16.1":         "JP",
+		"2001:200::1":      "JP",
+	} {
+		if !db.Contains(country, net.ParseIP(ip)) {
+			t.Fatalf("Expect %s in %s", ip, country)
+		}
+	}
+	for _, ip := range []string{"1.0.0.1", "1.0.4.0", "1.0.37.0", "1.0.64.1", "2001:250:4000::"} {
+		if db.Contains("CN", net.ParseIP(ip)) {
+			t.Fatalf("Unexpected %s in CN", ip)
+		}
+	}
+}
+
+func TestWriteIPv6Ranges(t *testing.T) {
+	var ranges []geo.Range
+	for _, cidr := range []string{"2001:db8:1::/48", "2001:db8:2::/48", "2001:db8:3::/48", "2001:db8:4::/48"} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		ranges = append(ranges, geo.CIDRRange(ipNet))
+	}
+	var buffer bytes.Buffer
+	if err := geo.WriteRanges(&buffer, geo.Merge(ranges)); err != nil {
+		t.Fatal(err)
+	}
+	expect := "2001:db8:1::/48\n2001:db8:2::/47\n2001:db8:4::/48\n"
+	if buffer.String() != expect {
+		t.Fatalf("Unexpected ipv6 ranges\n%s", buffer.String())
+	}
+}
@@ -0,0 +1,206 @@
+package test
+
+import (
+	"bufio"
+	"chuantou/config"
+	"chuantou/logging"
+	"encoding/json"
+	"github.com/go-ini/ini"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 测试结构化日志
+
+// 读取 JSON 日志文件，每行一条记录
+func readJSONLog(t *testing.T, file string) []map[string]interface{} {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := make(map[string]interface{})
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Illegal json line %q. %s", scanner.Text(), err.Error())
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// 查找消息为 msg 的记录
+func findRecord(records []map[string]interface{}, msg string) map[string]interface{} {
+	for _, record := range records {
+		if record["msg"] == msg {
+			return record
+		}
+	}
+	return nil
+}
+
+func TestLogJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "chuantou.log")
+	if err = logging.Setup(logging.Config{Level: logging.LevelInfo, Format: logging.FormatJSON, File: file, Debug: []string{"heartbeat"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer logging.Reset()
+
+	logging.New("tunnel").Info("Register port", "port", 13306, "client_id", "abc", "remote", "1.2.3.4:5678")
+	logging.New("tunnel").Debug("Hidden debug")
+	logging.New("heartbeat").Debug("Check tunnels", "checked", 2)
+	logging.New("auth").Warn("Illegal request", "result_code", 4)
+	log.Println("Plain log line")
+
+	records := readJSONLog(t, file)
+	register := findRecord(records, "Register port")
+	if register == nil || register["level"] != "info" || register["subsystem"] != "tunnel" ||
+		register["port"] != float64(13306) || register["client_id"] != "abc" || register["time"] == nil {
+		t.Fatalf("Unexpected register record %v", register)
+	}
+	if findRecord(records, "Hidden debug") != nil {
+		t.Fatal("Debug log of tunnel should be filtered")
+	}
+	if heartbeat := findRecord(records, "Check tunnels"); heartbeat == nil || heartbeat["level"] != "debug" {
+		t.Fatalf("Expect heartbeat debug log, got %v", heartbeat)
+	}
+	if illegal := findRecord(records, "Illegal request"); illegal == nil || illegal["level"] != "warn" || illegal["result_code"] != float64(4) {
+		t.Fatalf("Unexpected warn record %v", illegal)
+	}
+	if plain := findRecord(records, "Plain log line"); plain == nil || plain["level"] != "info" {
+		t.Fatalf("Expect standard log redirected, got %v", plain)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "chuantou.log")
+	if err = logging.Setup(logging.Config{Level: logging.LevelWarn, File: file}); err != nil {
+		t.Fatal(err)
+	}
+	defer logging.Reset()
+
+	logging.New("dial").Info("Dial success", "target", "127.0.0.1:3306")
+	logging.New("dial").Error("Dial failed", "target", "127.0.0.1:3306", "error", "connection refused")
+	log.Println("Plain log line")
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(content)
+	if strings.Contains(text, "Dial success") || strings.Contains(text, "Plain log line") {
+		t.Fatalf("Info logs should be filtered\n%s", text)
+	}
+	if !strings.Contains(text, `ERROR [dial] Dial failed target=127.0.0.1:3306 error="connection refused"`) {
+		t.Fatalf("Unexpected text log\n%s", text)
+	}
+}
+
+// 致命错误不受日志级别影响，在子进程中执行后检查日志
+func TestLogFatal(t *testing.T) {
+	if file := os.Getenv("CHUANTOU_FATAL_LOG"); file != "" {
+		if err := logging.Setup(logging.Config{Level: logging.LevelError, File: file}); err != nil {
+			t.Fatal(err)
+		}
+		logging.New("client").Fatal("Fail to auth. exit", "port", 13306, "result_code", 4)
+		return
+	}
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "chuantou.log")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLogFatal$")
+	cmd.Env = append(os.Environ(), "CHUANTOU_FATAL_LOG="+file)
+	if err = cmd.Run(); err == nil {
+		t.Fatal("Expect the process to exit with an error")
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `ERROR [client] Fail to auth. exit port=13306 result_code=4`) {
+		t.Fatalf("Unexpected fatal log\n%s", content)
+	}
+}
+
+func TestLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "chuantou.log")
+	if err = logging.Setup(logging.Config{Format: logging.FormatJSON, File: file, MaxSize: 512, MaxBackups: 2}); err != nil {
+		t.Fatal(err)
+	}
+	defer logging.Reset()
+
+	logger := logging.New("forward")
+	for i := 0; i < 50; i++ {
+		logger.Info("Rotate test", "index", i)
+	}
+	for _, name := range []string{file, file + ".1", file + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Expect %s. %s", name, err.Error())
+		}
+		if info.Size() > 512 {
+			t.Fatalf("%s is larger than max size, %d", name, info.Size())
+		}
+	}
+	if _, err = os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("Expect at most 2 backups, got %v", err)
+	}
+	// 最新的记录在当前文件中
+	found := false
+	for _, record := range readJSONLog(t, file) {
+		if record["index"] == float64(49) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Expect the latest record in the current file")
+	}
+}
+
+func TestParseLogConfig(t *testing.T) {
+	cfg, err := ini.Load([]byte("[log]\nlevel = debug\nformat = json\nfile = chuantou.log\nmax-size = 1M\nmax-backups = 3\ndebug = heartbeat, Dial\n" +
+		"access = true\naccess-file = access.log\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logConfig, err := config.ParseLogConfig(cfg.Section("log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logConfig.Level != logging.LevelDebug || logConfig.Format != logging.FormatJSON || logConfig.File != "chuantou.log" ||
+		logConfig.MaxSize != 1<<20 || logConfig.MaxBackups != 3 || strings.Join(logConfig.Debug, ",") != "heartbeat,dial" ||
+		!logConfig.Access || logConfig.AccessFile != "access.log" {
+		t.Fatalf("Unexpected log config %+v", logConfig)
+	}
+	for _, content := range []string{"[log]\nlevel = verbose\n", "[log]\nformat = xml\n", "[log]\nmax-size = big\n", "[log]\naccess-format = csv\n"} {
+		cfg, _ = ini.Load([]byte(content))
+		if _, err = config.ParseLogConfig(cfg.Section("log")); err == nil {
+			t.Fatalf("Expect error for %q", content)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"bufio"
+	"chuantou/config"
+	"chuantou/core"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试 Prometheus 指标
+
+// 抓取指标，返回 序列 -> 值，序列如 chuantou_tunnel_connections{mapping="16724"}
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Fail to scrape metrics, status = %d", response.StatusCode)
+	}
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("Unexpected content type %s", response.Header.Get("Content-Type"))
+	}
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		index := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[index+1:], 64)
+		if err != nil {
+			t.Fatalf("Illegal sample %q", line)
+		}
+		samples[line[:index]] = value
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	echoPort := startEchoServer(t)
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16723,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		HTTPPort:      16743,
+	})
+	// 域名映射的访问端口都为 0，按域名区分
+	webPort := startWebServer(t, "metrics")
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16723},
+		LocalAddr: []config.NetAddress{
+			{IP: "127.0.0.1", Port: echoPort, Port2: 16724},
+			{IP: "127.0.0.1", Port: webPort, Domain: "metrics1.example.com"},
+			{IP: "127.0.0.1", Port: webPort, Domain: "metrics2.example.com"},
+		},
+	})
+	waitForPort(t, 16724)
+	assertEcho(t, 16724)
+
+	// 鉴权失败
+	conn, result := register(t, 16723, 16725, strings.Repeat("f", 32), "", "wrong-key")
+	_ = conn.Close()
+	if result != 4 {
+		t.Fatalf("Expect auth failure, result = %d", result)
+	}
+	// 服务端不可达，客户端重拨
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16726},
+		LocalAddr:  []config.NetAddress{{IP: "127.0.0.1", Port: echoPort, Port2: 16727}},
+	})
+
+	metrics := httptest.NewServer(core.MetricsHandler())
+	defer metrics.Close()
+
+	// 服务端与客户端在同一进程中，同一映射的指标为两端之和
+	var samples map[string]float64
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		samples = scrapeMetrics(t, metrics.URL)
+		if samples[`chuantou_transfer_bytes_total{mapping="16724",direction="out"}`] >= 5 &&
+			samples[`chuantou_dial_retries_total{target="127.0.0.1:16726"}`] >= 1 &&
+			samples[`chuantou_tunnel_connections{mapping="metrics1.example.com"}`] == 2 &&
+			samples[`chuantou_tunnel_connections{mapping="metrics2.example.com"}`] == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Transfer and dial retries not recorded, samples = %v", samples)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	expects := []string{
+		`chuantou_registered_ports`,
+		`chuantou_tunnel_connections{mapping="16724"}`,
+		`chuantou_visitor_connections_total{mapping="16724",result="accepted"}`,
+		`chuantou_transfer_bytes_total{mapping="16724",direction="in"}`,
+		`chuantou_auth_failures_total{code="4"}`,
+		`chuantou_handshake_duration_seconds_count`,
+		`chuantou_handshake_duration_seconds_bucket{le="+Inf"}`,
+	}
+	for _, series := range expects {
+		if samples[series] < 1 {
+			t.Fatalf("Expect %s >= 1, samples = %v", series, samples)
+		}
+	}
+	// 没有标签的计数器从 0 开始输出
+	if _, exists := samples[`chuantou_heartbeat_failures_total`]; !exists {
+		t.Fatalf("Expect heartbeat failures, samples = %v", samples)
+	}
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"bytes"
+	"chuantou/config"
+	"chuantou/core"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试多路复用隧道
+
+// 启动本地回显服务，返回监听端口
+func startEchoServer(t *testing.T) uint32 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}(conn)
+		}
+	}()
+	return uint32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// 等待访问端口可用
+func waitForPort(t *testing.T, port uint32) {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+			_ = conn.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Access port %d is not available", port)
+}
+
+func TestMuxConcurrentVisitors(t *testing.T) {
+	echoPort := startEchoServer(t)
+
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16661,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+	})
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16661},
+		LocalAddr:  []config.NetAddress{{IP: "127.0.0.1", Port: echoPort, Port2: 16662}},
+	})
+	waitForPort(t, 16662)
+
+	// 访问者数量远超原连接池上限
+	var wg sync.WaitGroup
+	errChan := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", "127.0.0.1:16662")
+			if err != nil {
+				errChan <- err
+				return
+			}
+			defer conn.Close()
+
+			payload := bytes.Repeat([]byte{byte(i)}, 512*1024)
+			go func() {
+				_, _ = conn.Write(payload)
+			}()
+			received := make([]byte, len(payload))
+			_ = conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+			if _, err := io.ReadFull(conn, received); err != nil {
+				errChan <- err
+				return
+			}
+			if !bytes.Equal(payload, received) {
+				errChan <- fmt.Errorf("visitor %d received corrupted data", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errChan)
+
+	for err := range errChan {
+		t.Error(err)
+	}
+}
@@ -34,7 +34,7 @@ func TestClient(t *testing.T) {
 			IP: "127.0.0.1", Port: 6666,
 		},
 		LocalAddr: []config.NetAddress{
-			{"127.0.0.1", 3306, 13306},
+			{IP: "127.0.0.1", Port: 3306, Port2: 13306},
 		},
 		TunnelCount: 1,
 	}
@@ -65,7 +65,7 @@ func TestClient2(t *testing.T) {
 			IP: "127.0.0.1", Port: 6666,
 		},
 		LocalAddr: []config.NetAddress{
-			{"127.0.0.1", 3306, 13306},
+			{IP: "127.0.0.1", Port: 3306, Port2: 13306},
 		},
 		TunnelCount: 1,
 	}
@@ -0,0 +1,162 @@
+package test
+
+import (
+	"bytes"
+	"chuantou/config"
+	"chuantou/core"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试协议兼容性
+
+// 1.4.x 客户端收到旧格式的版本不匹配结果
+func TestLegacyClientVersionMismatch(t *testing.T) {
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16667,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+	})
+	waitForPort(t, 16667)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:16667")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 旧版协议：长度|结果|版本号|访问端口|machineid|Key
+	body := bytes.NewBuffer([]byte{})
+	body.WriteByte(0)
+	_ = binary.Write(body, binary.BigEndian, uint32(140))
+	_ = binary.Write(body, binary.BigEndian, uint32(13306))
+	body.WriteString(strings.Repeat("a", 32))
+	body.WriteString("winshu")
+	if _, err = conn.Write(append([]byte{byte(body.Len())}, body.Bytes()...)); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	length := make([]byte, 1)
+	if _, err = io.ReadFull(conn, length); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, length[0])
+	if _, err = io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response) < 42 || response[0] != 5 {
+		t.Fatalf("Expect version mismatch, got %v", response)
+	}
+	if bytes.Contains(response, []byte("winshu")) {
+		t.Fatal("Key is sent back to the client")
+	}
+}
+
+// Key 超过旧协议 255 字节上限时仍能注册
+func TestLongKey(t *testing.T) {
+	key := strings.Repeat("k", 300)
+	echoPort := startEchoServer(t)
+
+	go core.Server(config.ServerConfig{
+		Key:           key,
+		Port:          16668,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+	})
+	go core.Client(config.ClientConfig{
+		Key:        key,
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16668},
+		LocalAddr:  []config.NetAddress{{IP: "127.0.0.1", Port: echoPort, Port2: 16669}},
+	})
+	waitForPort(t, 16669)
+	assertEcho(t, 16669)
+}
+
+// 构造握手帧：标识|帧版本|帧类型|内容长度|内容
+func helloFrame(version, minProtocol, maxProtocol, features uint32) []byte {
+	body := bytes.NewBuffer([]byte{})
+	writeField := func(fieldType byte, value []byte) {
+		body.WriteByte(fieldType)
+		_ = binary.Write(body, binary.BigEndian, uint16(len(value)))
+		body.Write(value)
+	}
+	writeUint32 := func(fieldType byte, value uint32) {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, value)
+		writeField(fieldType, data)
+	}
+	writeField(1, []byte{0})
+	writeUint32(2, version)
+	writeUint32(6, minProtocol)
+	writeUint32(7, maxProtocol)
+	writeUint32(8, features)
+
+	frame := bytes.NewBuffer([]byte{0x1C, 0xC7, 1, 2})
+	_ = binary.Write(frame, binary.BigEndian, uint32(body.Len()))
+	frame.Write(body.Bytes())
+	return frame.Bytes()
+}
+
+// 发送握手帧，返回服务端回复的结果
+func exchangeHello(t *testing.T, port uint32, frame []byte) byte {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 8)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x1C || header[1] != 0xC7 || header[3] != 2 {
+		t.Fatalf("Unexpected hello header %v", header)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[4:8]))
+	if _, err = io.ReadFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	// 第一个字段为结果
+	if len(body) < 4 || body[0] != 1 {
+		t.Fatalf("Unexpected hello body %v", body)
+	}
+	return body[3]
+}
+
+func TestHelloNegotiation(t *testing.T) {
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16670,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+	})
+	waitForPort(t, 16670)
+
+	// 小版本号不同不影响连接
+	if result := exchangeHello(t, 16670, helloFrame(core.Version+1, 2, 5, 9)); result != 0 {
+		t.Fatalf("Expect success for patch-level difference, got %d", result)
+	}
+	// 没有共同支持的协议版本
+	if result := exchangeHello(t, 16670, helloFrame(core.Version, 9, 9, 9)); result != 5 {
+		t.Fatalf("Expect version mismatch, got %d", result)
+	}
+	// 缺少必需的多路复用特性
+	if result := exchangeHello(t, 16670, helloFrame(core.Version, 2, 2, 8)); result != 5 {
+		t.Fatalf("Expect version mismatch, got %d", result)
+	}
+	// 缺少必需的挑战应答特性，密钥不能明文传输
+	if result := exchangeHello(t, 16670, helloFrame(core.Version, 2, 2, 1)); result != 5 {
+		t.Fatalf("Expect version mismatch, got %d", result)
+	}
+}
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"bufio"
+	"chuantou/config"
+	"chuantou/core"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试 PROXY 协议
+
+// 启动本地服务，解析 PROXY 协议头后将访问者地址写回
+func startProxyProtocolServer(t *testing.T) uint32 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				_, _ = conn.Write([]byte(readProxyHeader(reader) + "\n"))
+			}(conn)
+		}
+	}()
+	return uint32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// 读取 PROXY 协议头，返回访问者地址
+func readProxyHeader(reader *bufio.Reader) string {
+	peek, err := reader.Peek(6)
+	if err != nil {
+		return "error"
+	}
+	if string(peek) == "PROXY " {
+		line, _ := reader.ReadString('\n')
+		fields := strings.Fields(line)
+		if len(fields) != 6 {
+			return "v1 " + strings.TrimSpace(line)
+		}
+		return fmt.Sprintf("v1 %s:%s", fields[2], fields[4])
+	}
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return "error"
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err = io.ReadFull(reader, body); err != nil || header[13] != 0x11 {
+		return "error"
+	}
+	return fmt.Sprintf("v2 %s:%d", net.IP(body[:4]).String(), binary.BigEndian.Uint16(body[8:]))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	localPort := startProxyProtocolServer(t)
+
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16677,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+	})
+
+	var locals []config.NetAddress
+	for i, version := range []string{"v1", "v2"} {
+		local, ok := config.ParseNetAddress(fmt.Sprintf("127.0.0.1:%d:%d?proxy=%s", localPort, 16678+i, version))
+		if !ok {
+			t.Fatalf("Fail to parse mapping with proxy=%s", version)
+		}
+		locals = append(locals, local)
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16677},
+		LocalAddr:  locals,
+	})
+
+	for i, version := range []string{"v1", "v2"} {
+		port := uint32(16678 + i)
+		waitForPort(t, port)
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := fmt.Sprintf("%s %s", version, conn.LocalAddr().String())
+		if strings.TrimSpace(line) != expect {
+			t.Fatalf("Unexpected visitor %q, expect %q", strings.TrimSpace(line), expect)
+		}
+		_ = conn.Close()
+	}
+
+	if _, ok := config.ParseNetAddress("127.0.0.1:80?proxy=v3"); ok {
+		t.Fatal("Expect unknown proxy protocol version to fail")
+	}
+}
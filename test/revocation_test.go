@@ -0,0 +1,193 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试令牌吊销
+
+// 等待访问端口关闭
+func waitForPortClosed(t *testing.T, port uint32) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Access port %d is still open", port)
+}
+
+func TestRevocationList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "revoked.txt")
+
+	// 文件不存在时为空列表
+	list, err := config.LoadRevocationList(file)
+	if err != nil || list.Len() != 0 {
+		t.Fatalf("Unexpected revocation list %v %v", list, err)
+	}
+	if err = list.Revoke("id1", "leaked\nkey"); err != nil {
+		t.Fatal(err)
+	}
+	if err = list.Revoke("bad id", ""); err == nil {
+		t.Fatal("Expect illegal token id to fail")
+	}
+	if _, err = config.RevokeToken(file, "id2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if list.Revoked("id2") {
+		t.Fatal("Expect list to be stale before reload")
+	}
+	// 其他进程修改文件后重新加载
+	time.Sleep(10 * time.Millisecond)
+	if err = list.ReloadIfModified(); err != nil {
+		t.Fatal(err)
+	}
+	if !list.Revoked("id1") || !list.Revoked("id2") || list.Revoked("id3") {
+		t.Fatal("Unexpected revoked ids")
+	}
+	content, _ := ioutil.ReadFile(file)
+	if string(content) != "id1 leaked key\nid2\n" {
+		t.Fatalf("Unexpected revocation file %q", content)
+	}
+
+	// 文件删除后视为空列表
+	if err = os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err = list.ReloadIfModified(); err != nil {
+		t.Fatal(err)
+	}
+	if list.Len() != 0 || list.Revoked("id1") {
+		t.Fatal("Expect revocations to be cleared after the file is removed")
+	}
+}
+
+func TestRevokeLiveTunnel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "revoked.txt")
+
+	privateKey, _ := generateTokenKey(t)
+	newToken := func(id string, expiry time.Duration) string {
+		token, err := config.NewToken(privateKey, config.TokenClaims{ID: id, Subject: id, ExpiresAt: time.Now().Add(expiry).Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	if _, err = config.RevokeToken(file, "revoked", "test"); err != nil {
+		t.Fatal(err)
+	}
+	revocations, err := config.LoadRevocationList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16696,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		TokenKey:      privateKey,
+		Revocations:   revocations,
+		HeartBeat:     500 * time.Millisecond,
+	})
+	waitForPort(t, 16696)
+
+	id := strings.Repeat("d", 32)
+	// 已吊销的令牌无法登录
+	conn, result := register(t, 16696, 16697, id, "", newToken("revoked", time.Hour))
+	_ = conn.Close()
+	if result != 4 {
+		t.Fatalf("Expect revoked token to fail, got %d", result)
+	}
+
+	// 已注册的隧道在令牌吊销后关闭
+	live := newToken("live", time.Hour)
+	conn, result = register(t, 16696, 16697, id, "", live)
+	defer conn.Close()
+	if result != 0 {
+		t.Fatalf("Expect success, got %d", result)
+	}
+	waitForPort(t, 16697)
+	if _, err = config.RevokeToken(file, live, "test"); err != nil {
+		t.Fatal(err)
+	}
+	waitForPortClosed(t, 16697)
+
+	// 已注册的隧道在令牌到期后关闭
+	conn, result = register(t, 16696, 16698, id, "", newToken("expiring", 2*time.Second))
+	defer conn.Close()
+	if result != 0 {
+		t.Fatalf("Expect success, got %d", result)
+	}
+	waitForPort(t, 16698)
+	waitForPortClosed(t, 16698)
+}
+
+// 吊销短期 key，已注册的隧道随之关闭
+func TestRevokeTrialKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "revoked.txt")
+	revocations, err := config.LoadRevocationList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16752,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		Revocations:   revocations,
+		HeartBeat:     500 * time.Millisecond,
+	})
+	waitForPort(t, 16752)
+
+	trialKey, err := config.NewTrialKey("winshu", time.Now().AddDate(0, 1, 0).Format("2006-01-02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.Repeat("e", 32)
+	conn, result := register(t, 16752, 16753, id, "", trialKey)
+	defer conn.Close()
+	if result != 0 {
+		t.Fatalf("Expect success, got %d", result)
+	}
+	waitForPort(t, 16753)
+
+	revokedID, err := config.RevokeToken(file, trialKey, "leaked")
+	if err != nil || !strings.HasPrefix(revokedID, "trial-") {
+		t.Fatalf("Unexpected revoked id %q %v", revokedID, err)
+	}
+	waitForPortClosed(t, 16753)
+
+	// 吊销后无法再次登录
+	conn, result = register(t, 16752, 16753, id, "", trialKey)
+	_ = conn.Close()
+	if result != 4 {
+		t.Fatalf("Expect revoked trial key to fail, got %d", result)
+	}
+}
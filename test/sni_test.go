@@ -0,0 +1,101 @@
+package test
+
+import (
+	"bytes"
+	"chuantou/config"
+	"chuantou/core"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 测试 SNI 路由
+
+// 通过 HTTPS 端口以指定 SNI 访问，返回对端证书及响应内容
+func getWithSNI(port uint32, serverName string) ([]byte, string, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", serverName); err != nil {
+		return nil, "", err
+	}
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	body := response[bytes.Index(response, []byte("\r\n\r\n"))+4:]
+	return conn.ConnectionState().PeerCertificates[0].Raw, string(body), nil
+}
+
+func TestSNIRouting(t *testing.T) {
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16675,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		HTTPSPort:     16676,
+	})
+
+	backends := make(map[string]*httptest.Server)
+	var mappings []config.NetAddress
+	for _, name := range []string{"app1", "app2"} {
+		name := name
+		backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, name)
+		}))
+		defer backend.Close()
+		backends[name] = backend
+
+		address, ok := config.ParseNetAddress(fmt.Sprintf("%s?sni=%s.example.com", backend.Listener.Addr().String(), name))
+		if !ok {
+			t.Fatal("Fail to parse sni mapping")
+		}
+		mappings = append(mappings, address)
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16675},
+		LocalAddr:  mappings,
+	})
+	waitForPort(t, 16676)
+
+	for _, name := range []string{"app1", "app2"} {
+		var cert []byte
+		var body string
+		var err error
+		// 等待映射注册完成
+		for i := 0; i < 100; i++ {
+			if cert, body, err = getWithSNI(16676, name+".example.com"); err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != name {
+			t.Fatalf("Unexpected response %q, expect %q", body, name)
+		}
+		// TLS 未被服务端终止，访问者看到的是内网服务的证书
+		if !bytes.Equal(cert, backends[name].Certificate().Raw) {
+			t.Fatalf("Unexpected certificate for %s", name)
+		}
+	}
+
+	if _, _, err := getWithSNI(16676, "unknown.example.com"); err == nil {
+		t.Fatal("Expect unknown server name to be rejected")
+	}
+}
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 测试 TLS 隧道
+
+// 生成自签名证书，返回证书、私钥文件路径及指纹
+func generateCert(t *testing.T) (string, string, string) {
+	certPEM, keyPEM, err := config.NewCert([]string{"127.0.0.1", "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := config.CertFingerprint(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, fingerprint
+}
+
+// 通过访问端口发送数据并校验回显
+func assertEcho(t *testing.T, port uint32) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("Unexpected echo %q", buf)
+	}
+}
+
+// 访问端口在一段时间内都不可用
+func assertPortClosed(t *testing.T, port uint32) {
+	time.Sleep(2 * time.Second)
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		_ = conn.Close()
+		t.Fatalf("Access port %d should not be registered", port)
+	}
+}
+
+func TestTLSTunnel(t *testing.T) {
+	certFile, keyFile, fingerprint := generateCert(t)
+	echoPort := startEchoServer(t)
+
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16663,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		TLSCert:       certFile,
+		TLSKey:        keyFile,
+	})
+
+	t.Run("fingerprint", func(t *testing.T) {
+		go core.Client(config.ClientConfig{
+			Key:            "winshu",
+			ServerAddr:     config.NetAddress{IP: "127.0.0.1", Port: 16663},
+			LocalAddr:      []config.NetAddress{{IP: "127.0.0.1", Port: echoPort, Port2: 16664}},
+			TLS:            true,
+			TLSFingerprint: fingerprint,
+		})
+		waitForPort(t, 16664)
+		assertEcho(t, 16664)
+	})
+
+	t.Run("ca", func(t *testing.T) {
+		go core.Client(config.ClientConfig{
+			Key:        "winshu",
+			ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16663},
+			LocalAddr:  []config.NetAddress{{IP: "127.0.0.1", Port: echoPort, Port2: 16665}},
+			TLS:        true,
+			TLSCA:      certFile,
+		})
+		waitForPort(t, 16665)
+		assertEcho(t, 16665)
+	})
+
+	t.Run("pin mismatch", func(t *testing.T) {
+		go core.Client(config.ClientConfig{
+			Key:            "winshu",
+			ServerAddr:     config.NetAddress{IP: "127.0.0.1", Port: 16663},
+			LocalAddr:      []config.NetAddress{{IP: "127.0.0.1", Port: echoPort, Port2: 16666}},
+			TLS:            true,
+			TLSFingerprint: "00" + fingerprint[2:],
+		})
+		assertPortClosed(t, 16666)
+	})
+}
@@ -0,0 +1,206 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试签名令牌
+
+// 生成签名密钥对并写入临时目录后读取
+func generateTokenKey(t *testing.T) (ed25519.PrivateKey, ed25519.PublicKey) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	privatePEM, publicPEM, err := config.NewTokenKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateFile, publicFile := filepath.Join(dir, "token.key"), filepath.Join(dir, "token.pub")
+	if err = ioutil.WriteFile(privateFile, privatePEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(publicFile, publicPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := config.LoadTokenPrivateKey(privateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := config.LoadTokenPublicKey(publicFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privateKey, publicKey
+}
+
+func TestTokenClaims(t *testing.T) {
+	privateKey, publicKey := generateTokenKey(t)
+
+	expiry, err := config.ParseExpiry("2099-12-31 18:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := config.NewToken(privateKey, config.TokenClaims{
+		Subject:    "alice",
+		ExpiresAt:  expiry.Unix(),
+		Ports:      "10000-10100,12000",
+		MaxTunnels: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.IsToken(token) {
+		t.Fatalf("Unexpected token format %s", token)
+	}
+	claims, err := config.CheckToken(publicKey, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.ID == "" || claims.Subject != "alice" || claims.MaxTunnels != 3 || claims.Expiry().Hour() != expiry.Hour() {
+		t.Fatalf("Unexpected claims %+v", claims)
+	}
+
+	// 篡改声明后签名失效
+	parts := strings.Split(token, ".")
+	parts[1] = parts[1][:len(parts[1])-2] + "AA"
+	if _, err = config.CheckToken(publicKey, strings.Join(parts, ".")); err == nil {
+		t.Fatal("Expect tampered token to fail")
+	}
+	// 其他密钥签发的令牌无效
+	_, otherPublicKey := generateTokenKey(t)
+	if _, err = config.CheckToken(otherPublicKey, token); err == nil {
+		t.Fatal("Expect token signed by other key to fail")
+	}
+	// 已到期
+	expired, _ := config.NewToken(privateKey, config.TokenClaims{Subject: "alice", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	if _, err = config.CheckToken(publicKey, expired); err == nil {
+		t.Fatal("Expect expired token to fail")
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	privateKey, _ := generateTokenKey(t)
+	token, err := config.NewToken(privateKey, config.TokenClaims{
+		Subject:    "alice",
+		ExpiresAt:  time.Now().Add(time.Hour).Unix(),
+		Ports:      "16686-16687",
+		MaxTunnels: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16685,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		TokenKey:      privateKey,
+	})
+	waitForPort(t, 16685)
+
+	id := strings.Repeat("b", 32)
+	cases := []struct {
+		name   string
+		port   uint32
+		key    string
+		expect byte
+	}{
+		{"legacy key without compatibility flag", 16686, "winshu", 4},
+		{"port out of token range", 16690, token, 6},
+		{"first tunnel", 16686, token, 0},
+		{"too many tunnels", 16687, token, 9},
+	}
+	for _, c := range cases {
+		conn, result := register(t, 16685, c.port, id, "", c.key)
+		if result != c.expect {
+			t.Fatalf("%s: expect %d, got %d", c.name, c.expect, result)
+		}
+		if result != 0 {
+			_ = conn.Close()
+		} else {
+			defer conn.Close()
+		}
+	}
+
+	// 开启兼容后仍接受共享 Key
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16688,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		TokenKey:      privateKey,
+		LegacyKeys:    true,
+	})
+	waitForPort(t, 16688)
+	conn, result := register(t, 16688, 16689, id, "", "winshu")
+	defer conn.Close()
+	if result != 0 {
+		t.Fatalf("Expect legacy key to be accepted, got %d", result)
+	}
+}
+
+func TestTrialKey(t *testing.T) {
+	privateKey, _ := generateTokenKey(t)
+	for _, port := range []uint32{16737, 16738} {
+		go core.Server(config.ServerConfig{
+			Key:           "winshu",
+			Port:          port,
+			MinAccessPort: 10000,
+			MaxAccessPort: 20000,
+			TokenKey:      privateKey,
+			LegacyKeys:    port == 16737,
+		})
+		waitForPort(t, port)
+	}
+
+	expired := time.Now().AddDate(0, 1, 0).Format("2006-01-02")
+	trialKey, err := config.NewTrialKey("winshu", expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredKey, _ := config.NewTrialKey("winshu", "2019-12-31")
+	otherKey, _ := config.NewTrialKey("another", expired)
+	// 只篡改到期日期，key 不变
+	_, key, _ := config.SplitTrialKey(trialKey)
+	forgedKey := time.Now().AddDate(1, 0, 0).Format("2006-01-02") + "." + key
+	hexKey := strings.Repeat("0123456789abcdef", 4)
+	if !config.IsTrialKey(trialKey) || config.IsTrialKey("winshu") || config.IsTrialKey(hexKey) || config.IsTrialKey(key) {
+		t.Fatal("Fail to recognize trial key")
+	}
+	if ex, ok := config.CheckKey("winshu", trialKey); !ok || ex.Format("2006-01-02") != expired {
+		t.Fatalf("Unexpected check result %v %v", ex, ok)
+	}
+
+	id := strings.Repeat("c", 32)
+	cases := []struct {
+		name   string
+		server uint32
+		key    string
+		expect byte
+	}{
+		{"expired trial key", 16737, expiredKey, 4},
+		{"trial key of another seed", 16737, otherKey, 4},
+		{"trial key with forged expiry", 16737, forgedKey, 4},
+		{"trial key without compatibility flag", 16738, trialKey, 4},
+		{"trial key with compatibility flag", 16737, trialKey, 0},
+	}
+	for _, c := range cases {
+		conn, result := register(t, c.server, 16739, id, "", c.key)
+		_ = conn.Close()
+		if result != c.expect {
+			t.Fatalf("%s: expect %d, got %d", c.name, c.expect, result)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试每月流量配额
+
+// 读取流量统计文件
+func readTrafficFile(file string) (month string, users, mappings map[string]uint64) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", nil, nil
+	}
+	var stats struct {
+		Month    string            `json:"month"`
+		Users    map[string]uint64 `json:"users"`
+		Mappings map[string]uint64 `json:"mappings"`
+	}
+	if err = json.Unmarshal(data, &stats); err != nil {
+		return "", nil, nil
+	}
+	return stats.Month, stats.Users, stats.Mappings
+}
+
+func TestTrafficQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traffic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trafficFile := filepath.Join(dir, "traffic.json")
+
+	echoPort := startEchoServer(t)
+	users := config.NewUserStore(config.User{Name: "dave", Secret: "dave-secret", MonthlyQuota: 8 << 10, Enabled: true})
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16716,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		Users:         users,
+		HeartBeat:     time.Second,
+		TrafficFile:   trafficFile,
+	})
+	go core.Client(config.ClientConfig{
+		Key:        "dave-secret",
+		User:       "dave",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16716},
+		LocalAddr:  []config.NetAddress{{IP: "127.0.0.1", Port: echoPort, Port2: 16717}},
+	})
+	waitForPort(t, 16717)
+
+	// 另一个访问者先建立连接，流量配额用完后再发送数据时被断开
+	active, err := dialEcho(16717)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+
+	// 包括两次握手共 8K，不足 64K 的流量在连接关闭时计入
+	conn, err := dialEcho(16717)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTransfer(t, conn, 4<<10-10)
+	_ = conn.Close()
+
+	// 配额用完后拒绝新的访问者连接
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err = dialEcho(16717)
+		if err != nil {
+			break
+		}
+		_ = conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("Expect visitor to be rejected after quota exceeded")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	_ = active.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = active.Write([]byte("hello")); err == nil {
+		_, err = io.ReadFull(active, make([]byte, 5))
+	}
+	if err == nil {
+		t.Fatal("Expect active visitor to be cut off after quota exceeded")
+	}
+
+	// 新的映射注册返回配额用完
+	id := strings.Repeat("f", 32)
+	conn, result := register(t, 16716, 16718, id, "dave", "dave-secret")
+	_ = conn.Close()
+	if result != 10 {
+		t.Fatalf("Expect quota exceeded, got %d", result)
+	}
+
+	// 心跳时保存统计
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		month, users, mappings := readTrafficFile(trafficFile)
+		if users["dave"] >= 8<<10 {
+			if month != time.Now().Format("2006-01") || mappings["16717"] != users["dave"] {
+				t.Fatalf("Unexpected traffic stats %s %v %v", month, users, mappings)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expect traffic stats to be saved")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// 重启后统计仍然有效
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16719,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		Users:         users,
+		TrafficFile:   trafficFile,
+	})
+	waitForPort(t, 16719)
+	conn, result = register(t, 16719, 16718, id, "dave", "dave-secret")
+	_ = conn.Close()
+	if result != 10 {
+		t.Fatalf("Expect quota exceeded after restart, got %d", result)
+	}
+}
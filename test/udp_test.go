@@ -0,0 +1,154 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// 测试 UDP 转发
+
+// 启动本地 UDP 回显服务，返回监听端口
+func startUDPEchoServer(t *testing.T) uint32 {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = packetConn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return uint32(packetConn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// 发送数据报并等待回显
+// UDP 可能丢包，访问端口未就绪时还会收到 connection refused，失败时重试
+func udpEcho(conn net.Conn, payload string) (string, error) {
+	buf := make([]byte, 64*1024)
+	var err error
+	for i := 0; i < 100; i++ {
+		if _, err = conn.Write([]byte(payload)); err == nil {
+			_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			var n int
+			if n, err = conn.Read(buf); err == nil {
+				return string(buf[:n]), nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return "", err
+}
+
+func TestUDPTunnel(t *testing.T) {
+	echoPort := startUDPEchoServer(t)
+
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16671,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+	})
+
+	local, ok := config.ParseNetAddress(fmt.Sprintf("udp://127.0.0.1:%d:16672", echoPort))
+	if !ok || !local.IsUDP() {
+		t.Fatal("Fail to parse udp mapping")
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16671},
+		LocalAddr:  []config.NetAddress{local},
+	})
+
+	// 多个访问者各自对应独立会话
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("udp", "127.0.0.1:16672")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 5; j++ {
+			payload := fmt.Sprintf("visitor %d datagram %d", i, j)
+			reply, err := udpEcho(conn, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply != payload {
+				t.Fatalf("Unexpected reply %q, expect %q", reply, payload)
+			}
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestParseUDPAddress(t *testing.T) {
+	addr, ok := config.ParseNetAddress("udp://127.0.0.1:53:10053")
+	if !ok || !addr.IsUDP() || addr.Port != 53 || addr.Port2 != 10053 {
+		t.Fatalf("Unexpected address %+v", addr)
+	}
+	if addr.FullString() != "udp://127.0.0.1:53:10053" {
+		t.Fatalf("Unexpected full string %s", addr.FullString())
+	}
+	if addr, ok = config.ParseNetAddress("tcp://127.0.0.1:3306"); !ok || addr.IsUDP() {
+		t.Fatalf("Unexpected address %+v", addr)
+	}
+	if _, ok = config.ParseNetAddress("sctp://127.0.0.1:3306"); ok {
+		t.Fatal("Expect unknown network to fail")
+	}
+}
+
+// 超出限速的数据报直接丢弃，不阻塞其他访问者
+func TestUDPDropWhenLimited(t *testing.T) {
+	echoPort := startUDPEchoServer(t)
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16754,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+	})
+	local, ok := config.ParseNetAddress(fmt.Sprintf("udp://127.0.0.1:%d:16755?bandwidth=16K&burst=16K", echoPort))
+	if !ok {
+		t.Fatal("Fail to parse udp mapping")
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16754},
+		LocalAddr:  []config.NetAddress{local},
+	})
+
+	flood, err := net.Dial("udp", "127.0.0.1:16755")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flood.Close()
+	if _, err = udpEcho(flood, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	// 约为限速的 12 倍，阻塞时读循环需要十余秒才能处理完
+	payload := make([]byte, 1024)
+	for i := 0; i < 200; i++ {
+		_, _ = flood.Write(payload)
+	}
+
+	// 令牌补充后其他访问者立即可用
+	time.Sleep(1200 * time.Millisecond)
+	conn, err := net.Dial("udp", "127.0.0.1:16755")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if reply, err := udpEcho(conn, "other visitor"); err != nil || reply != "other visitor" {
+		t.Fatalf("Unexpected reply %q %v", reply, err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("Expect other visitor not to be blocked, took %s", elapsed)
+	}
+}
@@ -0,0 +1,204 @@
+package test
+
+import (
+	"bytes"
+	"chuantou/config"
+	"chuantou/core"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试多用户
+
+// 构造请求帧，携带挑战应答，只有旧版短期 key 随请求发送
+func requestFrame(accessPort uint32, id, user, token, expiry string, proof []byte) []byte {
+	body := bytes.NewBuffer([]byte{})
+	writeField := func(fieldType byte, value []byte) {
+		body.WriteByte(fieldType)
+		_ = binary.Write(body, binary.BigEndian, uint16(len(value)))
+		body.Write(value)
+	}
+	writeUint32 := func(fieldType byte, value uint32) {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, value)
+		writeField(fieldType, data)
+	}
+	writeField(1, []byte{0})
+	writeUint32(2, core.Version)
+	writeUint32(3, accessPort)
+	writeField(4, []byte(id))
+	writeField(14, []byte(user))
+	if token != "" {
+		writeField(17, []byte(token))
+	}
+	if expiry != "" {
+		writeField(28, []byte(expiry))
+	}
+	writeField(16, proof)
+
+	frame := bytes.NewBuffer([]byte{0x1C, 0xC7, 1, 1})
+	_ = binary.Write(frame, binary.BigEndian, uint32(body.Len()))
+	frame.Write(body.Bytes())
+	return frame.Bytes()
+}
+
+// 挑战应答：HMAC-SHA256(密钥, 随机数|机器码|访问端口)
+func proofOf(secret, nonce []byte, id string, port uint32) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write([]byte(id))
+	_ = binary.Write(mac, binary.BigEndian, port)
+	return mac.Sum(nil)
+}
+
+// 读取一帧，返回各字段
+func readFields(t *testing.T, conn net.Conn) map[byte][]byte {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[4:8]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	fields := make(map[byte][]byte)
+	for len(body) >= 3 {
+		length := int(binary.BigEndian.Uint16(body[1:3]))
+		if len(body) < 3+length {
+			t.Fatalf("Truncated field %v", body)
+		}
+		fields[body[0]] = body[3 : 3+length]
+		body = body[3+length:]
+	}
+	if len(fields[1]) != 1 {
+		t.Fatalf("Unexpected fields %v", fields)
+	}
+	return fields
+}
+
+// 握手后以挑战应答发送注册请求，返回连接及注册结果
+// key 为令牌时只发送声明，以签名作为密钥，为短期 key 时只发送到期日期
+func register(t *testing.T, port, accessPort uint32, id, user, key string) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(helloFrame(core.Version, 2, 2, 9)); err != nil {
+		t.Fatal(err)
+	}
+	fields := readFields(t, conn)
+	if fields[1][0] != 0 || len(fields[15]) == 0 {
+		t.Fatalf("Fail to hello, fields = %v", fields)
+	}
+
+	secret, token, expiry := []byte(key), "", ""
+	if config.IsToken(key) {
+		if token, secret, err = config.SplitToken(key); err != nil {
+			t.Fatal(err)
+		}
+	} else if expired, trialKey, ok := config.SplitTrialKey(key); ok {
+		expiry, secret = expired, []byte(trialKey)
+	}
+	if _, err = conn.Write(requestFrame(accessPort, id, user, token, expiry, proofOf(secret, fields[15], id, accessPort))); err != nil {
+		t.Fatal(err)
+	}
+	return conn, readFields(t, conn)[1][0]
+}
+
+func TestUserAccounts(t *testing.T) {
+	users := config.NewUserStore(
+		config.User{Name: "alice", Secret: "alice-secret", PortRanges: []config.PortRange{{Min: 16682, Max: 16684}}, MaxMappings: 2, Enabled: true},
+		config.User{Name: "bob", Secret: "bob-secret", Enabled: true},
+		config.User{Name: "carol", Secret: "carol-secret", Enabled: false},
+	)
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16681,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		Users:         users,
+	})
+	waitForPort(t, 16681)
+
+	id := strings.Repeat("a", 32)
+	cases := []struct {
+		name   string
+		port   uint32
+		user   string
+		key    string
+		expect byte
+	}{
+		{"shared key", 16682, "", "winshu", 4},
+		{"wrong secret", 16682, "alice", "bob-secret", 4},
+		{"disabled user", 16682, "carol", "carol-secret", 4},
+		{"port out of user range", 16690, "alice", "alice-secret", 6},
+		{"first mapping", 16682, "alice", "alice-secret", 0},
+		{"second mapping", 16683, "alice", "alice-secret", 0},
+		{"too many mappings", 16684, "alice", "alice-secret", 9},
+		{"port of other user", 16682, "bob", "bob-secret", 7},
+	}
+	for _, c := range cases {
+		conn, result := register(t, 16681, c.port, id, c.user, c.key)
+		if result != c.expect {
+			t.Fatalf("%s: expect %d, got %d", c.name, c.expect, result)
+		}
+		// 成功的映射保持连接
+		if result != 0 {
+			_ = conn.Close()
+		} else {
+			defer conn.Close()
+		}
+	}
+}
+
+func TestLoadUserStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "users.ini")
+	content := "[alice]\nsecret = 123456\nport-range = 10000-10100, 12000\nmax-mappings = 5\n\n[bob]\nsecret = abcdef\nenabled = false\n"
+	if err = ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := config.LoadUserStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, ok := store.Get("alice")
+	if !ok || !alice.Enabled || alice.MaxMappings != 5 || len(alice.PortRanges) != 2 {
+		t.Fatalf("Unexpected user %+v", alice)
+	}
+	if !alice.PortAllowed(10100) || !alice.PortAllowed(12000) || alice.PortAllowed(12001) {
+		t.Fatalf("Unexpected port ranges %v", alice.PortRanges)
+	}
+	if bob, ok := store.Get("bob"); !ok || bob.Enabled || !bob.PortAllowed(30000) {
+		t.Fatalf("Unexpected user %+v", bob)
+	}
+
+	// 用户缺少密钥时加载失败，保留原有用户
+	if err = ioutil.WriteFile(file, []byte("[eve]\nport-range = 10000\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Reload(); err == nil {
+		t.Fatal("Expect user without secret to fail")
+	}
+	if _, ok = store.Get("alice"); !ok {
+		t.Fatal("Expect users to be kept after failed reload")
+	}
+}
@@ -0,0 +1,207 @@
+package test
+
+import (
+	"chuantou/config"
+	"chuantou/core"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 测试 HTTP 域名路由
+
+// 启动本地 web 服务，返回监听端口，响应内容为 name
+func startWebServer(t *testing.T, name string) uint32 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, "%s %s", name, r.Host)
+		}))
+	}()
+	return uint32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// 以指定 Host 访问 HTTP 端口
+func getWithHost(t *testing.T, port uint32, host string) (int, string) {
+	request, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/", port), nil)
+	request.Host = host
+	client := http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	return response.StatusCode, string(body)
+}
+
+func TestHTTPVirtualHost(t *testing.T) {
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16673,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		HTTPPort:      16674,
+	})
+
+	var mappings []config.NetAddress
+	for _, name := range []string{"app1", "app2"} {
+		address, ok := config.ParseNetAddress(fmt.Sprintf("127.0.0.1:%d?domain=%s.example.com", startWebServer(t, name), name))
+		if !ok {
+			t.Fatal("Fail to parse domain mapping")
+		}
+		mappings = append(mappings, address)
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16673},
+		LocalAddr:  mappings,
+	})
+	waitForPort(t, 16674)
+
+	// 等待两个域名都注册完成
+	for i := 0; i < 100; i++ {
+		code1, _ := getWithHost(t, 16674, "app1.example.com")
+		code2, _ := getWithHost(t, 16674, "app2.example.com")
+		if code1 == http.StatusOK && code2 == http.StatusOK {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if code, body := getWithHost(t, 16674, "APP1.example.com:16674"); code != http.StatusOK || body != "app1 APP1.example.com:16674" {
+		t.Fatalf("Unexpected response %d %q", code, body)
+	}
+	if code, body := getWithHost(t, 16674, "app2.example.com"); code != http.StatusOK || body != "app2 app2.example.com" {
+		t.Fatalf("Unexpected response %d %q", code, body)
+	}
+	if code, _ := getWithHost(t, 16674, "unknown.example.com"); code != http.StatusNotFound {
+		t.Fatalf("Expect 404 for unknown host, got %d", code)
+	}
+}
+
+// 域名映射的连接限制按请求计算，超出时返回 503
+func TestHTTPVirtualHostConnLimit(t *testing.T) {
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16740,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		HTTPPort:      16741,
+	})
+
+	// 访问 /slow 时阻塞到 release 关闭
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, release := make(chan struct{}, 1), make(chan struct{})
+	go func() {
+		_ = http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				received <- struct{}{}
+				<-release
+			}
+			_, _ = fmt.Fprint(w, "limited")
+		}))
+	}()
+	address, ok := config.ParseNetAddress(fmt.Sprintf("%s?domain=limited.example.com&max-conns=1", listener.Addr().String()))
+	if !ok {
+		t.Fatal("Fail to parse domain mapping")
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16740},
+		LocalAddr:  []config.NetAddress{address},
+	})
+	waitForPort(t, 16741)
+	for i := 0; i < 100; i++ {
+		if code, _ := getWithHost(t, 16741, "limited.example.com"); code == http.StatusOK {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		request, _ := http.NewRequest("GET", "http://127.0.0.1:16741/slow", nil)
+		request.Host = "limited.example.com"
+		response, err := (&http.Client{Timeout: 5 * time.Second}).Do(request)
+		if err != nil {
+			done <- 0
+			return
+		}
+		_ = response.Body.Close()
+		done <- response.StatusCode
+	}()
+	<-received
+	if code, _ := getWithHost(t, 16741, "limited.example.com"); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expect 503 when connections are saturated, got %d", code)
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("Expect slow request to succeed, got %d", code)
+	}
+	// 按域名直接查找映射，数字只作为访问端口
+	if stats, ok := core.ConnectionStats("LIMITED.example.com"); !ok || stats.Rejected != 1 {
+		t.Fatalf("Unexpected stats %+v %v", stats, ok)
+	}
+	if _, ok := core.ConnectionStats("16741"); ok {
+		t.Fatal("Expect HTTP port not to be a mapping")
+	}
+	if code, body := getWithHost(t, 16741, "limited.example.com"); code != http.StatusOK || body != "limited" {
+		t.Fatalf("Unexpected response %d %q", code, body)
+	}
+}
+
+// 域名映射的访问控制由服务端按请求检查，客户端不因访问者地址未知而拒绝
+func TestHTTPVirtualHostACL(t *testing.T) {
+	go core.Server(config.ServerConfig{
+		Key:           "winshu",
+		Port:          16750,
+		MinAccessPort: 10000,
+		MaxAccessPort: 20000,
+		HTTPPort:      16751,
+	})
+	var mappings []config.NetAddress
+	for _, item := range []string{"allowed.example.com&allow=127.0.0.1", "denied.example.com&deny=127.0.0.0/8"} {
+		address, ok := config.ParseNetAddress(fmt.Sprintf("127.0.0.1:%d?domain=%s", startWebServer(t, "acl"), item))
+		if !ok {
+			t.Fatalf("Fail to parse domain mapping %s", item)
+		}
+		mappings = append(mappings, address)
+	}
+	go core.Client(config.ClientConfig{
+		Key:        "winshu",
+		ServerAddr: config.NetAddress{IP: "127.0.0.1", Port: 16750},
+		LocalAddr:  mappings,
+	})
+	waitForPort(t, 16751)
+
+	var code int
+	var body string
+	for i := 0; i < 100; i++ {
+		if code, body = getWithHost(t, 16751, "allowed.example.com"); code == http.StatusOK {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if code != http.StatusOK || body != "acl allowed.example.com" {
+		t.Fatalf("Unexpected response %d %q", code, body)
+	}
+	for i := 0; i < 100; i++ {
+		if code, _ = getWithHost(t, 16751, "denied.example.com"); code != http.StatusNotFound {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if code != http.StatusForbidden {
+		t.Fatalf("Expect 403 for denied visitor, got %d", code)
+	}
+}